@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"time"
+
+	"mash-db/pkg/pager"
+	"mash-db/pkg/vfs"
 )
 
 const version = "0.1.0"
@@ -13,19 +21,248 @@ func main() {
 		os.Exit(1)
 	}
 
+	switch os.Args[1] {
+	case "vacuum":
+		if len(os.Args) != 3 {
+			printUsage()
+			os.Exit(1)
+		}
+		if err := vacuum(os.Args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "backup":
+		flags := flag.NewFlagSet("backup", flag.ExitOnError)
+		flags.Usage = printUsage
+		incremental := flags.Bool("incremental", false, "back up only the pages changed since an epoch")
+		since := flags.Uint("since", 0, "epoch of the earlier backup")
+		track := flags.Bool("track-changes", false, "make the database track changes first, for incremental backups after this one")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() != 2 || (*incremental && *track) {
+			printUsage()
+			os.Exit(1)
+		}
+		var err error
+		if *incremental {
+			err = backupDelta(flags.Arg(0), flags.Arg(1), uint32(*since))
+		} else {
+			err = backup(flags.Arg(0), flags.Arg(1), *track)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "restore":
+		if len(os.Args) < 4 {
+			printUsage()
+			os.Exit(1)
+		}
+		if err := restore(os.Args[2], os.Args[3], os.Args[4:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	dbPath := os.Args[1]
 	fmt.Printf("MashDB v%s\n", version)
-	fmt.Printf("Opening database: %s\n", dbPath)
+	if dbPath == pager.MemoryPath {
+		fmt.Println("Opening in-memory database")
+	} else {
+		fmt.Printf("Opening database: %s\n", dbPath)
+	}
+
+	p, err := pager.New(dbPath, 100)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer p.Close()
+	fmt.Printf("Page size: %d, pages: %d\n", p.PageSize(), p.NumPages())
 
-	// TODO: Initialize pager, btree, and start REPL
+	// TODO: Initialize btree and start REPL
 	fmt.Println("Database engine not yet implemented. Coming soon!")
 }
 
+// vacuum cuts the free pages at the end of a database file off
+// Pages are not moved over free ones further down: what refers to a page by
+// number is up to the pager's users, and the tool cannot update it.
+func vacuum(dbPath string) error {
+	p, err := openExisting(dbPath)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	pages := p.NumPages()
+	n, err := p.TruncateFree()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Vacuumed %s: %d pages -> %d pages, %d free pages left\n", dbPath, pages, pages-n, p.FreelistCount())
+	return p.Close()
+}
+
+// backup copies a database file into a backup file while it may be in use
+// The backup is a database file itself, and the base for incremental backups
+// once the database tracks changes, which track turns on first.
+func backup(srcPath, dstPath string, track bool) error {
+	src, err := openExisting(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if track {
+		if err := src.EnableTrackChanges(); err != nil {
+			return err
+		}
+	}
+
+	var b *pager.Backup
+	err = writeFile(dstPath, func(f *os.File) error {
+		b = src.BackupWriter(f)
+		return runBackup(b, srcPath)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %s to %s: %d pages at epoch %d, %d restarts\n",
+		srcPath, dstPath, b.PageCount(), b.Epoch(), b.Restarts())
+	return nil
+}
+
+// backupDelta writes the pages of a database file changed since epoch into
+// an incremental backup file
+func backupDelta(srcPath, dstPath string, epoch uint32) error {
+	src, err := openExisting(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var b *pager.Backup
+	err = writeFile(dstPath, func(f *os.File) error {
+		b = src.BackupDelta(f, epoch)
+		return runBackup(b, srcPath)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backed up changes to %s since epoch %d to %s: epoch %d, %d restarts\n",
+		srcPath, epoch, dstPath, b.Epoch(), b.Restarts())
+	return nil
+}
+
+// openExisting opens a database file, refusing to create one that is missing
+// Other processes may be using the file, so locks are waited for a while.
+func openExisting(dbPath string) (*pager.Pager, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, err
+	}
+	return pager.NewWithOptions(dbPath, pager.Options{CacheSize: 100, BusyTimeout: 5 * time.Second})
+}
+
+// runBackup runs a backup to completion, showing its progress
+func runBackup(b *pager.Backup, srcPath string) error {
+	b.Progress = func(remaining, total uint32) {
+		fmt.Printf("\rBacking up %s: %d/%d pages", srcPath, total-remaining, total)
+	}
+	err := b.Run(100, 10*time.Millisecond)
+	fmt.Println()
+	return err
+}
+
+// restore rebuilds a database file from a backup and the incremental
+// backups taken after it, in order
+func restore(dbPath, basePath string, deltaPaths []string) error {
+	if _, err := os.Stat(dbPath); err == nil {
+		return fmt.Errorf("%s already exists", dbPath)
+	}
+	err := writeFile(dbPath, func(f *os.File) error {
+		base, err := os.Open(basePath)
+		if err != nil {
+			return err
+		}
+		defer base.Close()
+		if _, err := io.Copy(f, base); err != nil {
+			return err
+		}
+
+		image, err := vfs.OS.Open(f.Name(), 0)
+		if err != nil {
+			return err
+		}
+		defer image.Close()
+		for _, deltaPath := range deltaPaths {
+			if err := applyDelta(image, deltaPath); err != nil {
+				return fmt.Errorf("%s: %w", deltaPath, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s from %s and %d incremental backups\n", dbPath, basePath, len(deltaPaths))
+	return nil
+}
+
+// applyDelta applies an incremental backup file to a database image
+func applyDelta(image vfs.File, deltaPath string) error {
+	f, err := os.Open(deltaPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pager.ApplyDelta(image, bufio.NewReader(f))
+}
+
+// writeFile creates path by writing a temporary file next to it and renaming
+// it into place, so path never holds a partial file
+func writeFile(path string, write func(f *os.File) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := write(f); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
 func printUsage() {
 	fmt.Println("MashDB - A simple SQLite-like database in Go")
 	fmt.Println()
 	fmt.Println("Usage: mashdb <database-file>")
+	fmt.Println("       mashdb vacuum <database-file>")
+	fmt.Println("       mashdb backup [--track-changes | --incremental --since <epoch>] <database-file> <backup-file>")
+	fmt.Println("       mashdb restore <database-file> <backup-file> [<incremental-backup-file>...]")
+	fmt.Println()
+	fmt.Println("Use :memory: as the file name for a database that lives only in memory.")
+	fmt.Println("vacuum cuts the free pages at the end of the file off. It moves no pages, as")
+	fmt.Println("it cannot update what refers to them, so free pages further down remain.")
+	fmt.Println("backup copies the database while other processes keep using it. With")
+	fmt.Println("--incremental it copies only the pages changed since the backup at <epoch>,")
+	fmt.Println("which takes a database that tracks changes. --track-changes makes an existing")
+	fmt.Println("database track them before copying it, if its pages have room for the stamps.")
+	fmt.Println("restore rebuilds a database from a backup and the incremental backups after it.")
 	fmt.Println()
 	fmt.Println("Example:")
 	fmt.Println("  mashdb mydb.db")
+	fmt.Println("  mashdb :memory:")
+	fmt.Println("  mashdb vacuum mydb.db")
+	fmt.Println("  mashdb backup --track-changes mydb.db mydb.bak")
+	fmt.Println("  mashdb backup --incremental --since 42 mydb.db mydb.1.delta")
+	fmt.Println("  mashdb restore restored.db mydb.bak mydb.1.delta")
 }
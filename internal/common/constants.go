@@ -1,9 +1,14 @@
 package common
 
 const (
-	// PageSize is the size of each page in bytes (4KB)
+	// PageSize is the default size of each page in bytes (4KB)
 	PageSize = 4096
 
+	// MinPageSize and MaxPageSize bound the configurable page size
+	// Any power of two in this range is accepted
+	MinPageSize = 512
+	MaxPageSize = 65536
+
 	// MaxPages is the maximum number of pages in a database file
 	MaxPages = 1000000
 
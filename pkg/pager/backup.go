@@ -0,0 +1,367 @@
+package pager
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"mash-db/internal/common"
+)
+
+// Online backup
+//
+// A Backup copies a consistent snapshot of a database while the source stays
+// open and in use, in the manner of SQLite's online backup. The copy proceeds
+// in steps, each of which holds the source's lock only while it reads a few
+// pages. Each step reads the committed images of its pages from storage and
+// leaves changes that are not committed yet alone; it never commits anything
+// on the source's behalf. Once such changes have reached the file or the
+// log, by eviction or FlushPage, the committed images are out of reach and
+// the step fails with ErrSourceBusy until the source commits or rolls back.
+// Each step also compares the committed change counter with the one the copy
+// started at. If the source committed anything in between, the copy starts
+// over from the first page.
+//
+// The destination is either another pager or an io.Writer. A pager receives
+// the pages within a transaction that commits once the copy is complete, so
+// it never holds half a snapshot. A writer receives the image of an
+// uncompressed database file, or from BackupDelta an incremental backup of
+// the pages changed since an earlier one. Unless the writer is also an
+// io.WriterAt, it cannot be rewound, and a change to the source mid-copy
+// fails with ErrSourceChanged.
+
+var (
+	ErrSourceChanged    = errors.New("source changed during backup")
+	ErrIncompatibleDest = errors.New("backup destination has a different page size or fewer usable bytes per page")
+	ErrBackupToSelf     = errors.New("backup source and destination are the same pager")
+	ErrSourceBusy       = errors.New("backup source has uncommitted changes in storage")
+)
+
+// DefaultBackupBusyTimeout is how long Run waits out a busy or locked source
+// when Backup.BusyTimeout is zero
+const DefaultBackupBusyTimeout = time.Minute
+
+// Backup is an online copy of a database in progress
+// A Backup is not safe for concurrent use; the source and destination pagers
+// may be used as usual meanwhile.
+type Backup struct {
+	src *Pager
+	dst *Pager    // Destination pager, or
+	w   io.Writer // destination writer
+	tx  *Tx       // Transaction on dst holding the copy until it is complete
+
+	delta bool   // w receives an incremental backup
+	since uint32 // Epoch the incremental backup holds the changes since
+
+	// Progress, if set, is called after every step with the number of pages
+	// still to copy and the number of pages in the snapshot
+	Progress func(remaining, total uint32)
+
+	// BusyTimeout is how long Run keeps retrying a source that stays busy or
+	// locked by another process; zero selects DefaultBackupBusyTimeout
+	BusyTimeout time.Duration
+
+	header   Header // Source header the snapshot was taken at
+	started  bool
+	next     uint32 // Next page to copy
+	off      int64  // Bytes written to w
+	count    uint32 // Pages written
+	restarts int
+	done     bool
+}
+
+// backupPage is a page read for a Backup
+type backupPage struct {
+	pageNum uint32
+	data    []byte
+}
+
+// Backup starts copying the database into dst, replacing its contents
+// dst must have the same page size as the database and at least as many
+// usable bytes per page. It stays in a transaction until the copy is
+// complete or the Backup is closed.
+func (p *Pager) Backup(dst *Pager) (*Backup, error) {
+	if dst == p {
+		return nil, ErrBackupToSelf
+	}
+	if dst.PageSize() != p.PageSize() || dst.UsableSize() < p.UsableSize() {
+		return nil, ErrIncompatibleDest
+	}
+	tx, err := dst.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Backup{src: p, dst: dst, tx: tx}, nil
+}
+
+// BackupWriter starts copying the database to w as the image of an
+// uncompressed database file
+// An encrypted database stays encrypted with the same key.
+func (p *Pager) BackupWriter(w io.Writer) *Backup {
+	return &Backup{src: p, w: w}
+}
+
+// Step copies up to n pages, or every page left if n is not positive, and
+// reports whether the copy is complete
+// While uncommitted changes of the source have reached storage, Step fails
+// with ErrSourceBusy and may be retried later.
+func (b *Backup) Step(n int) (bool, error) {
+	if b.done {
+		return true, nil
+	}
+
+	pages, end, err := b.src.backupPages(b, n)
+	if err != nil {
+		return false, err
+	}
+	if err := b.write(pages); err != nil {
+		return false, err
+	}
+	b.next = end
+
+	if b.next >= b.header.PageCount {
+		if err := b.finish(); err != nil {
+			return false, err
+		}
+		b.done = true
+	}
+	if b.Progress != nil {
+		b.Progress(b.Remaining(), b.header.PageCount)
+	}
+	return b.done, nil
+}
+
+// Run copies n pages per step, pausing between steps, until the copy is
+// complete, and closes the Backup
+// A step that finds the source busy, or locked by another process's commit,
+// is retried until BusyTimeout has passed without a step getting through.
+func (b *Backup) Run(n int, pause time.Duration) error {
+	defer b.Close()
+	timeout := cmp.Or(b.BusyTimeout, DefaultBackupBusyTimeout)
+	var busySince time.Time
+	for {
+		done, err := b.Step(n)
+		switch {
+		case err == nil:
+			busySince = time.Time{}
+		case !errors.Is(err, ErrSourceBusy) && !errors.Is(err, ErrDatabaseLocked):
+			return err
+		case busySince.IsZero():
+			busySince = time.Now()
+		case time.Since(busySince) > timeout:
+			return err
+		}
+		if done {
+			return nil
+		}
+		time.Sleep(pause)
+	}
+}
+
+// Remaining returns the number of pages still to copy
+func (b *Backup) Remaining() uint32 {
+	return b.header.PageCount - b.next
+}
+
+// PageCount returns the number of pages in the snapshot being copied
+func (b *Backup) PageCount() uint32 {
+	return b.header.PageCount
+}
+
+// Epoch returns the epoch of the snapshot being copied, the change counter
+// of the last commit it includes
+// A later BackupDelta passed the epoch copies only what changed after it.
+func (b *Backup) Epoch() uint32 {
+	return b.header.ChangeCounter
+}
+
+// Restarts returns how often the copy started over because the source changed
+func (b *Backup) Restarts() int {
+	return b.restarts
+}
+
+// Close ends the backup
+// A destination pager whose copy is not complete is rolled back to its
+// previous contents.
+func (b *Backup) Close() error {
+	if b.done || b.tx == nil {
+		return nil
+	}
+	b.done = true
+	return b.tx.Rollback()
+}
+
+// backupPages reads the committed images of the pages of the snapshot b
+// copies from the next one on, up to n of them, starting it over if the
+// database changed
+// It returns the pages to write and the page to continue from. Pages for a
+// pager are returned as callers see them, pages for a writer as stored.
+func (p *Pager) backupPages(b *Backup, n int) ([]backupPage, uint32, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed.Load() {
+		return nil, 0, ErrFileClosed
+	}
+	if err := p.lockShared(); err != nil {
+		return nil, 0, err
+	}
+	defer p.releaseLock()
+	if p.spilled || (p.wal != nil && len(p.wal.pending) > 0) || (p.store != nil && p.store.changed) {
+		return nil, 0, ErrSourceBusy
+	}
+
+	if !b.started || p.committed.ChangeCounter != b.header.ChangeCounter {
+		if b.started {
+			if _, ok := b.w.(io.WriterAt); b.off > 0 && !ok {
+				return nil, 0, ErrSourceChanged
+			}
+			b.restarts++
+		}
+		if b.delta && !p.committed.PageEpochs {
+			return nil, 0, ErrNoPageEpochs
+		}
+		if b.delta && b.since > p.committed.ChangeCounter {
+			return nil, 0, fmt.Errorf("%w: %d", ErrFutureEpoch, b.since)
+		}
+		b.started = true
+		b.header = p.committed
+		b.next = common.HeaderPageNum
+		if b.dst != nil {
+			b.next++
+		}
+		b.off, b.count = 0, 0
+	}
+
+	end := b.header.PageCount
+	if n > 0 {
+		end = min(end, b.next+uint32(n))
+	}
+	var pages []backupPage
+	var buf []byte
+	for pageNum := b.next; pageNum < end; pageNum++ {
+		if buf == nil {
+			buf = make([]byte, p.pageSize)
+		}
+		switch {
+		case pageNum == common.HeaderPageNum:
+			// The copy is a plain file of pages, whatever the source is
+			header := b.header
+			header.Compression = CompressionNone
+			header.PageMapSlot, header.PageMapSlots, header.PageMapCRC = 0, 0, 0
+			header.encode(buf)
+			p.sealInto(pageNum, buf, buf)
+		case b.w == nil:
+			if err := p.readPageFromDisk(pageNum, buf); err != nil {
+				return nil, 0, err
+			}
+			clear(buf[p.usable:])
+		default:
+			if err := p.readPageImage(pageNum, buf); err != nil {
+				return nil, 0, err
+			}
+			if b.delta {
+				changed, err := p.changedSince(pageNum, buf, b.since)
+				if err != nil {
+					return nil, 0, err
+				}
+				if !changed {
+					continue
+				}
+			}
+			if allZero(buf) {
+				// A page never written is sealed in the copy, where it
+				// lies inside the file
+				p.sealInto(pageNum, buf, buf)
+			}
+		}
+		pages = append(pages, backupPage{pageNum: pageNum, data: buf})
+		buf = nil
+	}
+	return pages, end, nil
+}
+
+// write hands pages read by backupPages to the destination
+func (b *Backup) write(pages []backupPage) error {
+	for _, page := range pages {
+		var err error
+		switch {
+		case b.w == nil:
+			err = b.dst.WritePage(page.pageNum, page.data)
+		case b.delta:
+			err = b.emit(b.deltaRecord(page))
+		default:
+			err = b.emit(page.data)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to back up page %d: %w", page.pageNum, err)
+		}
+		b.next = page.pageNum + 1
+		b.count++
+	}
+	return nil
+}
+
+// emit appends data to what the backup wrote to w
+func (b *Backup) emit(data []byte) error {
+	var err error
+	if w, ok := b.w.(io.WriterAt); ok {
+		_, err = w.WriteAt(data, b.off)
+	} else {
+		_, err = b.w.Write(data)
+	}
+	if err != nil {
+		return err
+	}
+	b.off += int64(len(data))
+	return nil
+}
+
+// finish completes the copy once every page is written
+func (b *Backup) finish() error {
+	if b.dst == nil {
+		if b.delta {
+			if err := b.emit(deltaTrailer(b.count)); err != nil {
+				return fmt.Errorf("failed to finish backup: %w", err)
+			}
+		}
+		// A writer rewound by a restart may hold more than this copy
+		if t, ok := b.w.(interface{ Truncate(int64) error }); ok {
+			if err := t.Truncate(b.off); err != nil {
+				return fmt.Errorf("failed to truncate backup: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if err := b.dst.restoreHeader(b.header); err != nil {
+		return err
+	}
+	return b.tx.Commit()
+}
+
+// restoreHeader gives the database the size, freelist and schema cookie of
+// a backed up header (must be in a transaction)
+func (p *Pager) restoreHeader(h Header) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed.Load() {
+		return ErrFileClosed
+	}
+
+	// The freelist pages have all been overwritten; the backed up list
+	// replaces it once the pages past the copy are gone
+	p.header.FreelistHead, p.header.FreelistCount = 0, 0
+	clear(p.free)
+	if err := p.truncateInternal(min(h.PageCount, p.numPages.Load())); err != nil {
+		return err
+	}
+	p.header.FreelistHead, p.header.FreelistCount = h.FreelistHead, h.FreelistCount
+	p.free = nil
+	p.header.SchemaCookie = h.SchemaCookie
+	p.dirty = true
+	return nil
+}
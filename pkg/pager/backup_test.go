@@ -0,0 +1,299 @@
+package pager
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"mash-db/pkg/vfs"
+)
+
+// newBackupSource creates a database of n pages holding their own number,
+// with pages 5 and 6 freed and the schema cookie set
+func newBackupSource(t *testing.T, n uint32, opts Options) *Pager {
+	t.Helper()
+	p := newTestDB(t, filepath.Join(t.TempDir(), "src.db"), opts, n, ownNumber)
+	for _, pageNum := range []uint32{5, 6} {
+		if err := p.FreePage(pageNum); err != nil {
+			t.Fatalf("Failed to free page %d: %v", pageNum, err)
+		}
+	}
+	if err := p.SetSchemaCookie(42); err != nil {
+		t.Fatalf("Failed to set schema cookie: %v", err)
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	return p
+}
+
+// expectBackup checks that p holds the database newBackupSource created,
+// with page 1 holding first
+func expectBackup(t *testing.T, p *Pager, n uint32, first byte) {
+	t.Helper()
+	if p.NumPages() != n+1 || p.FreelistCount() != 2 || p.SchemaCookie() != 42 {
+		t.Errorf("Expected %d pages, 2 free and cookie 42, got %d pages, %d free and cookie %d",
+			n+1, p.NumPages(), p.FreelistCount(), p.SchemaCookie())
+	}
+	// The freelist came along and still works
+	got := map[uint32]bool{}
+	for range 2 {
+		pageNum, err := p.AllocatePage()
+		if err != nil {
+			t.Fatalf("Failed to allocate page: %v", err)
+		}
+		got[pageNum] = true
+	}
+	if !got[5] || !got[6] {
+		t.Errorf("Expected pages 5 and 6 from the freelist, got %v", got)
+	}
+	// which hands them out zeroed
+	expectPages(t, p, n, func(i uint32) byte {
+		switch i {
+		case 1:
+			return first
+		case 5, 6:
+			return 0
+		}
+		return byte(i)
+	})
+}
+
+func TestBackup_ToPager(t *testing.T) {
+	src := newBackupSource(t, 50, Options{})
+
+	// The destination starts out bigger than the source
+	dstPath := filepath.Join(t.TempDir(), "dst.db")
+	dst, err := NewWithOptions(dstPath, Options{JournalMode: JournalModeWAL, Compression: CompressionFlate})
+	if err != nil {
+		t.Fatalf("Failed to create destination: %v", err)
+	}
+	for i := uint32(1); i <= 80; i++ {
+		dst.WritePage(i, testPage(dst, 0xee))
+	}
+	if err := dst.Flush(); err != nil {
+		t.Fatalf("Failed to flush destination: %v", err)
+	}
+
+	b, err := src.Backup(dst)
+	if err != nil {
+		t.Fatalf("Failed to start backup: %v", err)
+	}
+	var progress []uint32
+	b.Progress = func(remaining, total uint32) {
+		if total != 51 {
+			t.Errorf("Expected 51 pages in the snapshot, got %d", total)
+		}
+		progress = append(progress, remaining)
+	}
+	for steps := 1; ; steps++ {
+		done, err := b.Step(7)
+		if err != nil {
+			t.Fatalf("Failed to step: %v", err)
+		}
+		if done {
+			break
+		}
+		if steps > 10 {
+			t.Fatalf("Backup did not finish")
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Failed to close backup: %v", err)
+	}
+
+	// Pages 1-50 in steps of 7
+	want := []uint32{43, 36, 29, 22, 15, 8, 1, 0}
+	if !slices.Equal(progress, want) {
+		t.Errorf("Expected progress %v, got %v", want, progress)
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatalf("Failed to close destination: %v", err)
+	}
+
+	dst, err = New(dstPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen destination: %v", err)
+	}
+	defer dst.Close()
+	expectBackup(t, dst, 50, 1)
+}
+
+func TestBackup_RestartsOnChange(t *testing.T) {
+	src := newBackupSource(t, 30, Options{})
+	dst, err := New(MemoryPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create destination: %v", err)
+	}
+	defer dst.Close()
+
+	b, err := src.Backup(dst)
+	if err != nil {
+		t.Fatalf("Failed to start backup: %v", err)
+	}
+	defer b.Close()
+	if _, err := b.Step(10); err != nil {
+		t.Fatalf("Failed to step: %v", err)
+	}
+
+	// A change not committed yet is neither copied nor committed by a step
+	src.WritePage(1, testPage(src, 99))
+	if _, err := b.Step(10); err != nil {
+		t.Fatalf("Failed to step: %v", err)
+	}
+	if b.Restarts() != 0 || b.Remaining() != 10 {
+		t.Errorf("Expected no restart and 10 pages left, got %d restarts and %d pages left", b.Restarts(), b.Remaining())
+	}
+	if src.Header().ChangeCounter != b.Epoch() {
+		t.Errorf("Expected the step to leave the change uncommitted")
+	}
+
+	// Once committed, it starts the copy over
+	if err := src.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if _, err := b.Step(10); err != nil {
+		t.Fatalf("Failed to step: %v", err)
+	}
+	if b.Restarts() != 1 || b.Remaining() != 20 {
+		t.Errorf("Expected a restart and pages 1-10 copied again, got %d restarts and %d pages left", b.Restarts(), b.Remaining())
+	}
+
+	// Uncommitted changes in the file hold the backup up
+	tx, err := src.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	src.WritePage(2, testPage(src, 77))
+	if _, err := b.Step(10); err != nil {
+		t.Fatalf("Failed to step with a change in the cache only: %v", err)
+	}
+	if err := src.FlushPage(2); err != nil {
+		t.Fatalf("Failed to flush page: %v", err)
+	}
+	if _, err := b.Step(10); !errors.Is(err, ErrSourceBusy) {
+		t.Errorf("Expected ErrSourceBusy, got %v", err)
+	}
+	tx.Rollback()
+
+	if done, err := b.Step(-1); !done || err != nil {
+		t.Fatalf("Expected the backup to finish, got %v, %v", done, err)
+	}
+	expectBackup(t, dst, 30, 99)
+}
+
+func TestBackup_CloseRollsBack(t *testing.T) {
+	src := newBackupSource(t, 30, Options{})
+	dst, err := New(MemoryPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create destination: %v", err)
+	}
+	defer dst.Close()
+	dst.WritePage(1, testPage(dst, 7))
+	if err := dst.Flush(); err != nil {
+		t.Fatalf("Failed to flush destination: %v", err)
+	}
+
+	if _, err := src.Backup(src); !errors.Is(err, ErrBackupToSelf) {
+		t.Errorf("Expected ErrBackupToSelf, got %v", err)
+	}
+	b, err := src.Backup(dst)
+	if err != nil {
+		t.Fatalf("Failed to start backup: %v", err)
+	}
+	if _, err := b.Step(10); err != nil {
+		t.Fatalf("Failed to step: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Failed to close backup: %v", err)
+	}
+	if dst.NumPages() != 2 || dst.InTx() {
+		t.Errorf("Expected the destination back at 2 pages outside a transaction, got %d pages", dst.NumPages())
+	}
+	expectPages(t, dst, 1, func(uint32) byte { return 7 })
+}
+
+func TestBackup_Writer(t *testing.T) {
+	for _, opts := range []Options{
+		{},
+		{Compression: CompressionFlate, JournalMode: JournalModeWAL},
+		{Key: testKey},
+	} {
+		src := newBackupSource(t, 40, opts)
+
+		var buf bytes.Buffer
+		if err := src.BackupWriter(&buf).Run(16, 0); err != nil {
+			t.Fatalf("Failed to back up: %v", err)
+		}
+		if buf.Len() != 41*src.PageSize() {
+			t.Errorf("Expected an image of 41 pages, got %d bytes", buf.Len())
+		}
+
+		fsys := vfs.NewMemFS()
+		file, err := fsys.Open("backup.db", vfs.OpenCreate)
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		file.WriteAt(buf.Bytes(), 0)
+		file.Close()
+		p, err := NewWithOptions("backup.db", Options{FS: fsys, Key: opts.Key})
+		if err != nil {
+			t.Fatalf("Failed to open backup: %v", err)
+		}
+		expectBackup(t, p, 40, 1)
+		p.Close()
+	}
+}
+
+// fileWriter lets a backup write to a vfs.File, which it does with WriteAt
+type fileWriter struct {
+	vfs.File
+}
+
+func (fileWriter) Write([]byte) (int, error) {
+	return 0, errors.New("not rewindable")
+}
+
+func TestBackup_WriterSourceChanged(t *testing.T) {
+	src := newBackupSource(t, 20, Options{})
+
+	var buf bytes.Buffer
+	b := src.BackupWriter(&buf)
+	if _, err := b.Step(5); err != nil {
+		t.Fatalf("Failed to step: %v", err)
+	}
+	src.WritePage(1, testPage(src, 99))
+	src.Flush()
+	if _, err := b.Step(5); !errors.Is(err, ErrSourceChanged) {
+		t.Errorf("Expected ErrSourceChanged, got %v", err)
+	}
+
+	// A file can be rewound instead
+	fsys := vfs.NewMemFS()
+	file, err := fsys.Open("backup.db", vfs.OpenCreate)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	b = src.BackupWriter(fileWriter{file})
+	if _, err := b.Step(5); err != nil {
+		t.Fatalf("Failed to step: %v", err)
+	}
+	src.WritePage(1, testPage(src, 100))
+	src.Flush()
+	if err := b.Run(5, 0); err != nil {
+		t.Fatalf("Failed to back up: %v", err)
+	}
+	if b.Restarts() != 1 {
+		t.Errorf("Expected 1 restart, got %d", b.Restarts())
+	}
+	file.Close()
+
+	p, err := NewWithOptions("backup.db", Options{FS: fsys})
+	if err != nil {
+		t.Fatalf("Failed to open backup: %v", err)
+	}
+	defer p.Close()
+	expectBackup(t, p, 20, 100)
+}
@@ -1,215 +1,407 @@
 package pager
 
 import (
-	"container/list"
 	"sync"
 
 	"mash-db/internal/common"
 )
 
-// CacheEntry represents a cached page with LRU tracking
+// minShardPages is the fewest pages per shard the pager picks by default
+const minShardPages = 64
+
+// CacheEntry represents a cached page
 type CacheEntry struct {
 	PageNum uint32
 	Page    *Page
-	element *list.Element // Position in LRU list
+
+	prefetched bool // Loaded ahead of use and not used since
 }
 
-// LRUCache is a thread-safe LRU cache for database pages
-type LRUCache struct {
+// PageCache is a thread-safe cache for database pages
+// Which page to evict when the cache is full is up to its
+// ReplacementPolicy. Pinned pages are never evicted, and the cache never
+// grows past its capacity: with every page pinned, Put fails instead.
+//
+// A cache may be split into shards by page number. Each shard has its own
+// lock, policy and share of the capacity, so goroutines working on different
+// pages rarely wait for each other, but a shard runs out of unpinned pages
+// on its own.
+type PageCache struct {
+	capacity int
+	shards   []*cacheShard
+}
+
+// cacheShard holds the pages whose number maps to it
+type cacheShard struct {
 	capacity int
 	cache    map[uint32]*CacheEntry
-	lruList  *list.List // Front = most recently used, Back = least recently used
+	policy   ReplacementPolicy
 	mu       sync.RWMutex
 	hits     uint64
 	misses   uint64
+	prefetch uint64 // First uses of prefetched pages
+	evicted  uint64
+	dirty    uint64   // Evicted pages that were dirty
+	_        [64]byte // Keeps neighbouring shards off each other's cache line
 }
 
-// NewLRUCache creates a new LRU cache with the given capacity
-func NewLRUCache(capacity int) *LRUCache {
+// LRUCache is the name PageCache had when LRU was its only policy
+type LRUCache = PageCache
+
+// NewLRUCache creates a new cache with the given capacity and the LRU policy
+func NewLRUCache(capacity int) *PageCache {
+	return NewPageCache(capacity, nil)
+}
+
+// NewPageCache creates a new cache with the given capacity and policy
+// A nil policy selects LRU.
+func NewPageCache(capacity int, policy ReplacementPolicy) *PageCache {
+	return NewShardedPageCache(capacity, []ReplacementPolicy{policy})
+}
+
+// NewShardedPageCache creates a cache with one shard per policy, which
+// share the capacity evenly
+// Every shard needs a policy of its own; a nil policy selects LRU. There
+// are never more shards than pages.
+func NewShardedPageCache(capacity int, policies []ReplacementPolicy) *PageCache {
 	if capacity <= 0 {
 		capacity = 100
 	}
-	return &LRUCache{
-		capacity: capacity,
-		cache:    make(map[uint32]*CacheEntry),
-		lruList:  list.New(),
+	n := max(1, min(len(policies), capacity))
+	c := &PageCache{capacity: capacity, shards: make([]*cacheShard, n)}
+	for i := range c.shards {
+		var policy ReplacementPolicy
+		if i < len(policies) {
+			policy = policies[i]
+		}
+		if policy == nil {
+			policy = NewLRUPolicy()
+		}
+		c.shards[i] = &cacheShard{
+			capacity: shardCapacity(capacity, n, i),
+			cache:    make(map[uint32]*CacheEntry),
+			policy:   policy,
+		}
+	}
+	return c
+}
+
+// shardCapacity returns the share of capacity that shard i of n holds
+func shardCapacity(capacity, n, i int) int {
+	size := capacity / n
+	if i < capacity%n {
+		size++
 	}
+	return size
+}
+
+// shard returns the shard that holds pageNum
+func (c *PageCache) shard(pageNum uint32) *cacheShard {
+	return c.shards[pageNum%uint32(len(c.shards))]
+}
+
+// Shards returns the number of shards in the cache
+func (c *PageCache) Shards() int {
+	return len(c.shards)
 }
 
-// Get retrieves a page from the cache
+// Get retrieves a page from the cache and records the use
 // Returns nil if not found
-func (c *LRUCache) Get(pageNum uint32) *Page {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if entry, ok := c.cache[pageNum]; ok {
-		// Move to front (most recently used)
-		c.lruList.MoveToFront(entry.element)
-		c.hits++
+func (c *PageCache) Get(pageNum uint32) *Page {
+	s := c.shard(pageNum)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.cache[pageNum]; ok {
+		s.policy.Access(pageNum)
+		s.countHit(entry)
+		return entry.Page
+	}
+	s.misses++
+	return nil
+}
+
+// GetPinned is Get, but also pins the page it returns
+func (c *PageCache) GetPinned(pageNum uint32) *Page {
+	return c.getPinned(pageNum, true)
+}
+
+// TryPin is GetPinned, but does not count a miss, for a caller that goes
+// on to GetPinned
+func (c *PageCache) TryPin(pageNum uint32) *Page {
+	return c.getPinned(pageNum, false)
+}
+
+func (c *PageCache) getPinned(pageNum uint32, countMiss bool) *Page {
+	s := c.shard(pageNum)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.cache[pageNum]; ok {
+		s.policy.Access(pageNum)
+		s.countHit(entry)
+		entry.Page.PinCnt++
+		return entry.Page
+	}
+	if countMiss {
+		s.misses++
+	}
+	return nil
+}
+
+// countHit counts a use of a cached page
+// The first use of a prefetched page is counted apart from the hits, as the
+// page was read from disk for it all the same.
+// Must be called with lock held
+func (s *cacheShard) countHit(entry *CacheEntry) {
+	if entry.prefetched {
+		entry.prefetched = false
+		s.prefetch++
+		return
+	}
+	s.hits++
+}
+
+// Peek retrieves a page from the cache without counting it as a use
+// Returns nil if not found
+func (c *PageCache) Peek(pageNum uint32) *Page {
+	s := c.shard(pageNum)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if entry, ok := s.cache[pageNum]; ok {
 		return entry.Page
 	}
-	c.misses++
 	return nil
 }
 
 // Put adds or updates a page in the cache
-// Returns evicted page (if any) for flushing
-func (c *LRUCache) Put(pageNum uint32, page *Page) *CacheEntry {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// Returns evicted page (if any) for flushing. If the page's shard is full
+// and every page in it is pinned, the page is not added and Put fails with
+// ErrAllPagesPinned.
+func (c *PageCache) Put(pageNum uint32, page *Page) (*CacheEntry, error) {
+	s := c.shard(pageNum)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	// Check if already in cache
-	if entry, ok := c.cache[pageNum]; ok {
+	if entry, ok := s.cache[pageNum]; ok {
 		entry.Page = page
-		c.lruList.MoveToFront(entry.element)
-		return nil
+		s.policy.Access(pageNum)
+		return nil, nil
 	}
 
 	// Check if we need to evict
 	var evicted *CacheEntry
-	if c.lruList.Len() >= c.capacity {
-		evicted = c.evictLRU()
+	if len(s.cache) >= s.capacity {
+		if evicted = s.evict(); evicted == nil {
+			return nil, ErrAllPagesPinned
+		}
 	}
 
-	// Add new entry
-	entry := &CacheEntry{
+	s.cache[pageNum] = &CacheEntry{
 		PageNum: pageNum,
 		Page:    page,
 	}
-	entry.element = c.lruList.PushFront(entry)
-	c.cache[pageNum] = entry
+	s.policy.Insert(pageNum)
 
-	return evicted
+	return evicted, nil
 }
 
-// evictLRU removes the least recently used unpinned page
+// evict removes the unpinned page the policy picks
 // Must be called with lock held
-func (c *LRUCache) evictLRU() *CacheEntry {
-	// Start from back (least recently used)
-	for e := c.lruList.Back(); e != nil; e = e.Prev() {
-		entry := e.Value.(*CacheEntry)
-		// Only evict unpinned pages
-		if entry.Page.PinCnt == 0 {
-			c.lruList.Remove(e)
-			delete(c.cache, entry.PageNum)
-			return entry
-		}
+func (s *cacheShard) evict() *CacheEntry {
+	pageNum, ok := s.policy.Evict(func(pageNum uint32) bool {
+		return s.cache[pageNum].Page.PinCnt == 0
+	})
+	if !ok {
+		return nil
 	}
-	return nil
+	entry := s.cache[pageNum]
+	delete(s.cache, pageNum)
+	s.evicted++
+	if entry.Page.Dirty {
+		s.dirty++
+	}
+	return entry
 }
 
 // Remove removes a specific page from the cache
-func (c *LRUCache) Remove(pageNum uint32) *CacheEntry {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if entry, ok := c.cache[pageNum]; ok {
-		c.lruList.Remove(entry.element)
-		delete(c.cache, pageNum)
+func (c *PageCache) Remove(pageNum uint32) *CacheEntry {
+	s := c.shard(pageNum)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.cache[pageNum]; ok {
+		s.policy.Remove(pageNum)
+		delete(s.cache, pageNum)
 		return entry
 	}
 	return nil
 }
 
+// RemoveUnpinned removes a page from the cache unless it is pinned
+// It reports whether the page is no longer cached.
+func (c *PageCache) RemoveUnpinned(pageNum uint32) bool {
+	s := c.shard(pageNum)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.cache[pageNum]; ok {
+		if entry.Page.PinCnt > 0 {
+			return false
+		}
+		s.policy.Remove(pageNum)
+		delete(s.cache, pageNum)
+	}
+	return true
+}
+
 // Contains checks if a page is in the cache
-func (c *LRUCache) Contains(pageNum uint32) bool {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	_, ok := c.cache[pageNum]
+func (c *PageCache) Contains(pageNum uint32) bool {
+	s := c.shard(pageNum)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.cache[pageNum]
 	return ok
 }
 
 // Size returns the current number of pages in the cache
-func (c *LRUCache) Size() int {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return c.lruList.Len()
+func (c *PageCache) Size() int {
+	size := 0
+	for _, s := range c.shards {
+		s.mu.RLock()
+		size += len(s.cache)
+		s.mu.RUnlock()
+	}
+	return size
 }
 
 // Capacity returns the maximum capacity of the cache
-func (c *LRUCache) Capacity() int {
+func (c *PageCache) Capacity() int {
 	return c.capacity
 }
 
 // Stats returns cache hit/miss statistics
-func (c *LRUCache) Stats() (hits, misses uint64) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return c.hits, c.misses
+func (c *PageCache) Stats() (hits, misses uint64) {
+	for _, s := range c.shards {
+		s.mu.RLock()
+		hits += s.hits
+		misses += s.misses
+		s.mu.RUnlock()
+	}
+	return hits, misses
+}
+
+// PrefetchHits returns how many prefetched pages were used, each counted on
+// its first use only and neither as a hit nor as a miss
+func (c *PageCache) PrefetchHits() uint64 {
+	var n uint64
+	for _, s := range c.shards {
+		s.mu.RLock()
+		n += s.prefetch
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// Evictions returns how many pages were evicted to make room, and how many
+// of those were dirty
+// Pages dropped by Remove, EvictUnpinned or Clear are not counted.
+func (c *PageCache) Evictions() (evicted, dirty uint64) {
+	for _, s := range c.shards {
+		s.mu.RLock()
+		evicted += s.evicted
+		dirty += s.dirty
+		s.mu.RUnlock()
+	}
+	return evicted, dirty
 }
 
 // HitRate returns the cache hit rate as a percentage
-func (c *LRUCache) HitRate() float64 {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	total := c.hits + c.misses
+func (c *PageCache) HitRate() float64 {
+	hits, misses := c.Stats()
+	total := hits + misses
 	if total == 0 {
 		return 0
 	}
-	return float64(c.hits) / float64(total) * 100
+	return float64(hits) / float64(total) * 100
 }
 
 // Clear removes all entries from the cache
 // Returns all dirty pages for flushing
-func (c *LRUCache) Clear() []*CacheEntry {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
+func (c *PageCache) Clear() []*CacheEntry {
 	var dirtyPages []*CacheEntry
-	for _, entry := range c.cache {
-		if entry.Page.Dirty {
-			dirtyPages = append(dirtyPages, entry)
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for pageNum, entry := range s.cache {
+			if entry.Page.Dirty {
+				dirtyPages = append(dirtyPages, entry)
+			}
+			s.policy.Remove(pageNum)
 		}
+		s.cache = make(map[uint32]*CacheEntry)
+		s.mu.Unlock()
 	}
-
-	c.cache = make(map[uint32]*CacheEntry)
-	c.lruList = list.New()
-
 	return dirtyPages
 }
 
 // GetAllDirty returns all dirty pages in the cache
-func (c *LRUCache) GetAllDirty() []*CacheEntry {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
+func (c *PageCache) GetAllDirty() []*CacheEntry {
 	var dirtyPages []*CacheEntry
-	for _, entry := range c.cache {
-		if entry.Page.Dirty {
-			dirtyPages = append(dirtyPages, entry)
+	for _, s := range c.shards {
+		s.mu.RLock()
+		for _, entry := range s.cache {
+			if entry.Page.Dirty {
+				dirtyPages = append(dirtyPages, entry)
+			}
 		}
+		s.mu.RUnlock()
 	}
 	return dirtyPages
 }
 
 // ForEach iterates over all cached pages
-func (c *LRUCache) ForEach(fn func(pageNum uint32, page *Page) bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// Each shard is locked while fn visits its pages.
+func (c *PageCache) ForEach(fn func(pageNum uint32, page *Page) bool) {
+	for _, s := range c.shards {
+		if !s.forEach(fn) {
+			return
+		}
+	}
+}
+
+// forEach reports whether fn wants to go on
+func (s *cacheShard) forEach(fn func(pageNum uint32, page *Page) bool) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	for pageNum, entry := range c.cache {
+	for pageNum, entry := range s.cache {
 		if !fn(pageNum, entry.Page) {
-			return
+			return false
 		}
 	}
+	return true
 }
 
 // Touch marks a page as recently used without modifying it
-func (c *LRUCache) Touch(pageNum uint32) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (c *PageCache) Touch(pageNum uint32) {
+	s := c.shard(pageNum)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if entry, ok := c.cache[pageNum]; ok {
-		c.lruList.MoveToFront(entry.element)
+	if _, ok := s.cache[pageNum]; ok {
+		s.policy.Access(pageNum)
 	}
 }
 
 // Pin increments the pin count for a cached page
-func (c *LRUCache) Pin(pageNum uint32) bool {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (c *PageCache) Pin(pageNum uint32) bool {
+	s := c.shard(pageNum)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if entry, ok := c.cache[pageNum]; ok {
+	if entry, ok := s.cache[pageNum]; ok {
 		entry.Page.PinCnt++
 		return true
 	}
@@ -217,62 +409,82 @@ func (c *LRUCache) Pin(pageNum uint32) bool {
 }
 
 // Unpin decrements the pin count for a cached page
-func (c *LRUCache) Unpin(pageNum uint32) bool {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if entry, ok := c.cache[pageNum]; ok {
-		if entry.Page.PinCnt > 0 {
-			entry.Page.PinCnt--
-		}
-		return true
+// It reports whether the page had a pin to drop, and whether that was the
+// last one.
+func (c *PageCache) Unpin(pageNum uint32) (dropped, last bool) {
+	s := c.shard(pageNum)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.cache[pageNum]; ok && entry.Page.PinCnt > 0 {
+		entry.Page.PinCnt--
+		return true, entry.Page.PinCnt == 0
 	}
-	return false
+	return false, false
+}
+
+// Pinned reports whether a cached page is pinned
+func (c *PageCache) Pinned(pageNum uint32) bool {
+	s := c.shard(pageNum)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.cache[pageNum]
+	return ok && entry.Page.PinCnt > 0
 }
 
 // MarkDirty marks a cached page as dirty
-func (c *LRUCache) MarkDirty(pageNum uint32) bool {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (c *PageCache) MarkDirty(pageNum uint32) bool {
+	s := c.shard(pageNum)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if entry, ok := c.cache[pageNum]; ok {
+	if entry, ok := s.cache[pageNum]; ok {
 		entry.Page.Dirty = true
 		return true
 	}
 	return false
 }
 
-// EvictUnpinned evicts all unpinned pages and returns dirty ones for flushing
-func (c *LRUCache) EvictUnpinned() []*CacheEntry {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// markPrefetched marks a cached page as loaded ahead of use
+func (c *PageCache) markPrefetched(pageNum uint32) {
+	s := c.shard(pageNum)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	var dirtyPages []*CacheEntry
-	var toRemove []uint32
-
-	for pageNum, entry := range c.cache {
-		if entry.Page.PinCnt == 0 {
-			if entry.Page.Dirty {
-				dirtyPages = append(dirtyPages, entry)
-			}
-			toRemove = append(toRemove, pageNum)
-		}
+	if entry, ok := s.cache[pageNum]; ok {
+		entry.prefetched = true
 	}
+}
 
-	for _, pageNum := range toRemove {
-		if entry, ok := c.cache[pageNum]; ok {
-			c.lruList.Remove(entry.element)
-			delete(c.cache, pageNum)
+// EvictUnpinned evicts all unpinned pages and returns dirty ones for flushing
+func (c *PageCache) EvictUnpinned() []*CacheEntry {
+	var dirtyPages []*CacheEntry
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for pageNum, entry := range s.cache {
+			if entry.Page.PinCnt == 0 {
+				if entry.Page.Dirty {
+					dirtyPages = append(dirtyPages, entry)
+				}
+				s.policy.Remove(pageNum)
+				delete(s.cache, pageNum)
+			}
 		}
+		s.mu.Unlock()
 	}
-
 	return dirtyPages
 }
 
-// NewPage creates a new empty page
+// NewPage creates a new empty page of the default page size
 func NewPage() *Page {
+	return newPage(common.PageSize)
+}
+
+// newPage creates a new empty page of the given size
+func newPage(size int) *Page {
 	return &Page{
-		Data:   [common.PageSize]byte{},
+		Data:   make([]byte, size),
 		Dirty:  false,
 		PinCnt: 0,
 	}
@@ -1,6 +1,7 @@
 package pager
 
 import (
+	"errors"
 	"testing"
 )
 
@@ -58,7 +59,7 @@ func TestLRUCache_Eviction(t *testing.T) {
 	// Add one more - should evict LRU (page 0)
 	page := NewPage()
 	page.Data[0] = 99
-	evicted := cache.Put(99, page)
+	evicted, _ := cache.Put(99, page)
 
 	if evicted == nil {
 		t.Error("Expected eviction")
@@ -93,7 +94,7 @@ func TestLRUCache_LRUOrder(t *testing.T) {
 
 	// Add page 3 - should evict page 1 (now LRU)
 	page := NewPage()
-	evicted := cache.Put(3, page)
+	evicted, _ := cache.Put(3, page)
 
 	if evicted.PageNum != 1 {
 		t.Errorf("Expected page 1 to be evicted (LRU), got %d", evicted.PageNum)
@@ -112,15 +113,21 @@ func TestLRUCache_PinnedPagesNotEvicted(t *testing.T) {
 
 	// Try to add another page - should not evict any (all pinned)
 	page := NewPage()
-	evicted := cache.Put(99, page)
+	evicted, err := cache.Put(99, page)
 
 	if evicted != nil {
 		t.Error("Should not evict pinned pages")
 	}
+	if !errors.Is(err, ErrAllPagesPinned) {
+		t.Errorf("Expected ErrAllPagesPinned, got %v", err)
+	}
 
-	// Cache should have grown beyond capacity
-	if cache.Size() != 4 {
-		t.Errorf("Expected size 4, got %d", cache.Size())
+	// Cache must not grow beyond capacity
+	if cache.Size() != 3 {
+		t.Errorf("Expected size 3, got %d", cache.Size())
+	}
+	if cache.Contains(99) {
+		t.Error("Page 99 should not have been added")
 	}
 }
 
@@ -240,7 +247,7 @@ func TestLRUCache_Touch(t *testing.T) {
 
 	// Add page 3 - should evict page 1 (page 0 was touched, making page 1 LRU)
 	page := NewPage()
-	evicted := cache.Put(3, page)
+	evicted, _ := cache.Put(3, page)
 
 	if evicted.PageNum != 1 {
 		t.Errorf("Expected page 1 to be evicted, got %d", evicted.PageNum)
@@ -305,3 +312,51 @@ func TestLRUCache_ForEach(t *testing.T) {
 		t.Errorf("Expected to iterate 3 pages with early termination, got %d", count)
 	}
 }
+
+func TestShardedPageCache(t *testing.T) {
+	cache := NewShardedPageCache(10, make([]ReplacementPolicy, 4))
+	if cache.Shards() != 4 {
+		t.Fatalf("Expected 4 shards, got %d", cache.Shards())
+	}
+
+	// Shard 0 holds pages 0, 4, 8, ... and three of the ten slots
+	for _, pageNum := range []uint32{0, 4, 8} {
+		if evicted, _ := cache.Put(pageNum, NewPage()); evicted != nil {
+			t.Fatalf("Unexpected eviction of page %d", evicted.PageNum)
+		}
+	}
+	evicted, err := cache.Put(12, NewPage())
+	if err != nil || evicted == nil || evicted.PageNum != 0 {
+		t.Fatalf("Expected page 0 to make room in its shard, got %+v, %v", evicted, err)
+	}
+
+	// A shard full of pinned pages fails even with room elsewhere
+	for _, pageNum := range []uint32{4, 8, 12} {
+		cache.Pin(pageNum)
+	}
+	if _, err := cache.Put(16, NewPage()); !errors.Is(err, ErrAllPagesPinned) {
+		t.Errorf("Expected ErrAllPagesPinned, got %v", err)
+	}
+	if _, err := cache.Put(1, NewPage()); err != nil {
+		t.Errorf("Failed to add a page to another shard: %v", err)
+	}
+
+	if cache.Size() != 4 {
+		t.Errorf("Expected 4 pages, got %d", cache.Size())
+	}
+	if dropped, last := cache.Unpin(4); !dropped || !last {
+		t.Errorf("Expected the only pin of page 4 to be dropped, got %v, %v", dropped, last)
+	}
+	if dropped, _ := cache.Unpin(4); dropped {
+		t.Error("Expected no pin left on page 4")
+	}
+	if cache.RemoveUnpinned(8) || !cache.RemoveUnpinned(4) || cache.Contains(4) {
+		t.Error("Expected only the unpinned page to be removed")
+	}
+
+	cache.Get(8)
+	cache.Get(99)
+	if hits, misses := cache.Stats(); hits != 1 || misses != 1 {
+		t.Errorf("Expected 1 hit and 1 miss across shards, got %d and %d", hits, misses)
+	}
+}
@@ -0,0 +1,75 @@
+package pager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"mash-db/internal/common"
+)
+
+// checksumSize is the size of the CRC32C trailer at the end of every page
+const checksumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrCorruptPage = errors.New("page checksum mismatch")
+
+// CorruptPageError reports a page whose stored checksum does not match its contents
+type CorruptPageError struct {
+	PageNum uint32
+}
+
+func (e *CorruptPageError) Error() string {
+	return fmt.Sprintf("%v: page %d", ErrCorruptPage, e.PageNum)
+}
+
+// Is makes errors.Is(err, ErrCorruptPage) match a *CorruptPageError
+func (e *CorruptPageError) Is(target error) bool {
+	return target == ErrCorruptPage
+}
+
+// pageChecksum computes the checksum of a page image
+// The page number is mixed in so a page written to the wrong offset is detected.
+func pageChecksum(pageNum uint32, data []byte) uint32 {
+	var seed [4]byte
+	binary.LittleEndian.PutUint32(seed[:], pageNum)
+	crc := crc32.Update(0, castagnoli, seed[:])
+	return crc32.Update(crc, castagnoli, data[:len(data)-checksumSize])
+}
+
+// sealPage returns the on-disk image of a page, encrypted if the database is,
+// with its checksum trailer set
+// The returned slice is a scratch buffer owned by the pager (must hold lock).
+func (p *Pager) sealPage(pageNum uint32, data []byte) []byte {
+	if len(p.sealBuf) != p.pageSize {
+		p.sealBuf = make([]byte, p.pageSize)
+	}
+	p.sealInto(pageNum, data, p.sealBuf)
+	return p.sealBuf
+}
+
+// sealInto stores the on-disk image of a page in buf, which is one page long
+// A database that tracks changes stamps the page with the epoch of the
+// commit it is written for.
+func (p *Pager) sealInto(pageNum uint32, data, buf []byte) {
+	copy(buf, data)
+	if p.header.PageEpochs && pageNum != common.HeaderPageNum {
+		binary.LittleEndian.PutUint32(buf[p.usable:], p.committed.ChangeCounter+1)
+	}
+	if p.isEncryptedPage(pageNum) {
+		p.cipher.seal(pageNum, buf)
+	}
+	binary.LittleEndian.PutUint32(buf[p.pageSize-checksumSize:], pageChecksum(pageNum, buf))
+}
+
+// verifyPage checks the checksum trailer of an on-disk page image
+// A page of zeroes fails the check like any other damage.
+func (p *Pager) verifyPage(pageNum uint32, data []byte) error {
+	stored := binary.LittleEndian.Uint32(data[len(data)-checksumSize:])
+	if stored == pageChecksum(pageNum, data) && !allZero(data) {
+		return nil
+	}
+	return &CorruptPageError{PageNum: pageNum}
+}
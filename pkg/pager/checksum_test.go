@@ -0,0 +1,179 @@
+package pager
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mash-db/internal/common"
+)
+
+func TestChecksum_DetectsCorruption(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	for i := uint32(1); i <= 3; i++ {
+		data := make([]byte, common.PageSize)
+		copy(data, []byte("checksummed"))
+		if err := p.WritePage(i, data); err != nil {
+			t.Fatalf("Failed to write page %d: %v", i, err)
+		}
+	}
+	p.Close()
+
+	// Flip a single bit in page 2
+	f, err := os.OpenFile(dbPath, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	var b [1]byte
+	f.ReadAt(b[:], 2*common.PageSize+100)
+	b[0] ^= 0x01
+	f.WriteAt(b[:], 2*common.PageSize+100)
+	f.Close()
+
+	p2, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen pager: %v", err)
+	}
+	defer p2.Close()
+
+	if _, err := p2.ReadPage(1); err != nil {
+		t.Errorf("Page 1 should be intact: %v", err)
+	}
+
+	_, err = p2.ReadPage(2)
+	if !errors.Is(err, ErrCorruptPage) {
+		t.Fatalf("Expected ErrCorruptPage, got %v", err)
+	}
+	var corrupt *CorruptPageError
+	if !errors.As(err, &corrupt) || corrupt.PageNum != 2 {
+		t.Errorf("Expected corrupt page 2, got %v", err)
+	}
+}
+
+func TestChecksum_DetectsMisplacedPage(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	for i := uint32(1); i <= 2; i++ {
+		data := make([]byte, common.PageSize)
+		data[0] = byte(i)
+		p.WritePage(i, data)
+	}
+	p.Close()
+
+	// Copy page 1 over page 2: a valid checksum, but for the wrong page
+	raw, _ := os.ReadFile(dbPath)
+	copy(raw[2*common.PageSize:3*common.PageSize], raw[common.PageSize:2*common.PageSize])
+	os.WriteFile(dbPath, raw, 0644)
+
+	p2, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen pager: %v", err)
+	}
+	defer p2.Close()
+
+	if _, err := p2.ReadPage(2); !errors.Is(err, ErrCorruptPage) {
+		t.Errorf("Expected ErrCorruptPage, got %v", err)
+	}
+}
+
+func TestChecksum_CorruptHeader(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	p.Close()
+
+	raw, _ := os.ReadFile(dbPath)
+	raw[headerSize+10] = 0xFF
+	os.WriteFile(dbPath, raw, 0644)
+
+	if _, err := New(dbPath, 10); !errors.Is(err, ErrCorruptPage) {
+		t.Errorf("Expected ErrCorruptPage, got %v", err)
+	}
+}
+
+func TestChecksum_UnwrittenPagesAccepted(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+
+	// Writing page 5 fills the hole of pages 1-4 with sealed zeroes
+	data := make([]byte, common.PageSize)
+	p.WritePage(5, data)
+	p.Close()
+
+	p2, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen pager: %v", err)
+	}
+	defer p2.Close()
+
+	for i := uint32(1); i <= 5; i++ {
+		if _, err := p2.ReadPage(i); err != nil {
+			t.Errorf("Page %d: unexpected error %v", i, err)
+		}
+		p2.UnpinPage(i, false)
+	}
+}
+
+func TestChecksum_ZeroedPage(t *testing.T) {
+	for _, opts := range []Options{{}, {Key: testKey}} {
+		dbPath := filepath.Join(t.TempDir(), "test.db")
+		p, err := NewWithOptions(dbPath, opts)
+		if err != nil {
+			t.Fatalf("Failed to create pager: %v", err)
+		}
+		data := make([]byte, common.PageSize)
+		copy(data, []byte("zeroed"))
+		for _, pageNum := range []uint32{1, 2, 5} {
+			if err := p.WritePage(pageNum, data); err != nil {
+				t.Fatalf("Failed to write page %d: %v", pageNum, err)
+			}
+		}
+		pageSize := p.PageSize()
+		if err := p.Close(); err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+
+		// Zero page 2, which was written, and page 3, a filled hole
+		raw, _ := os.ReadFile(dbPath)
+		clear(raw[2*pageSize : 4*pageSize])
+		os.WriteFile(dbPath, raw, 0644)
+
+		p2, err := NewWithOptions(dbPath, opts)
+		if err != nil {
+			t.Fatalf("Failed to reopen pager: %v", err)
+		}
+		for _, pageNum := range []uint32{2, 3} {
+			if _, err := p2.ReadPage(pageNum); !errors.Is(err, ErrCorruptPage) {
+				t.Errorf("Page %d: expected ErrCorruptPage, got %v", pageNum, err)
+			}
+		}
+		for _, pageNum := range []uint32{1, 4, 5, 6} {
+			if _, err := p2.ReadPage(pageNum); err != nil {
+				t.Errorf("Page %d: unexpected error %v", pageNum, err)
+			}
+			p2.UnpinPage(pageNum, false)
+		}
+		p2.Close()
+	}
+}
@@ -0,0 +1,363 @@
+package pager
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+	"sort"
+
+	"mash-db/pkg/vfs"
+)
+
+// Compressed file layout
+//
+// With compression enabled the database file is no longer an array of pages.
+// Page 0 still holds the header at offset 0, but every other page is
+// compressed and stored as a record in a run of 512-byte slots:
+//
+//	record: payload length and raw flag, compressed (or raw) sealed page image
+//
+// Slot s starts at offset s*slotSize; the slots covering page 0 are never
+// handed out. The page map, itself stored as a record, lists the slots
+// holding the record of every page. Its location and checksum live in the
+// header.
+//
+// Records are never overwritten in place. A rewritten page goes to free
+// slots, and its old slots are only released once the header pointing at the
+// new page map is durable. That makes the header write the commit point: the
+// rollback journal only ever needs the original of page 0, and restoring it
+// brings back the old page map together with every record it points to.
+const (
+	slotSize         = 512
+	recordHeaderSize = 4
+	recordRaw        = 1 << 31 // Record payload is stored uncompressed
+	pageMapEntrySize = 8
+)
+
+// Compression selects how pages are stored in the database file
+type Compression uint32
+
+const (
+	// CompressionNone stores every page verbatim at its own offset
+	CompressionNone Compression = iota
+
+	// CompressionFlate stores pages compressed with DEFLATE in packed slots
+	CompressionFlate
+)
+
+// errCorruptRecord reports a record that cannot be read back
+var errCorruptRecord = errors.New("corrupt record")
+
+// extent is a run of slots
+type extent struct {
+	start, count uint32
+}
+
+func (e extent) end() uint32 {
+	return e.start + e.count
+}
+
+// slotStore keeps the compressed page records of a database file
+// All methods must be called with the owning pager's lock held.
+type slotStore struct {
+	file     vfs.File
+	pageSize int
+
+	pages    []extent // Page map: the record of every page, zero if none
+	mapRef   extent   // Record holding the page map the header points to
+	mapCRC   uint32
+	changed  bool     // pages differs from the page map at mapRef
+	free     []extent // Unused slots below end, sorted and coalesced
+	end      uint32   // Slot just past the last one in use
+	released []extent // Superseded records, reusable after the next commit
+
+	zbuf bytes.Buffer
+	zw   *flate.Writer
+}
+
+// newSlotStore returns an empty store for a file with the given page size
+func newSlotStore(file vfs.File, pageSize int) *slotStore {
+	zw, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return &slotStore{
+		file:     file,
+		pageSize: pageSize,
+		end:      uint32(pageSize / slotSize),
+		zw:       zw,
+	}
+}
+
+// load reads the page map a header points to and rebuilds the free space
+// It is a no-op if the store already reflects exactly that page map.
+func (s *slotStore) load(h Header) error {
+	ref := extent{h.PageMapSlot, h.PageMapSlots}
+	if ref == s.mapRef && h.PageMapCRC == s.mapCRC && !s.changed && len(s.released) == 0 {
+		return nil
+	}
+
+	var pages []extent
+	if ref.count != 0 {
+		raw, err := s.readRecord(ref, maxPageMapSize)
+		if err != nil || len(raw)%pageMapEntrySize != 0 || crc32.Checksum(raw, castagnoli) != h.PageMapCRC {
+			return fmt.Errorf("%w: corrupt page map", ErrNotADatabase)
+		}
+		pages = make([]extent, len(raw)/pageMapEntrySize)
+		for i := range pages {
+			pages[i].start = binary.LittleEndian.Uint32(raw[i*pageMapEntrySize:])
+			pages[i].count = binary.LittleEndian.Uint32(raw[i*pageMapEntrySize+4:])
+		}
+	}
+
+	// Every slot not taken by page 0, the page map or a record is free
+	used := []extent{{0, uint32(s.pageSize / slotSize)}}
+	if ref.count != 0 {
+		used = append(used, ref)
+	}
+	for _, e := range pages {
+		if (e.start == 0) != (e.count == 0) {
+			return fmt.Errorf("%w: corrupt page map", ErrNotADatabase)
+		}
+		if e.count != 0 {
+			used = append(used, e)
+		}
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].start < used[j].start })
+
+	var free []extent
+	var end uint32
+	for _, e := range used {
+		if e.start < end {
+			return fmt.Errorf("%w: overlapping records in page map", ErrNotADatabase)
+		}
+		if e.start > end {
+			free = append(free, extent{end, e.start - end})
+		}
+		end = e.end()
+	}
+
+	s.pages = pages
+	s.mapRef = ref
+	s.mapCRC = h.PageMapCRC
+	s.changed = false
+	s.free = free
+	s.end = end
+	s.released = nil
+	return nil
+}
+
+// maxPageMapSize bounds the uncompressed size of a page map
+const maxPageMapSize = pageMapEntrySize * (1 << 20)
+
+// read decompresses the sealed image of a page into buf and reports whether
+// the page has a record
+func (s *slotStore) read(pageNum uint32, buf []byte) (bool, error) {
+	if int(pageNum) >= len(s.pages) || s.pages[pageNum].count == 0 {
+		return false, nil
+	}
+	data, err := s.readRecord(s.pages[pageNum], len(buf))
+	if errors.Is(err, errCorruptRecord) || (err == nil && len(data) != len(buf)) {
+		return true, &CorruptPageError{PageNum: pageNum}
+	}
+	if err != nil {
+		return true, fmt.Errorf("failed to read page %d: %w", pageNum, err)
+	}
+	copy(buf, data)
+	return true, nil
+}
+
+// write stores the sealed image of a page in free slots
+func (s *slotStore) write(pageNum uint32, data []byte) error {
+	rec := s.encodeRecord(data)
+	ref := s.alloc(uint32(len(rec) / slotSize))
+	if _, err := s.file.WriteAt(rec, int64(ref.start)*slotSize); err != nil {
+		s.freeExtent(ref)
+		return fmt.Errorf("failed to write page %d: %w", pageNum, err)
+	}
+
+	if int(pageNum) >= len(s.pages) {
+		s.pages = append(s.pages, make([]extent, int(pageNum)+1-len(s.pages))...)
+	}
+	if old := s.pages[pageNum]; old.count != 0 {
+		s.released = append(s.released, old)
+	}
+	s.pages[pageNum] = ref
+	s.changed = true
+	return nil
+}
+
+// truncate drops the records of pages from n on
+// Their slots are released on the next commit.
+func (s *slotStore) truncate(n uint32) {
+	if int(n) >= len(s.pages) {
+		return
+	}
+	for _, e := range s.pages[n:] {
+		if e.count != 0 {
+			s.released = append(s.released, e)
+		}
+	}
+	s.pages = s.pages[:n]
+	s.changed = true
+}
+
+// writeMap stores the page map if it changed and returns where it is
+// The previous page map is released on the next commit.
+func (s *slotStore) writeMap() (extent, uint32, error) {
+	if !s.changed {
+		return s.mapRef, s.mapCRC, nil
+	}
+
+	raw := make([]byte, len(s.pages)*pageMapEntrySize)
+	for i, e := range s.pages {
+		binary.LittleEndian.PutUint32(raw[i*pageMapEntrySize:], e.start)
+		binary.LittleEndian.PutUint32(raw[i*pageMapEntrySize+4:], e.count)
+	}
+	crc := crc32.Checksum(raw, castagnoli)
+
+	rec := s.encodeRecord(raw)
+	ref := s.alloc(uint32(len(rec) / slotSize))
+	if _, err := s.file.WriteAt(rec, int64(ref.start)*slotSize); err != nil {
+		s.freeExtent(ref)
+		return extent{}, 0, fmt.Errorf("failed to write page map: %w", err)
+	}
+
+	if s.mapRef.count != 0 {
+		s.released = append(s.released, s.mapRef)
+	}
+	s.mapRef = ref
+	s.mapCRC = crc
+	s.changed = false
+	return ref, crc, nil
+}
+
+// commit makes superseded records reusable once the header pointing at the
+// new page map is durable, and gives free space at the end back to the file
+func (s *slotStore) commit() error {
+	for _, e := range s.released {
+		s.freeExtent(e)
+	}
+	s.released = nil
+
+	size, err := s.file.Size()
+	if err != nil {
+		return err
+	}
+	if end := int64(s.end) * slotSize; size > end {
+		if err := s.file.Truncate(end); err != nil {
+			return fmt.Errorf("failed to truncate database: %w", err)
+		}
+	}
+	return nil
+}
+
+// encodeRecord returns a record for payload, padded to whole slots
+// The result is only valid until the next call.
+func (s *slotStore) encodeRecord(payload []byte) []byte {
+	s.zbuf.Reset()
+	s.zbuf.Write(make([]byte, recordHeaderSize))
+	s.zw.Reset(&s.zbuf)
+	s.zw.Write(payload)
+	s.zw.Close()
+
+	rec := s.zbuf.Bytes()
+	hdr := uint32(len(rec) - recordHeaderSize)
+	if len(rec)-recordHeaderSize >= len(payload) {
+		// Not worth it: keep the payload as is
+		rec = append(rec[:recordHeaderSize], payload...)
+		hdr = uint32(len(payload)) | recordRaw
+	}
+	binary.LittleEndian.PutUint32(rec, hdr)
+
+	padded := (len(rec) + slotSize - 1) / slotSize * slotSize
+	return append(rec, make([]byte, padded-len(rec))...)
+}
+
+// readRecord reads the record at ref and returns its payload
+// Payloads that would decompress to more than limit bytes are corrupt.
+func (s *slotStore) readRecord(ref extent, limit int) ([]byte, error) {
+	raw := make([]byte, int(ref.count)*slotSize)
+	if n, err := s.file.ReadAt(raw, int64(ref.start)*slotSize); n != len(raw) {
+		if err == io.EOF {
+			return nil, errCorruptRecord
+		}
+		return nil, err
+	}
+
+	hdr := binary.LittleEndian.Uint32(raw)
+	length := int(hdr &^ recordRaw)
+	if recordHeaderSize+length > len(raw) {
+		return nil, errCorruptRecord
+	}
+	payload := raw[recordHeaderSize : recordHeaderSize+length]
+	if hdr&recordRaw != 0 {
+		return payload, nil
+	}
+
+	zr := flate.NewReader(bytes.NewReader(payload))
+	defer zr.Close()
+	data, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil || len(data) > limit {
+		return nil, errCorruptRecord
+	}
+	return data, nil
+}
+
+// alloc takes count slots from the first free run that fits or from the end
+func (s *slotStore) alloc(count uint32) extent {
+	for i, f := range s.free {
+		if f.count < count {
+			continue
+		}
+		if f.count == count {
+			s.free = slices.Delete(s.free, i, i+1)
+		} else {
+			s.free[i] = extent{f.start + count, f.count - count}
+		}
+		return extent{f.start, count}
+	}
+	e := extent{s.end, count}
+	s.end += count
+	return e
+}
+
+// freeExtent returns slots to the free space
+func (s *slotStore) freeExtent(e extent) {
+	i := sort.Search(len(s.free), func(i int) bool { return s.free[i].start > e.start })
+	s.free = slices.Insert(s.free, i, e)
+
+	// Merge with the following run, then with the preceding one
+	if i+1 < len(s.free) && s.free[i].end() == s.free[i+1].start {
+		s.free[i].count += s.free[i+1].count
+		s.free = slices.Delete(s.free, i+1, i+2)
+	}
+	if i > 0 && s.free[i-1].end() == s.free[i].start {
+		s.free[i-1].count += s.free[i].count
+		s.free = slices.Delete(s.free, i, i+1)
+	}
+
+	// A free run at the end shrinks the file instead
+	if last := s.free[len(s.free)-1]; last.end() == s.end {
+		s.end = last.start
+		s.free = s.free[:len(s.free)-1]
+	}
+}
+
+// writePageMap stores the page map and makes every record durable before the
+// header pointing at them is written (must hold lock)
+func (p *Pager) writePageMap() error {
+	if err := p.acquireLock(LockExclusive); err != nil {
+		return err
+	}
+	ref, crc, err := p.store.writeMap()
+	if err != nil {
+		return err
+	}
+	p.header.PageMapSlot = ref.start
+	p.header.PageMapSlots = ref.count
+	p.header.PageMapCRC = crc
+	return p.syncFile()
+}
@@ -0,0 +1,192 @@
+package pager
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newCompressedPager(t *testing.T, dbPath string, mode JournalMode) *Pager {
+	t.Helper()
+	p, err := NewWithOptions(dbPath, Options{CacheSize: 4, JournalMode: mode, Compression: CompressionFlate})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	return p
+}
+
+// repetitivePage fills a page with a short repeating pattern
+func repetitivePage(p *Pager, seed byte) []byte {
+	data := make([]byte, p.PageSize())
+	for i := range p.UsableSize() {
+		data[i] = seed + byte(i%7)
+	}
+	return data
+}
+
+func TestCompression_ShrinksFile(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p := newCompressedPager(t, dbPath, JournalModeDelete)
+
+	const n = 100
+	for i := uint32(1); i <= n; i++ {
+		if err := p.WritePage(i, repetitivePage(p, byte(i))); err != nil {
+			t.Fatalf("Failed to write page %d: %v", i, err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to stat: %v", err)
+	}
+	if uncompressed := int64(n+1) * int64(p.PageSize()); info.Size()*5 > uncompressed {
+		t.Errorf("Expected at least 5x compression, file is %d bytes for %d bytes of pages", info.Size(), uncompressed)
+	}
+
+	p2, err := New(dbPath, 4)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer p2.Close()
+	if p2.Header().Compression != CompressionFlate {
+		t.Errorf("Expected compression to be recorded in the header")
+	}
+	for i := uint32(1); i <= n; i++ {
+		page, err := p2.ReadPage(i)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", i, err)
+		}
+		want := repetitivePage(p2, byte(i))
+		if !bytes.Equal(page.Data[:p2.UsableSize()], want[:p2.UsableSize()]) {
+			t.Fatalf("Page %d does not match after reopen", i)
+		}
+		p2.UnpinPage(i, false)
+	}
+}
+
+func TestCompression_IncompressiblePages(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p := newCompressedPager(t, dbPath, JournalModeOff)
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	want := make([]byte, p.PageSize())
+	for i := range p.UsableSize() {
+		want[i] = byte(rng.Uint32())
+	}
+	p.WritePage(1, want)
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	p2, err := New(dbPath, 4)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer p2.Close()
+	page, err := p2.ReadPage(1)
+	if err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	if !bytes.Equal(page.Data[:p2.UsableSize()], want[:p2.UsableSize()]) {
+		t.Error("Random page does not round-trip")
+	}
+	p2.UnpinPage(1, false)
+}
+
+func TestCompression_RewritesReuseSpace(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p := newCompressedPager(t, dbPath, JournalModeDelete)
+	defer p.Close()
+
+	var sizes []int64
+	for round := range 20 {
+		for i := uint32(1); i <= 10; i++ {
+			p.WritePage(i, repetitivePage(p, byte(round)))
+		}
+		if err := p.Flush(); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+		info, _ := os.Stat(dbPath)
+		sizes = append(sizes, info.Size())
+	}
+
+	// Old records are recycled, so the file must not keep growing
+	if last := sizes[len(sizes)-1]; last > 2*sizes[1] {
+		t.Errorf("File grew from %d to %d bytes rewriting the same pages", sizes[1], last)
+	}
+}
+
+func TestCompression_RollbackAndWAL(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeDelete, JournalModeWAL} {
+		dbPath := filepath.Join(t.TempDir(), "test.db")
+		p := newCompressedPager(t, dbPath, mode)
+
+		for i := uint32(1); i <= 8; i++ {
+			p.WritePage(i, repetitivePage(p, 1))
+		}
+		if err := p.Flush(); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+
+		tx, err := p.Begin()
+		if err != nil {
+			t.Fatalf("Failed to begin: %v", err)
+		}
+		for i := uint32(1); i <= 8; i++ {
+			p.WritePage(i, repetitivePage(p, 2))
+		}
+		if err := tx.Rollback(); err != nil {
+			t.Fatalf("Failed to roll back: %v", err)
+		}
+		if err := p.Checkpoint(); err != nil {
+			t.Fatalf("Failed to checkpoint: %v", err)
+		}
+		expectPages(t, p, 8, func(uint32) byte { return 1 })
+		if err := p.Close(); err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+
+		p2, err := NewWithOptions(dbPath, Options{CacheSize: 4, JournalMode: mode})
+		if err != nil {
+			t.Fatalf("Failed to reopen: %v", err)
+		}
+		expectPages(t, p2, 8, func(uint32) byte { return 1 })
+		p2.Close()
+	}
+}
+
+func TestCompression_CorruptRecord(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p := newCompressedPager(t, dbPath, JournalModeOff)
+	p.WritePage(1, repetitivePage(p, 1))
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// The first record after page 0 belongs to page 1
+	raw, _ := os.ReadFile(dbPath)
+	raw[p.PageSize()+recordHeaderSize+2] ^= 0xff
+	os.WriteFile(dbPath, raw, 0644)
+
+	p2, err := New(dbPath, 4)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer p2.Close()
+	if _, err := p2.ReadPage(1); !errors.Is(err, ErrCorruptPage) {
+		t.Errorf("Expected ErrCorruptPage, got %v", err)
+	}
+}
+
+func TestCompression_UnsupportedCodec(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	if _, err := NewWithOptions(dbPath, Options{Compression: 99}); !errors.Is(err, ErrUnsupportedCodec) {
+		t.Errorf("Expected ErrUnsupportedCodec, got %v", err)
+	}
+}
@@ -0,0 +1,353 @@
+package pager
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"syscall"
+	"testing"
+
+	"mash-db/pkg/vfs"
+)
+
+// The crash harness runs a random workload of transactions against a
+// FaultFS, cuts the power at every few mutating operations, and checks that
+// the reopened database holds exactly the last committed state. A crash in
+// the middle of a commit may leave either the old or the new state, but
+// never a mix of the two.
+
+const (
+	crashPath      = "crash.db"
+	crashMaxPage   = 12
+	crashTxCount   = 8
+	crashCacheSize = 3 // Small enough that transactions spill pages early
+)
+
+// crashState is the database contents the harness expects
+type crashState struct {
+	pages  map[uint32]byte // Every usable byte of a page holds its value
+	cookie uint32
+}
+
+func (s crashState) clone() crashState {
+	return crashState{pages: maps.Clone(s.pages), cookie: s.cookie}
+}
+
+func (s crashState) String() string {
+	return fmt.Sprintf("pages %v, cookie %d", s.pages, s.cookie)
+}
+
+// crashResult is how far a workload got before the power went out
+type crashResult struct {
+	committed crashState // Last state a commit was acknowledged for
+	pending   crashState // State of the transaction in flight
+	inCommit  bool       // Crashed inside Commit, so pending may have become durable
+}
+
+// crashConfig is a storage configuration the crash tests run against
+type crashConfig struct {
+	name        string
+	mode        JournalMode
+	compression Compression
+	key         []byte
+}
+
+var crashConfigs = []crashConfig{
+	{"off", JournalModeOff, CompressionNone, nil},
+	{"wal", JournalModeWAL, CompressionNone, nil},
+	{"delete", JournalModeDelete, CompressionNone, nil},
+	{"truncate", JournalModeTruncate, CompressionNone, nil},
+	{"off-flate", JournalModeOff, CompressionFlate, nil},
+	{"wal-flate", JournalModeWAL, CompressionFlate, nil},
+	{"delete-flate", JournalModeDelete, CompressionFlate, nil},
+	{"wal-aes", JournalModeWAL, CompressionNone, testKey},
+	{"delete-aes", JournalModeDelete, CompressionNone, testKey},
+}
+
+func crashOptions(ffs *vfs.FaultFS, cfg crashConfig) Options {
+	return Options{
+		CacheSize:         crashCacheSize,
+		JournalMode:       cfg.mode,
+		WALAutoCheckpoint: 5,
+		FS:                ffs,
+		Compression:       cfg.compression,
+		Key:               cfg.key,
+	}
+}
+
+// runCrashWorkload runs the workload for seed until it finishes or fails
+func runCrashWorkload(ffs *vfs.FaultFS, cfg crashConfig, seed uint64) crashResult {
+	rng := rand.New(rand.NewPCG(seed, 0))
+	res := crashResult{committed: crashState{pages: make(map[uint32]byte)}}
+
+	p, err := NewWithOptions(crashPath, crashOptions(ffs, cfg))
+	if err != nil {
+		return res
+	}
+
+	for range crashTxCount {
+		tx, err := p.Begin()
+		if err != nil {
+			return res
+		}
+		res.pending = res.committed.clone()
+
+		// Truncating before the writes regrows some of the pages cut off
+		if rng.IntN(4) == 0 {
+			n := min(p.NumPages(), 1+uint32(rng.IntN(crashMaxPage)))
+			if err := p.Truncate(n); err != nil {
+				return res
+			}
+			maps.DeleteFunc(res.pending.pages, func(pageNum uint32, _ byte) bool { return pageNum >= n })
+		}
+
+		for range 1 + rng.IntN(6) {
+			pageNum := 1 + uint32(rng.IntN(crashMaxPage))
+			value := byte(1 + rng.IntN(255))
+			if err := p.WritePage(pageNum, testPage(p, value)); err != nil {
+				return res
+			}
+			res.pending.pages[pageNum] = value
+		}
+		if rng.IntN(3) == 0 {
+			cookie := rng.Uint32()
+			if err := p.SetSchemaCookie(cookie); err != nil {
+				return res
+			}
+			res.pending.cookie = cookie
+		}
+
+		res.inCommit = true
+		if err := tx.Commit(); err != nil {
+			return res
+		}
+		res.inCommit = false
+		res.committed = res.pending
+	}
+
+	// Closing checkpoints the WAL, which must not lose anything either
+	res.pending = res.committed
+	res.inCommit = true
+	p.Close()
+	res.inCommit = false
+	return res
+}
+
+// readCrashState reads back every page the workload may have written
+func readCrashState(t *testing.T, p *Pager) crashState {
+	t.Helper()
+	s := crashState{pages: make(map[uint32]byte), cookie: p.SchemaCookie()}
+	for pageNum := uint32(1); pageNum <= crashMaxPage; pageNum++ {
+		page, err := p.ReadPage(pageNum)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", pageNum, err)
+		}
+		value := page.Data[0]
+		for i, b := range page.Data[:p.UsableSize()] {
+			if b != value {
+				t.Fatalf("Page %d is a mix of images: byte 0 is %d, byte %d is %d", pageNum, value, i, b)
+			}
+		}
+		p.UnpinPage(pageNum, false)
+		if value != 0 {
+			s.pages[pageNum] = value
+		}
+	}
+	return s
+}
+
+func (s crashState) equal(o crashState) bool {
+	return s.cookie == o.cookie && maps.Equal(s.pages, o.pages)
+}
+
+// createCrashDB creates an empty database before any crash is armed
+func createCrashDB(t *testing.T, ffs *vfs.FaultFS, cfg crashConfig) {
+	t.Helper()
+	p, err := NewWithOptions(crashPath, crashOptions(ffs, cfg))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+}
+
+func TestCrash_RandomWorkloads(t *testing.T) {
+	seeds := []uint64{1, 2, 3}
+	if testing.Short() {
+		seeds = seeds[:1]
+	}
+
+	for _, tc := range crashConfigs {
+		for _, seed := range seeds {
+			t.Run(fmt.Sprintf("%s/seed%d", tc.name, seed), func(t *testing.T) {
+				// A dry run tells how many crash points the workload has
+				dry := vfs.NewFaultFS(seed)
+				createCrashDB(t, dry, tc)
+				start := dry.Mutations()
+				final := runCrashWorkload(dry, tc, seed)
+				total := dry.Mutations() - start
+				if final.inCommit || len(final.committed.pages) == 0 {
+					t.Fatalf("Dry run did not complete: %+v", final)
+				}
+
+				step := max(1, total/60)
+				for crashAt := 1; crashAt <= total; crashAt += step {
+					for _, tear := range []bool{false, true} {
+						ffs := vfs.NewFaultFS(seed*1000 + uint64(crashAt))
+						createCrashDB(t, ffs, tc)
+						ffs.CrashAfter(crashAt)
+						res := runCrashWorkload(ffs, tc, seed)
+						ffs.Restart(tear)
+
+						p, err := NewWithOptions(crashPath, crashOptions(ffs, tc))
+						if err != nil {
+							t.Fatalf("Crash at %d (tear %v): failed to reopen: %v", crashAt, tear, err)
+						}
+						got := readCrashState(t, p)
+						if !got.equal(res.committed) && !(res.inCommit && got.equal(res.pending)) {
+							t.Fatalf("Crash at %d (tear %v): got %v, want %v (in commit %v, pending %v)",
+								crashAt, tear, got, res.committed, res.inCommit, res.pending)
+						}
+
+						// The recovered database must take new writes
+						if err := p.WritePage(1, testPage(p, 1)); err != nil {
+							t.Fatalf("Crash at %d: failed to write after recovery: %v", crashAt, err)
+						}
+						if err := p.Close(); err != nil {
+							t.Fatalf("Crash at %d: failed to close after recovery: %v", crashAt, err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCrash_IOErrorDuringCommit(t *testing.T) {
+	faults := []struct {
+		name string
+		op   vfs.Op
+		err  error
+	}{
+		{"write-eio", vfs.OpWrite, syscall.EIO},
+		{"write-enospc", vfs.OpWrite, syscall.ENOSPC},
+		{"sync-eio", vfs.OpSync, syscall.EIO},
+	}
+
+	for _, tc := range crashConfigs {
+		for _, fault := range faults {
+			t.Run(tc.name+"/"+fault.name, func(t *testing.T) {
+				ffs := vfs.NewFaultFS(1)
+				p, err := NewWithOptions(crashPath, crashOptions(ffs, tc))
+				if err != nil {
+					t.Fatalf("Failed to create pager: %v", err)
+				}
+				for i := uint32(1); i <= 4; i++ {
+					p.WritePage(i, testPage(p, 1))
+				}
+				if err := p.Flush(); err != nil {
+					t.Fatalf("Failed to flush: %v", err)
+				}
+
+				tx, err := p.Begin()
+				if err != nil {
+					t.Fatalf("Failed to begin: %v", err)
+				}
+				for i := uint32(1); i <= 4; i++ {
+					p.WritePage(i, testPage(p, 2))
+				}
+				ffs.InjectError(fault.op, 1, fault.err)
+				if err := tx.Commit(); !errors.Is(err, fault.err) {
+					t.Fatalf("Expected commit to fail with %v, got %v", fault.err, err)
+				}
+				if err := tx.Rollback(); err != nil {
+					t.Fatalf("Failed to roll back: %v", err)
+				}
+
+				want := crashState{pages: map[uint32]byte{1: 1, 2: 1, 3: 1, 4: 1}}
+				if got := readCrashState(t, p); !got.equal(want) {
+					t.Errorf("After rollback: got %v, want %v", got, want)
+				}
+
+				// Power loss right after the failed commit must not matter either
+				ffs.Crash()
+				ffs.Restart(true)
+				p2, err := NewWithOptions(crashPath, crashOptions(ffs, tc))
+				if err != nil {
+					t.Fatalf("Failed to reopen: %v", err)
+				}
+				defer p2.Close()
+				if got := readCrashState(t, p2); !got.equal(want) {
+					t.Errorf("After reopen: got %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestCrash_Rekey(t *testing.T) {
+	for _, tc := range crashConfigs {
+		if tc.key == nil {
+			continue
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			// rekey writes a few pages and switches to otherKey
+			rekey := func(ffs *vfs.FaultFS) error {
+				p, err := NewWithOptions(crashPath, crashOptions(ffs, tc))
+				if err != nil {
+					return err
+				}
+				for i := uint32(1); i <= crashMaxPage; i++ {
+					if err := p.WritePage(i, testPage(p, byte(i))); err != nil {
+						return err
+					}
+				}
+				if err := p.Flush(); err != nil {
+					return err
+				}
+				if err := p.Rekey(otherKey); err != nil {
+					return err
+				}
+				return p.Close()
+			}
+
+			dry := vfs.NewFaultFS(1)
+			if err := rekey(dry); err != nil {
+				t.Fatalf("Dry run failed: %v", err)
+			}
+			total := dry.Mutations()
+
+			want := crashState{pages: make(map[uint32]byte)}
+			for i := uint32(1); i <= crashMaxPage; i++ {
+				want.pages[i] = byte(i)
+			}
+			for crashAt := 1; crashAt <= total; crashAt++ {
+				ffs := vfs.NewFaultFS(uint64(crashAt))
+				ffs.CrashAfter(crashAt)
+				rekey(ffs)
+				ffs.Restart(true)
+
+				// Whichever key the database opens with, nothing may be lost
+				opts := crashOptions(ffs, tc)
+				p, err := NewWithOptions(crashPath, opts)
+				if errors.Is(err, ErrWrongKey) {
+					opts.Key = otherKey
+					p, err = NewWithOptions(crashPath, opts)
+				}
+				if errors.Is(err, ErrNotADatabase) {
+					continue // Crashed before the database was created
+				}
+				if err != nil {
+					t.Fatalf("Crash at %d: failed to reopen: %v", crashAt, err)
+				}
+				got := readCrashState(t, p)
+				if len(got.pages) != 0 && !got.equal(want) {
+					t.Fatalf("Crash at %d: got %v, want %v", crashAt, got, want)
+				}
+				p.Close()
+			}
+		})
+	}
+}
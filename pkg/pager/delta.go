@@ -0,0 +1,255 @@
+package pager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"mash-db/internal/common"
+	"mash-db/pkg/vfs"
+)
+
+// Change tracking and incremental backups
+//
+// A database created with Options.TrackChanges stamps every page it writes
+// with an epoch: the change counter the commit the page is written for ends
+// at. The stamp sits in the pager's reserved area in front of the cipher's
+// tag and nonce, so it is encrypted along with the page:
+//
+//	page: contents, epoch, [tag, nonce,] checksum
+//
+// A full backup written by BackupWriter keeps the stamps and is taken at the
+// epoch Backup.Epoch reports. BackupDelta then copies only the pages stamped
+// after a given epoch, plus the header page, into a delta file:
+//
+//	delta:  magic, version, page size, since, epoch
+//	record: page number, page image
+//	end:    0xffffffff, number of records
+//
+// ApplyDelta brings the image of a backup at any epoch from since to epoch up
+// to epoch, so a base image and a chain of deltas, each taken since the one
+// before, restore the database as of the last. Pages that read as zeroes,
+// never written or cut off and regrown, carry no stamp and always go into
+// a delta, sealed like any other page.
+const (
+	epochSize       = 4
+	deltaHeaderSize = 32
+	deltaVersion    = 1
+	deltaEnd        = ^uint32(0)
+)
+
+// deltaMagic identifies a MashDB incremental backup
+var deltaMagic = [16]byte{'M', 'a', 's', 'h', 'D', 'B', ' ', 'd', 'e', 'l', 't', 'a', 0, 0, 0, 0}
+
+var (
+	ErrNoPageEpochs  = errors.New("database does not track page changes")
+	ErrNoEpochRoom   = errors.New("page contents leave no room to track changes")
+	ErrFutureEpoch   = errors.New("backup epoch is ahead of the database")
+	ErrNotADelta     = errors.New("file is not a MashDB incremental backup")
+	ErrCorruptDelta  = errors.New("incremental backup is truncated or corrupt")
+	ErrDeltaMismatch = errors.New("incremental backup does not apply to this database image")
+)
+
+// EnableTrackChanges makes an existing database track page changes, as one
+// created with Options.TrackChanges does
+// The stamps take the last four usable bytes of every page, so UsableSize
+// shrinks by four, and it fails with ErrNoEpochRoom if any page has data in
+// them. Every page is rewritten in a transaction of its own. Other pagers
+// with the file open keep the old layout until they reopen it.
+func (p *Pager) EnableTrackChanges() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed.Load() {
+		return ErrFileClosed
+	}
+
+	if p.tx != nil {
+		return ErrTxActive
+	}
+
+	if err := p.lockReserved(); err != nil {
+		return err
+	}
+	defer p.releaseLock()
+
+	if p.header.PageEpochs {
+		return nil
+	}
+	if err := p.beginInternal(); err != nil {
+		return err
+	}
+	if err := p.stampPages(); err != nil {
+		rbErr := p.rollbackInternal()
+		p.usable = p.pageSize - p.ReservedBytes()
+		if rbErr != nil {
+			return fmt.Errorf("%w (rollback also failed: %v)", err, rbErr)
+		}
+		return err
+	}
+	p.endTx()
+	return nil
+}
+
+// stampPages moves the usable area's last bytes into the reserved area and
+// rewrites every page with its epoch (must hold lock, in a transaction)
+func (p *Pager) stampPages() error {
+	// Journal every original up front, as Rekey does
+	if p.journal != nil && p.store == nil {
+		for pageNum := uint32(0); pageNum < p.numPages.Load(); pageNum++ {
+			if err := p.journalOriginal(pageNum); err != nil {
+				return err
+			}
+		}
+		if err := p.journal.sync(); err != nil {
+			return err
+		}
+	}
+
+	p.header.PageEpochs = true
+	p.header.ReservedBytes += epochSize
+	p.usable -= epochSize
+	p.dirty = true
+
+	buf := make([]byte, p.pageSize)
+	for pageNum := uint32(1); pageNum < p.numPages.Load(); pageNum++ {
+		if err := p.readPageFromDisk(pageNum, buf); err != nil {
+			return err
+		}
+		if !allZero(buf[p.usable : p.usable+epochSize]) {
+			return fmt.Errorf("%w: page %d", ErrNoEpochRoom, pageNum)
+		}
+		if err := p.writePageToDisk(pageNum, buf); err != nil {
+			return err
+		}
+	}
+	return p.flushAllInternal()
+}
+
+// BackupDelta starts writing the pages changed after epoch to w as an
+// incremental backup
+// The database must track changes, and epoch is usually the Epoch of the
+// backup before. A change to the source mid-copy starts the delta over, like
+// any backup.
+func (p *Pager) BackupDelta(w io.Writer, epoch uint32) *Backup {
+	return &Backup{src: p, w: w, delta: true, since: epoch}
+}
+
+// changedSince reports whether the on-disk image of a page was written after
+// epoch (must hold lock)
+func (p *Pager) changedSince(pageNum uint32, image []byte, epoch uint32) (bool, error) {
+	if allZero(image) {
+		return true, nil
+	}
+	stamp := image
+	if p.isEncryptedPage(pageNum) {
+		stamp = make([]byte, p.pageSize)
+		copy(stamp, image)
+		if err := p.cipher.open(pageNum, stamp); err != nil {
+			return false, err
+		}
+	}
+	return binary.LittleEndian.Uint32(stamp[p.usable:]) > epoch, nil
+}
+
+// deltaRecord returns the bytes of an incremental backup holding a page
+// The header page opens the backup and comes with the file header.
+func (b *Backup) deltaRecord(page backupPage) []byte {
+	var buf []byte
+	if page.pageNum == common.HeaderPageNum {
+		buf = make([]byte, deltaHeaderSize)
+		copy(buf, deltaMagic[:])
+		binary.LittleEndian.PutUint32(buf[16:], deltaVersion)
+		binary.LittleEndian.PutUint32(buf[20:], uint32(len(page.data)))
+		binary.LittleEndian.PutUint32(buf[24:], b.since)
+		binary.LittleEndian.PutUint32(buf[28:], b.header.ChangeCounter)
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, page.pageNum)
+	return append(buf, page.data...)
+}
+
+// deltaTrailer returns the record that closes an incremental backup of count pages
+func deltaTrailer(count uint32) []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, deltaEnd)
+	return binary.LittleEndian.AppendUint32(buf, count)
+}
+
+// ApplyDelta applies the incremental backup read from r to file, the image of
+// a backup of the same database
+// The image must be from an epoch between the ones the delta was taken since
+// and at. Should the delta turn out corrupt, the image is left partly updated,
+// so deltas are best applied to a copy.
+func ApplyDelta(file vfs.File, r io.Reader) error {
+	buf := make([]byte, deltaHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil || [16]byte(buf[:16]) != deltaMagic {
+		return ErrNotADelta
+	}
+	if v := binary.LittleEndian.Uint32(buf[16:]); v != deltaVersion {
+		return fmt.Errorf("%w: delta version %d", ErrUnsupportedVersion, v)
+	}
+	pageSize := binary.LittleEndian.Uint32(buf[20:])
+	since := binary.LittleEndian.Uint32(buf[24:])
+	epoch := binary.LittleEndian.Uint32(buf[28:])
+
+	base := make([]byte, headerSize)
+	if _, err := file.ReadAt(base, 0); err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	h, err := decodeHeader(base)
+	if err != nil {
+		return err
+	}
+	if h.PageSize != pageSize || !h.PageEpochs || h.Compression != CompressionNone ||
+		h.ChangeCounter < since || h.ChangeCounter > epoch {
+		return fmt.Errorf("%w: image at epoch %d, delta from %d to %d", ErrDeltaMismatch, h.ChangeCounter, since, epoch)
+	}
+
+	image := make([]byte, pageSize)
+	var count uint32
+	for {
+		var rec [4]byte
+		if _, err := io.ReadFull(r, rec[:]); err != nil {
+			return ErrCorruptDelta
+		}
+		pageNum := binary.LittleEndian.Uint32(rec[:])
+		if pageNum == deltaEnd {
+			if _, err := io.ReadFull(r, rec[:]); err != nil || binary.LittleEndian.Uint32(rec[:]) != count {
+				return ErrCorruptDelta
+			}
+			break
+		}
+		if _, err := io.ReadFull(r, image); err != nil {
+			return ErrCorruptDelta
+		}
+
+		stored := binary.LittleEndian.Uint32(image[pageSize-checksumSize:])
+		if stored != pageChecksum(pageNum, image) || allZero(image) {
+			return &CorruptPageError{PageNum: pageNum}
+		}
+		// The header page comes first and sets the size of the database
+		if count == 0 {
+			if pageNum != common.HeaderPageNum {
+				return ErrCorruptDelta
+			}
+			if h, err = decodeHeader(image); err != nil || h.ChangeCounter != epoch {
+				return ErrCorruptDelta
+			}
+		} else if pageNum == common.HeaderPageNum || pageNum >= h.PageCount {
+			return ErrCorruptDelta
+		}
+
+		if _, err := file.WriteAt(image, int64(pageNum)*int64(pageSize)); err != nil {
+			return fmt.Errorf("failed to write page %d: %w", pageNum, err)
+		}
+		count++
+	}
+	if count == 0 {
+		return ErrCorruptDelta
+	}
+
+	if err := file.Truncate(int64(h.PageCount) * int64(pageSize)); err != nil {
+		return fmt.Errorf("failed to truncate image: %w", err)
+	}
+	return file.Sync()
+}
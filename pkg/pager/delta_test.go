@@ -0,0 +1,266 @@
+package pager
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"mash-db/pkg/vfs"
+)
+
+// backupImage writes a full backup of p to a file of fsys and returns its epoch
+func backupImage(t *testing.T, p *Pager, fsys vfs.FS, name string) uint32 {
+	t.Helper()
+	file, err := fsys.Open(name, vfs.OpenCreate)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer file.Close()
+	b := p.BackupWriter(fileWriter{file})
+	if err := b.Run(16, 0); err != nil {
+		t.Fatalf("Failed to back up: %v", err)
+	}
+	return b.Epoch()
+}
+
+// backupDelta writes an incremental backup of p since epoch and returns it
+// with its epoch
+func backupDelta(t *testing.T, p *Pager, epoch uint32) ([]byte, uint32) {
+	t.Helper()
+	var buf bytes.Buffer
+	b := p.BackupDelta(&buf, epoch)
+	if err := b.Run(16, 0); err != nil {
+		t.Fatalf("Failed to back up changes since %d: %v", epoch, err)
+	}
+	return buf.Bytes(), b.Epoch()
+}
+
+// applyDelta applies an incremental backup to a file of fsys
+func applyDelta(fsys vfs.FS, name string, delta []byte) error {
+	file, err := fsys.Open(name, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return ApplyDelta(file, bytes.NewReader(delta))
+}
+
+// deltaPages returns the number of pages an incremental backup holds
+func deltaPages(p *Pager, delta []byte) int {
+	return (len(delta) - deltaHeaderSize - 8) / (4 + p.PageSize())
+}
+
+func TestBackupDelta(t *testing.T) {
+	for _, opts := range []Options{
+		{},
+		{Compression: CompressionFlate, JournalMode: JournalModeWAL},
+		{Key: testKey},
+	} {
+		opts.TrackChanges = true
+		src := newBackupSource(t, 40, opts)
+		fsys := vfs.NewMemFS()
+		epoch := backupImage(t, src, fsys, "backup.db")
+
+		// Nothing changed yet: the delta holds the header page alone
+		delta, _ := backupDelta(t, src, epoch)
+		if n := deltaPages(src, delta); n != 1 {
+			t.Errorf("Expected the header page, got %d pages", n)
+		}
+
+		src.WritePage(1, testPage(src, 99))
+		src.WritePage(30, testPage(src, 30))
+		if err := src.Flush(); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+		first, epoch := backupDelta(t, src, epoch)
+		if n := deltaPages(src, first); n != 3 {
+			t.Errorf("Expected 2 changed pages more, got %d pages", n)
+		}
+
+		tx, err := src.Begin()
+		if err != nil {
+			t.Fatalf("Failed to begin: %v", err)
+		}
+		for i := uint32(41); i <= 45; i++ {
+			src.WritePage(i, testPage(src, byte(i)))
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+		second, _ := backupDelta(t, src, epoch)
+		if n := deltaPages(src, second); n != 6 {
+			t.Errorf("Expected 5 new pages more, got %d pages", n)
+		}
+
+		// The chain only applies in order
+		if err := applyDelta(fsys, "backup.db", second); !errors.Is(err, ErrDeltaMismatch) {
+			t.Errorf("Expected ErrDeltaMismatch, got %v", err)
+		}
+		for _, delta := range [][]byte{first, second} {
+			if err := applyDelta(fsys, "backup.db", delta); err != nil {
+				t.Fatalf("Failed to apply delta: %v", err)
+			}
+		}
+		// Applying a delta again changes nothing
+		if err := applyDelta(fsys, "backup.db", second); err != nil {
+			t.Fatalf("Failed to apply delta again: %v", err)
+		}
+
+		p, err := NewWithOptions("backup.db", Options{FS: fsys, Key: opts.Key})
+		if err != nil {
+			t.Fatalf("Failed to open restored backup: %v", err)
+		}
+		expectBackup(t, p, 45, 99)
+		p.Close()
+	}
+}
+
+func TestBackupDelta_Truncate(t *testing.T) {
+	src := newBackupSource(t, 20, Options{TrackChanges: true})
+	fsys := vfs.NewMemFS()
+	epoch := backupImage(t, src, fsys, "backup.db")
+
+	// Pages cut off and grown back unwritten read as zeroes in the copy too;
+	// the first two allocations reuse the free pages 5 and 6
+	if err := src.Truncate(15); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	for range 5 {
+		if _, err := src.AllocatePage(); err != nil {
+			t.Fatalf("Failed to allocate page: %v", err)
+		}
+	}
+	if err := src.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	delta, _ := backupDelta(t, src, epoch)
+	if err := applyDelta(fsys, "backup.db", delta); err != nil {
+		t.Fatalf("Failed to apply delta: %v", err)
+	}
+
+	p, err := NewWithOptions("backup.db", Options{FS: fsys})
+	if err != nil {
+		t.Fatalf("Failed to open restored backup: %v", err)
+	}
+	defer p.Close()
+	if p.NumPages() != 18 {
+		t.Errorf("Expected 18 pages, got %d", p.NumPages())
+	}
+	for i := uint32(15); i < 18; i++ {
+		page, err := p.ReadPage(i)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", i, err)
+		}
+		if page.Data[0] != 0 {
+			t.Errorf("Page %d: expected zeroes, got %d", i, page.Data[0])
+		}
+		p.UnpinPage(i, false)
+	}
+}
+
+func TestEnableTrackChanges(t *testing.T) {
+	for _, opts := range []Options{
+		{JournalMode: JournalModeDelete},
+		{Compression: CompressionFlate, JournalMode: JournalModeWAL},
+		{Key: testKey},
+	} {
+		dbPath := filepath.Join(t.TempDir(), "test.db")
+
+		// Pages using their last four bytes leave no room for the stamps
+		full := newTestDB(t, filepath.Join(t.TempDir(), "full.db"), opts, 5, ownNumber)
+		usable := full.UsableSize()
+		if err := full.EnableTrackChanges(); !errors.Is(err, ErrNoEpochRoom) {
+			t.Errorf("Expected ErrNoEpochRoom, got %v", err)
+		}
+		if full.UsableSize() != usable || full.Header().PageEpochs {
+			t.Errorf("Expected the layout unchanged, got %d usable bytes", full.UsableSize())
+		}
+		expectPages(t, full, 5, func(i uint32) byte { return byte(i) })
+
+		p := newTestDB(t, dbPath, opts, 5, func(p *Pager, i uint32) []byte {
+			data := testPage(p, byte(i))
+			clear(data[p.UsableSize()-epochSize : p.UsableSize()])
+			return data
+		})
+		if err := p.EnableTrackChanges(); err != nil {
+			t.Fatalf("Failed to enable change tracking: %v", err)
+		}
+		if p.UsableSize() != usable-epochSize || !p.Header().PageEpochs {
+			t.Errorf("Expected %d usable bytes and page epochs, got %d", usable-epochSize, p.UsableSize())
+		}
+
+		fsys := vfs.NewMemFS()
+		epoch := backupImage(t, p, fsys, "backup.db")
+		p.WritePage(2, testPage(p, 22))
+		if err := p.Flush(); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+		delta, _ := backupDelta(t, p, epoch)
+		if n := deltaPages(p, delta); n != 2 {
+			t.Errorf("Expected the header and page 2, got %d pages", n)
+		}
+		if err := p.Close(); err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+
+		p, err := NewWithOptions(dbPath, opts)
+		if err != nil {
+			t.Fatalf("Failed to reopen: %v", err)
+		}
+		if p.UsableSize() != usable-epochSize {
+			t.Errorf("Expected %d usable bytes after reopening, got %d", usable-epochSize, p.UsableSize())
+		}
+		expectPages(t, p, 5, func(i uint32) byte {
+			if i == 2 {
+				return 22
+			}
+			return byte(i)
+		})
+		p.Close()
+	}
+}
+
+func TestBackupDelta_Errors(t *testing.T) {
+	src := newBackupSource(t, 10, Options{})
+	var buf bytes.Buffer
+	if _, err := src.BackupDelta(&buf, 0).Step(-1); !errors.Is(err, ErrNoPageEpochs) {
+		t.Errorf("Expected ErrNoPageEpochs, got %v", err)
+	}
+
+	src = newBackupSource(t, 10, Options{TrackChanges: true})
+	if src.ReservedBytes() != checksumSize+epochSize {
+		t.Errorf("Expected %d reserved bytes, got %d", checksumSize+epochSize, src.ReservedBytes())
+	}
+	if _, err := src.BackupDelta(&buf, 1000).Step(-1); !errors.Is(err, ErrFutureEpoch) {
+		t.Errorf("Expected ErrFutureEpoch, got %v", err)
+	}
+
+	fsys := vfs.NewMemFS()
+	epoch := backupImage(t, src, fsys, "backup.db")
+	src.WritePage(3, testPage(src, 33))
+	delta, _ := backupDelta(t, src, epoch)
+
+	if err := applyDelta(fsys, "backup.db", []byte("not a delta at all, just some bytes")); !errors.Is(err, ErrNotADelta) {
+		t.Errorf("Expected ErrNotADelta, got %v", err)
+	}
+	if err := applyDelta(fsys, "backup.db", delta[:len(delta)-4]); !errors.Is(err, ErrCorruptDelta) {
+		t.Errorf("Expected ErrCorruptDelta for a truncated delta, got %v", err)
+	}
+	damaged := bytes.Clone(delta)
+	damaged[len(damaged)-100] ^= 0xff
+	if err := applyDelta(fsys, "backup.db", damaged); !errors.Is(err, ErrCorruptPage) {
+		t.Errorf("Expected ErrCorruptPage, got %v", err)
+	}
+
+	// A database without change tracking cannot take a delta
+	plain, err := NewWithOptions(filepath.Join(t.TempDir(), "plain.db"), Options{})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer plain.Close()
+	backupImage(t, plain, fsys, "plain.db")
+	if err := applyDelta(fsys, "plain.db", delta); !errors.Is(err, ErrDeltaMismatch) {
+		t.Errorf("Expected ErrDeltaMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package pager
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"mash-db/internal/common"
+)
+
+// Encrypted page layout
+//
+// Every page but the header page is encrypted with AES-GCM under the
+// database key. The pager's reserved area at the end of the page grows to
+// hold the authentication tag and the nonce in front of the checksum:
+//
+//	page: ciphertext, tag, nonce, checksum
+//
+// Each write draws a fresh random nonce, and the page number is authenticated
+// along with the contents so pages cannot be swapped around. The checksum
+// covers the encrypted image, which keeps journaling, the write-ahead log and
+// crash recovery oblivious to encryption: none of them ever needs the key.
+//
+// The header page stays in the clear so the page size and layout can be read
+// before a key is known. It carries a key check value derived from the key,
+// which tells a wrong key apart from a corrupt page on open.
+const (
+	nonceSize      = 12
+	tagSize        = 16
+	cipherOverhead = tagSize + nonceSize
+	keyCheckSize   = 16
+)
+
+// Encryption selects how pages are protected in the database file
+type Encryption uint32
+
+const (
+	// EncryptionNone stores pages in the clear
+	EncryptionNone Encryption = iota
+
+	// EncryptionAESGCM encrypts and authenticates every page with AES-GCM
+	EncryptionAESGCM
+)
+
+var (
+	ErrInvalidKey   = errors.New("encryption key must be 16, 24 or 32 bytes")
+	ErrWrongKey     = errors.New("encryption key does not match the database")
+	ErrNotEncrypted = errors.New("database is not encrypted")
+)
+
+// keyCheckLabel is the message the key check value is computed over
+var keyCheckLabel = []byte("MashDB key check")
+
+// pageCipher encrypts and decrypts page images under one key
+type pageCipher struct {
+	aead  cipher.AEAD
+	check [keyCheckSize]byte
+}
+
+// newPageCipher returns the cipher for an AES-128, AES-192 or AES-256 key
+func newPageCipher(key []byte) (*pageCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: got %d", ErrInvalidKey, len(key))
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &pageCipher{aead: aead}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(keyCheckLabel)
+	copy(c.check[:], mac.Sum(nil))
+	return c, nil
+}
+
+// pageAAD returns the additional data authenticated with a page
+func pageAAD(pageNum uint32) []byte {
+	var aad [4]byte
+	binary.LittleEndian.PutUint32(aad[:], pageNum)
+	return aad[:]
+}
+
+// seal encrypts a page image in place, filling in its tag and nonce
+// The checksum trailer is left for the caller to set.
+func (c *pageCipher) seal(pageNum uint32, buf []byte) {
+	n := len(buf) - checksumSize - cipherOverhead
+	nonce := buf[n+tagSize : n+cipherOverhead]
+	rand.Read(nonce)
+	c.aead.Seal(buf[:0], nonce, buf[:n], pageAAD(pageNum))
+}
+
+// open decrypts and authenticates a page image in place
+func (c *pageCipher) open(pageNum uint32, buf []byte) error {
+	n := len(buf) - checksumSize - cipherOverhead
+	var nonce [nonceSize]byte
+	copy(nonce[:], buf[n+tagSize:])
+	if _, err := c.aead.Open(buf[:0], nonce[:], buf[:n+tagSize], pageAAD(pageNum)); err != nil {
+		return &CorruptPageError{PageNum: pageNum}
+	}
+	return nil
+}
+
+// checkKey verifies that the pager's key, if any, is the one a header expects
+func (p *Pager) checkKey(h Header) error {
+	switch {
+	case h.Encryption == EncryptionNone && p.cipher != nil:
+		return ErrNotEncrypted
+	case h.Encryption != EncryptionNone && p.cipher == nil:
+		return fmt.Errorf("%w: database is encrypted", ErrWrongKey)
+	case p.cipher != nil && subtle.ConstantTimeCompare(h.KeyCheck[:], p.cipher.check[:]) != 1:
+		return ErrWrongKey
+	}
+	return nil
+}
+
+// Rekey re-encrypts every page of the database under newKey
+// Pending changes are committed first. The switch is atomic: should it fail
+// or the process crash, the database stays readable with the old key only.
+// In WAL mode the rewritten pages go through the log like any transaction.
+func (p *Pager) Rekey(newKey []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed.Load() {
+		return ErrFileClosed
+	}
+
+	if p.tx != nil {
+		return ErrTxActive
+	}
+
+	if err := p.lockReserved(); err != nil {
+		return err
+	}
+	defer p.releaseLock()
+
+	if p.cipher == nil {
+		return ErrNotEncrypted
+	}
+	next, err := newPageCipher(newKey)
+	if err != nil {
+		return err
+	}
+
+	if err := p.beginInternal(); err != nil {
+		return err
+	}
+	old := p.cipher
+	if err := p.rekeyPages(old, next); err != nil {
+		p.cipher = old
+		if rbErr := p.rollbackInternal(); rbErr != nil {
+			return fmt.Errorf("%w (rollback also failed: %v)", err, rbErr)
+		}
+		return err
+	}
+	p.endTx()
+	return nil
+}
+
+// rekeyPages rewrites every page under next and commits the new key check
+// value (must hold lock, in a transaction)
+func (p *Pager) rekeyPages(old, next *pageCipher) error {
+	// Journal every original up front so the journal is synced once rather
+	// than before each page is overwritten
+	if p.journal != nil && p.store == nil {
+		for pageNum := uint32(0); pageNum < p.numPages.Load(); pageNum++ {
+			if err := p.journalOriginal(pageNum); err != nil {
+				return err
+			}
+		}
+		if err := p.journal.sync(); err != nil {
+			return err
+		}
+	}
+
+	p.cipher = next
+	p.header.KeyCheck = next.check
+	p.dirty = true
+
+	buf := make([]byte, p.pageSize)
+	for pageNum := uint32(1); pageNum < p.numPages.Load(); pageNum++ {
+		if err := p.readPageImage(pageNum, buf); err != nil {
+			return err
+		}
+		// Zeroes are a page never written
+		if !allZero(buf) {
+			if err := old.open(pageNum, buf); err != nil {
+				return err
+			}
+		}
+		if err := p.writePageToDisk(pageNum, buf); err != nil {
+			return err
+		}
+	}
+	return p.flushAllInternal()
+}
+
+// allZero reports whether every byte of data is zero
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isEncryptedPage reports whether a page is stored encrypted (must hold lock)
+func (p *Pager) isEncryptedPage(pageNum uint32) bool {
+	return p.cipher != nil && pageNum != common.HeaderPageNum
+}
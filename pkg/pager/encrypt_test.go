@@ -0,0 +1,200 @@
+package pager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	testKey  = bytes.Repeat([]byte{0x42}, 32)
+	otherKey = bytes.Repeat([]byte{0x17}, 16)
+)
+
+func TestEncryption_RoundTrip(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p, err := NewWithOptions(dbPath, Options{Key: testKey, CacheSize: 4})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	if p.ReservedBytes() != checksumSize+cipherOverhead {
+		t.Errorf("Expected %d reserved bytes, got %d", checksumSize+cipherOverhead, p.ReservedBytes())
+	}
+	for i := uint32(1); i <= 10; i++ {
+		p.WritePage(i, testPage(p, byte(i)))
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	raw, _ := os.ReadFile(dbPath)
+	for i := range 10 {
+		if bytes.Contains(raw, bytes.Repeat([]byte{byte(i + 1)}, 64)) {
+			t.Errorf("Plaintext of page %d found in the database file", i+1)
+		}
+	}
+
+	p2, err := NewWithOptions(dbPath, Options{Key: testKey, CacheSize: 4})
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer p2.Close()
+	if p2.Header().Encryption != EncryptionAESGCM {
+		t.Error("Expected encryption to be recorded in the header")
+	}
+	expectPages(t, p2, 10, func(i uint32) byte { return byte(i) })
+}
+
+func TestEncryption_KeyErrors(t *testing.T) {
+	dir := t.TempDir()
+	encPath := filepath.Join(dir, "enc.db")
+	plainPath := filepath.Join(dir, "plain.db")
+
+	p, err := NewWithOptions(encPath, Options{Key: testKey})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	p.Close()
+	p, err = New(plainPath, 4)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	p.Close()
+
+	tests := []struct {
+		name string
+		path string
+		key  []byte
+		want error
+	}{
+		{"wrong key", encPath, otherKey, ErrWrongKey},
+		{"missing key", encPath, nil, ErrWrongKey},
+		{"key for plaintext database", plainPath, testKey, ErrNotEncrypted},
+		{"invalid key length", encPath, []byte("short"), ErrInvalidKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewWithOptions(tt.path, Options{Key: tt.key})
+			if err == nil {
+				p.Close()
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestEncryption_TamperedPage(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p, err := NewWithOptions(dbPath, Options{Key: testKey})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	p.WritePage(1, testPage(p, 1))
+	p.WritePage(2, testPage(p, 2))
+	pageSize := p.PageSize()
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// Swap pages 1 and 2 and fix up their checksums, so only the
+	// authentication tag can tell
+	raw, _ := os.ReadFile(dbPath)
+	page1 := bytes.Clone(raw[pageSize : 2*pageSize])
+	copy(raw[pageSize:], raw[2*pageSize:3*pageSize])
+	copy(raw[2*pageSize:], page1)
+	for _, pageNum := range []uint32{1, 2} {
+		img := raw[int(pageNum)*pageSize : int(pageNum+1)*pageSize]
+		binary.LittleEndian.PutUint32(img[pageSize-checksumSize:], pageChecksum(pageNum, img))
+	}
+	os.WriteFile(dbPath, raw, 0644)
+
+	p2, err := NewWithOptions(dbPath, Options{Key: testKey})
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer p2.Close()
+	if _, err := p2.ReadPage(1); !errors.Is(err, ErrCorruptPage) {
+		t.Errorf("Expected ErrCorruptPage, got %v", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	modes := []struct {
+		name        string
+		mode        JournalMode
+		compression Compression
+	}{
+		{"off", JournalModeOff, CompressionNone},
+		{"wal", JournalModeWAL, CompressionNone},
+		{"delete", JournalModeDelete, CompressionNone},
+		{"delete-flate", JournalModeDelete, CompressionFlate},
+	}
+
+	for _, tc := range modes {
+		t.Run(tc.name, func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "test.db")
+			opts := Options{Key: testKey, CacheSize: 4, JournalMode: tc.mode, Compression: tc.compression}
+			p, err := NewWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("Failed to create pager: %v", err)
+			}
+			for i := uint32(1); i <= 10; i++ {
+				p.WritePage(i, testPage(p, byte(i)))
+			}
+			if err := p.Rekey(otherKey); err != nil {
+				t.Fatalf("Failed to rekey: %v", err)
+			}
+			expectPages(t, p, 10, func(i uint32) byte { return byte(i) })
+			if err := p.Close(); err != nil {
+				t.Fatalf("Failed to close: %v", err)
+			}
+
+			if _, err := NewWithOptions(dbPath, opts); !errors.Is(err, ErrWrongKey) {
+				t.Errorf("Expected the old key to be rejected, got %v", err)
+			}
+			opts.Key = otherKey
+			p2, err := NewWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("Failed to reopen with the new key: %v", err)
+			}
+			defer p2.Close()
+			expectPages(t, p2, 10, func(i uint32) byte { return byte(i) })
+		})
+	}
+}
+
+func TestRekey_Errors(t *testing.T) {
+	dir := t.TempDir()
+
+	p, err := New(filepath.Join(dir, "plain.db"), 4)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	if err := p.Rekey(testKey); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Expected ErrNotEncrypted, got %v", err)
+	}
+	p.Close()
+
+	p, err = NewWithOptions(filepath.Join(dir, "enc.db"), Options{Key: testKey})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+	if err := p.Rekey([]byte("short")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey, got %v", err)
+	}
+
+	tx, err := p.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	if err := p.Rekey(otherKey); !errors.Is(err, ErrTxActive) {
+		t.Errorf("Expected ErrTxActive, got %v", err)
+	}
+	tx.Rollback()
+}
@@ -0,0 +1,127 @@
+package pager
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+)
+
+// maxWriteRun is the largest write, in bytes, that flushPages coalesces
+// adjacent pages into
+const maxWriteRun = 1 << 20
+
+// IOStats counts the page I/O a pager has issued
+// Reads of original pages for the rollback journal and writes to the journal
+// itself are not counted.
+type IOStats struct {
+	Reads        uint64 // Read operations issued for page images
+	PagesRead    uint64 // Page images read; more than Reads when prefetches coalesce
+	Writes       uint64 // Write operations issued for page images
+	PagesWritten uint64 // Page images written; more than Writes when flushes coalesce
+}
+
+// IOStats returns the page I/O issued since the pager was opened
+// Flush writes dirty pages in page number order and coalesces runs of
+// adjacent pages into a single write, so comparing the stats before and
+// after a Flush shows how many operations it took.
+func (p *Pager) IOStats() IOStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.io
+}
+
+// sortedDirty returns the dirty cached pages in page number order (must hold lock)
+func (p *Pager) sortedDirty() []*CacheEntry {
+	dirty := p.cache.GetAllDirty()
+	sortEntries(dirty)
+	return dirty
+}
+
+func sortEntries(entries []*CacheEntry) {
+	slices.SortFunc(entries, func(a, b *CacheEntry) int {
+		return cmp.Compare(a.PageNum, b.PageNum)
+	})
+}
+
+// flushPages writes pages sorted by page number to disk (must hold lock)
+// Runs of adjacent pages bound for the database file go out in one write;
+// pages for the write-ahead log or a compressed database are written one by
+// one.
+func (p *Pager) flushPages(entries []*CacheEntry) error {
+	if p.wal != nil || p.store != nil {
+		for _, entry := range entries {
+			if err := p.flushPageInternal(entry.PageNum, entry.Page); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	limit := max(1, maxWriteRun/p.pageSize)
+	for len(entries) > 0 {
+		n := 1
+		for n < len(entries) && n < limit && entries[n].PageNum == entries[n-1].PageNum+1 {
+			n++
+		}
+		if err := p.writeRun(entries[:n]); err != nil {
+			return err
+		}
+		entries = entries[n:]
+	}
+	return nil
+}
+
+// writeRun writes pages with consecutive numbers to the database file in a
+// single write (must hold lock)
+func (p *Pager) writeRun(run []*CacheEntry) error {
+	if len(run) == 1 {
+		return p.flushPageInternal(run[0].PageNum, run[0].Page)
+	}
+	first, last := run[0].PageNum, run[len(run)-1].PageNum
+
+	for _, entry := range run {
+		if p.tx != nil {
+			p.tx.written[entry.PageNum] = true
+		}
+		if p.journal != nil {
+			if err := p.journalOriginal(entry.PageNum); err != nil {
+				return err
+			}
+		}
+	}
+	if p.journal != nil {
+		if err := p.journal.sync(); err != nil {
+			return err
+		}
+	}
+	if err := p.acquireLock(LockExclusive); err != nil {
+		return err
+	}
+	if err := p.fillHoles(first); err != nil {
+		return err
+	}
+
+	size := len(run) * p.pageSize
+	if cap(p.runBuf) < size {
+		p.runBuf = make([]byte, size)
+	}
+	buf := p.runBuf[:size]
+	for i, entry := range run {
+		if !entry.Page.latch.TryRLock() {
+			return &latchedError{pageNum: entry.PageNum, page: entry.Page}
+		}
+		p.sealInto(entry.PageNum, entry.Page.Data, buf[i*p.pageSize:(i+1)*p.pageSize])
+		entry.Page.latch.RUnlock()
+	}
+
+	if _, err := p.file.WriteAt(buf, p.pageOffset(first)); err != nil {
+		return fmt.Errorf("failed to write pages %d-%d: %w", first, last, err)
+	}
+	p.spilled = true
+	p.io.Writes++
+	p.io.PagesWritten += uint64(len(run))
+	for _, entry := range run {
+		entry.Page.Dirty = false
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package pager
+
+import (
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"mash-db/pkg/vfs"
+)
+
+// writeLogFS records the writes made to the database file
+type writeLogFS struct {
+	vfs.FS
+	name string
+
+	mu     sync.Mutex
+	writes []writeRecord
+}
+
+type writeRecord struct {
+	off  int64
+	size int
+}
+
+type writeLogFile struct {
+	vfs.File
+	fs *writeLogFS
+}
+
+func (f *writeLogFS) Open(name string, flag vfs.OpenFlag) (vfs.File, error) {
+	file, err := f.FS.Open(name, flag)
+	if err != nil || name != f.name {
+		return file, err
+	}
+	return &writeLogFile{File: file, fs: f}, nil
+}
+
+func (f *writeLogFS) reset() []writeRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writes := f.writes
+	f.writes = nil
+	return writes
+}
+
+func (f *writeLogFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	f.fs.writes = append(f.fs.writes, writeRecord{off, len(p)})
+	f.fs.mu.Unlock()
+	return f.File.WriteAt(p, off)
+}
+
+func TestFlush_SortsAndCoalesces(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeOff, JournalModeDelete} {
+		fsys := &writeLogFS{FS: vfs.NewMemFS(), name: "test.db"}
+		p, err := NewWithOptions("test.db", Options{FS: fsys, JournalMode: mode, Key: testKey})
+		if err != nil {
+			t.Fatalf("Failed to create pager: %v", err)
+		}
+
+		// Three runs, written out of order: 20-22, 1-10 and 30
+		pages := []uint32{21, 5, 30, 1, 9, 2, 22, 3, 10, 4, 20, 6, 8, 7}
+		for _, pageNum := range pages {
+			p.WritePage(pageNum, testPage(p, byte(pageNum)))
+		}
+		fsys.reset()
+		before := p.IOStats()
+		if err := p.Flush(); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+		after := p.IOStats()
+
+		// Each run goes out in one write, as do the holes the file grows
+		// over in between, followed by the header
+		size := int64(p.PageSize())
+		want := []writeRecord{
+			{1 * size, 10 * int(size)},
+			{11 * size, 9 * int(size)},
+			{20 * size, 3 * int(size)},
+			{23 * size, 7 * int(size)},
+			{30 * size, int(size)},
+			{0, int(size)},
+		}
+		if got := fsys.reset(); !slices.Equal(got, want) {
+			t.Errorf("Mode %d: expected writes %v, got %v", mode, want, got)
+		}
+		if n := after.Writes - before.Writes; n != 6 {
+			t.Errorf("Mode %d: expected 6 writes, got %d", mode, n)
+		}
+		if n := after.PagesWritten - before.PagesWritten; n != 31 {
+			t.Errorf("Mode %d: expected 31 pages written, got %d", mode, n)
+		}
+
+		if err := p.Close(); err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+		p, err = NewWithOptions("test.db", Options{FS: fsys, Key: testKey})
+		if err != nil {
+			t.Fatalf("Failed to reopen: %v", err)
+		}
+		for _, pageNum := range pages {
+			page, err := p.ReadPage(pageNum)
+			if err != nil {
+				t.Fatalf("Failed to read page %d: %v", pageNum, err)
+			}
+			if page.Data[0] != byte(pageNum) {
+				t.Errorf("Page %d: expected %d, got %d", pageNum, pageNum, page.Data[0])
+			}
+			p.UnpinPage(pageNum, false)
+		}
+		p.Close()
+	}
+}
+
+func TestFlush_RunLimit(t *testing.T) {
+	p, err := NewWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{CacheSize: 400})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	limit := maxWriteRun / p.PageSize()
+	for i := uint32(1); i <= uint32(limit+10); i++ {
+		p.WritePage(i, testPage(p, byte(i)))
+	}
+	before := p.IOStats()
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	// Two writes for the pages, one for the header
+	if n := p.IOStats().Writes - before.Writes; n != 3 {
+		t.Errorf("Expected 3 writes, got %d", n)
+	}
+	expectPages(t, p, uint32(limit+10), func(i uint32) byte { return byte(i) })
+}
@@ -0,0 +1,266 @@
+package pager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"mash-db/internal/common"
+)
+
+// Freelist layout
+//
+// Free pages are tracked in a linked list of trunk pages starting at
+// Header.FreelistHead. Each trunk page stores the next trunk page number,
+// the number of leaf entries it holds, and the leaf page numbers themselves:
+//
+//	[0:4]  next trunk page (0 terminates the list)
+//	[4:8]  leaf count
+//	[8:]   leaf page numbers, 4 bytes each
+//
+// Leaf pages carry no data of their own. When a trunk has no leaves left,
+// the trunk page itself is handed out and the list advances to the next trunk.
+const (
+	trunkNextOffset  = 0
+	trunkCountOffset = 4
+	trunkLeafOffset  = 8
+)
+
+var (
+	ErrPagePinned = errors.New("page is pinned")
+	ErrPageFree   = errors.New("page is already free")
+)
+
+// trunkCapacity returns how many leaf entries fit on a single trunk page
+func (p *Pager) trunkCapacity() uint32 {
+	return uint32(p.UsableSize()-trunkLeafOffset) / 4
+}
+
+// AllocatePage returns a page number for new data
+// Pages on the freelist are reused before the file is grown. A reused page
+// is handed back zeroed, exactly like a freshly appended one.
+func (p *Pager) AllocatePage() (uint32, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed.Load() {
+		return 0, ErrFileClosed
+	}
+
+	if err := p.lockReserved(); err != nil {
+		return 0, err
+	}
+	defer p.releaseLock()
+	p.dirty = true
+
+	if p.header.FreelistHead == 0 {
+		if p.numPages.Load() >= common.MaxPages {
+			return 0, ErrPageOutOfBounds
+		}
+		pageNum := p.numPages.Load()
+		p.numPages.Add(1)
+		if err := p.zeroStale(pageNum, pageNum+1); err != nil {
+			return 0, err
+		}
+		return pageNum, nil
+	}
+
+	pageNum, err := p.popFreelist()
+	if err != nil {
+		return 0, err
+	}
+
+	zero := make([]byte, p.pageSize)
+	if err := p.writePageInternal(pageNum, zero); err != nil {
+		return 0, err
+	}
+	return pageNum, nil
+}
+
+// popFreelist removes one page from the freelist (must hold lock)
+func (p *Pager) popFreelist() (uint32, error) {
+	trunkNum := p.header.FreelistHead
+	trunk, err := p.readPageInternal(trunkNum)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read freelist trunk %d: %w", trunkNum, err)
+	}
+	defer p.unpinPageInternal(trunkNum, false)
+
+	count := binary.LittleEndian.Uint32(trunk.Data[trunkCountOffset:])
+	if count > p.trunkCapacity() {
+		return 0, fmt.Errorf("%w: corrupt freelist trunk %d", ErrNotADatabase, trunkNum)
+	}
+
+	// Take the last leaf so the trunk only needs its count updated, or the
+	// trunk page itself once it is empty
+	pageNum := trunkNum
+	if count > 0 {
+		pageNum = binary.LittleEndian.Uint32(trunk.Data[trunkLeafOffset+4*(count-1):])
+	}
+	if pageNum == common.HeaderPageNum || pageNum >= p.numPages.Load() {
+		return 0, fmt.Errorf("%w: freelist references page %d", ErrNotADatabase, pageNum)
+	}
+
+	if count > 0 {
+		data := slices.Clone(trunk.Data)
+		binary.LittleEndian.PutUint32(data[trunkCountOffset:], count-1)
+		if err := p.writePageInternal(trunkNum, data); err != nil {
+			return 0, err
+		}
+	} else {
+		p.header.FreelistHead = binary.LittleEndian.Uint32(trunk.Data[trunkNextOffset:])
+	}
+	p.header.FreelistCount--
+	delete(p.free, pageNum)
+	return pageNum, nil
+}
+
+// FreePage returns a page to the freelist so AllocatePage can reuse it
+// The page must not be pinned or free already. Its contents are discarded.
+func (p *Pager) FreePage(pageNum uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed.Load() {
+		return ErrFileClosed
+	}
+
+	if pageNum == common.HeaderPageNum {
+		return ErrReservedPage
+	}
+
+	if err := p.lockReserved(); err != nil {
+		return err
+	}
+	defer p.releaseLock()
+
+	if pageNum >= p.numPages.Load() {
+		return ErrPageOutOfBounds
+	}
+
+	if p.cache.Pinned(pageNum) {
+		return ErrPagePinned
+	}
+
+	// Freeing a page twice would hand it out twice
+	free, err := p.freeSet()
+	if err != nil {
+		return err
+	}
+	if free[pageNum] {
+		return ErrPageFree
+	}
+	return p.freePageInternal(pageNum)
+}
+
+// freePageInternal adds an unpinned page to the freelist (must hold lock)
+func (p *Pager) freePageInternal(pageNum uint32) error {
+	p.dirty = true
+
+	if head := p.header.FreelistHead; head != 0 {
+		trunk, err := p.readPageInternal(head)
+		if err != nil {
+			return fmt.Errorf("failed to read freelist trunk %d: %w", head, err)
+		}
+		count := binary.LittleEndian.Uint32(trunk.Data[trunkCountOffset:])
+		if count < p.trunkCapacity() {
+			data := slices.Clone(trunk.Data)
+			binary.LittleEndian.PutUint32(data[trunkLeafOffset+4*count:], pageNum)
+			binary.LittleEndian.PutUint32(data[trunkCountOffset:], count+1)
+			err := p.writePageInternal(head, data)
+			p.unpinPageInternal(head, false)
+			if err != nil {
+				return err
+			}
+
+			// A leaf's contents are never read again, so don't bother writing them
+			p.cache.Remove(pageNum)
+			p.header.FreelistCount++
+			p.markFree(pageNum)
+			return nil
+		}
+		p.unpinPageInternal(head, false)
+	}
+
+	// No trunk or the head trunk is full: the freed page becomes the new head
+	trunk := make([]byte, p.pageSize)
+	binary.LittleEndian.PutUint32(trunk[trunkNextOffset:], p.header.FreelistHead)
+	if err := p.writePageInternal(pageNum, trunk); err != nil {
+		return err
+	}
+	p.header.FreelistHead = pageNum
+	p.header.FreelistCount++
+	p.markFree(pageNum)
+	return nil
+}
+
+// markFree adds a page to the free set, if it has been read (must hold lock)
+func (p *Pager) markFree(pageNum uint32) {
+	if p.free != nil {
+		p.free[pageNum] = true
+	}
+}
+
+// freeSet returns the pages on the freelist as a set (must hold lock)
+// The freelist is read once after the header loads; pushes and pops keep
+// the set up to date from then on.
+func (p *Pager) freeSet() (map[uint32]bool, error) {
+	if p.free != nil {
+		return p.free, nil
+	}
+	pages, err := p.freelistPages()
+	if err != nil {
+		return nil, err
+	}
+	p.free = make(map[uint32]bool, len(pages))
+	for _, pageNum := range pages {
+		p.free[pageNum] = true
+	}
+	return p.free, nil
+}
+
+// FreelistCount returns the number of pages on the freelist
+// These pages are reclaimable space inside the database file.
+func (p *Pager) FreelistCount() uint32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refresh()
+	return p.header.FreelistCount
+}
+
+// freelistPages returns every page on the freelist, trunks included (must
+// hold lock)
+func (p *Pager) freelistPages() ([]uint32, error) {
+	var pages []uint32
+	for trunkNum := p.header.FreelistHead; trunkNum != 0; {
+		if trunkNum >= p.numPages.Load() || uint32(len(pages)) >= p.header.FreelistCount {
+			return nil, fmt.Errorf("%w: corrupt freelist at trunk %d", ErrNotADatabase, trunkNum)
+		}
+		trunk, err := p.readPageInternal(trunkNum)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read freelist trunk %d: %w", trunkNum, err)
+		}
+		count := binary.LittleEndian.Uint32(trunk.Data[trunkCountOffset:])
+		next := binary.LittleEndian.Uint32(trunk.Data[trunkNextOffset:])
+		if count > p.trunkCapacity() {
+			p.unpinPageInternal(trunkNum, false)
+			return nil, fmt.Errorf("%w: corrupt freelist trunk %d", ErrNotADatabase, trunkNum)
+		}
+		pages = append(pages, trunkNum)
+		for i := range count {
+			pages = append(pages, binary.LittleEndian.Uint32(trunk.Data[trunkLeafOffset+4*i:]))
+		}
+		p.unpinPageInternal(trunkNum, false)
+		for _, leaf := range pages[len(pages)-int(count):] {
+			if leaf == common.HeaderPageNum || leaf >= p.numPages.Load() {
+				return nil, fmt.Errorf("%w: freelist references page %d", ErrNotADatabase, leaf)
+			}
+		}
+		trunkNum = next
+	}
+	if uint32(len(pages)) != p.header.FreelistCount {
+		return nil, fmt.Errorf("%w: freelist holds %d pages, header says %d", ErrNotADatabase, len(pages), p.header.FreelistCount)
+	}
+	return pages, nil
+}
@@ -0,0 +1,266 @@
+package pager
+
+import (
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"mash-db/internal/common"
+)
+
+func TestFreelist_ReuseFreedPages(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := p.AllocatePage(); err != nil {
+			t.Fatalf("Failed to allocate page: %v", err)
+		}
+	}
+
+	if err := p.FreePage(2); err != nil {
+		t.Fatalf("Failed to free page 2: %v", err)
+	}
+	if err := p.FreePage(4); err != nil {
+		t.Fatalf("Failed to free page 4: %v", err)
+	}
+
+	if p.FreelistCount() != 2 {
+		t.Errorf("Expected 2 free pages, got %d", p.FreelistCount())
+	}
+
+	numPages := p.NumPages()
+	got := map[uint32]bool{}
+	for i := 0; i < 2; i++ {
+		pageNum, err := p.AllocatePage()
+		if err != nil {
+			t.Fatalf("Failed to allocate page: %v", err)
+		}
+		got[pageNum] = true
+	}
+
+	if !got[2] || !got[4] {
+		t.Errorf("Expected pages 2 and 4 to be reused, got %v", got)
+	}
+	if p.NumPages() != numPages {
+		t.Errorf("File should not grow while freelist has pages: %d -> %d", numPages, p.NumPages())
+	}
+	if p.FreelistCount() != 0 {
+		t.Errorf("Expected empty freelist, got %d", p.FreelistCount())
+	}
+
+	// Freelist exhausted, next allocation appends
+	pageNum, err := p.AllocatePage()
+	if err != nil {
+		t.Fatalf("Failed to allocate page: %v", err)
+	}
+	if pageNum != numPages {
+		t.Errorf("Expected page %d, got %d", numPages, pageNum)
+	}
+}
+
+func TestFreelist_ReusedPageIsZeroed(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	data := make([]byte, common.PageSize)
+	for i := range data {
+		data[i] = 0xAB
+	}
+	for i := uint32(1); i <= 2; i++ {
+		if err := p.WritePage(i, data); err != nil {
+			t.Fatalf("Failed to write page %d: %v", i, err)
+		}
+	}
+	p.Flush()
+
+	// Page 1 becomes a trunk, page 2 a leaf
+	p.FreePage(1)
+	p.FreePage(2)
+
+	for i := 0; i < 2; i++ {
+		pageNum, err := p.AllocatePage()
+		if err != nil {
+			t.Fatalf("Failed to allocate page: %v", err)
+		}
+		page, err := p.ReadPage(pageNum)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", pageNum, err)
+		}
+		for j, b := range page.Data {
+			if b != 0 {
+				t.Fatalf("Page %d byte %d not zeroed: %x", pageNum, j, b)
+			}
+		}
+		p.UnpinPage(pageNum, false)
+	}
+}
+
+func TestFreelist_SurvivesReopen(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := New(dbPath, 4)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+
+	// Free enough pages to spill over more than one trunk
+	total := p.trunkCapacity() + 10
+	for i := uint32(0); i < total; i++ {
+		if _, err := p.AllocatePage(); err != nil {
+			t.Fatalf("Failed to allocate page: %v", err)
+		}
+	}
+	for i := uint32(1); i <= total; i++ {
+		if err := p.FreePage(i); err != nil {
+			t.Fatalf("Failed to free page %d: %v", i, err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	p2, err := New(dbPath, 4)
+	if err != nil {
+		t.Fatalf("Failed to reopen pager: %v", err)
+	}
+	defer p2.Close()
+
+	if p2.FreelistCount() != total {
+		t.Fatalf("Expected %d free pages after reopen, got %d", total, p2.FreelistCount())
+	}
+
+	seen := map[uint32]bool{}
+	for i := uint32(0); i < total; i++ {
+		pageNum, err := p2.AllocatePage()
+		if err != nil {
+			t.Fatalf("Failed to allocate page: %v", err)
+		}
+		if pageNum == common.HeaderPageNum || pageNum > total {
+			t.Fatalf("Allocated unexpected page %d", pageNum)
+		}
+		if seen[pageNum] {
+			t.Fatalf("Page %d allocated twice", pageNum)
+		}
+		seen[pageNum] = true
+	}
+	if p2.NumPages() != total+1 {
+		t.Errorf("Expected %d pages, got %d", total+1, p2.NumPages())
+	}
+}
+
+func TestFreelist_FreePageErrors(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	if err := p.FreePage(common.HeaderPageNum); err != ErrReservedPage {
+		t.Errorf("Expected ErrReservedPage, got %v", err)
+	}
+	if err := p.FreePage(5); err != ErrPageOutOfBounds {
+		t.Errorf("Expected ErrPageOutOfBounds, got %v", err)
+	}
+
+	pageNum, _ := p.AllocatePage()
+	if _, err := p.ReadPage(pageNum); err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	if err := p.FreePage(pageNum); err != ErrPagePinned {
+		t.Errorf("Expected ErrPagePinned, got %v", err)
+	}
+	p.UnpinPage(pageNum, false)
+
+	// A second free of a leaf or a trunk changes nothing
+	leaf, _ := p.AllocatePage()
+	if err := p.FreePage(pageNum); err != nil {
+		t.Fatalf("Failed to free page: %v", err)
+	}
+	if err := p.FreePage(leaf); err != nil {
+		t.Fatalf("Failed to free page: %v", err)
+	}
+	for _, pageNum := range []uint32{pageNum, leaf} {
+		if err := p.FreePage(pageNum); err != ErrPageFree {
+			t.Errorf("Page %d: expected ErrPageFree, got %v", pageNum, err)
+		}
+	}
+	if p.FreelistCount() != 2 {
+		t.Errorf("Expected 2 free pages, got %d", p.FreelistCount())
+	}
+
+	// A rolled back allocation leaves the page free
+	tx, err := p.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	reused, err := p.AllocatePage()
+	if err != nil {
+		t.Fatalf("Failed to allocate: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	if err := p.FreePage(reused); err != ErrPageFree {
+		t.Errorf("Page %d: expected ErrPageFree after rollback, got %v", reused, err)
+	}
+}
+
+func TestFreelist_CorruptLeafLeavesTrunk(t *testing.T) {
+	p, err := New(MemoryPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	for range 5 {
+		if _, err := p.AllocatePage(); err != nil {
+			t.Fatalf("Failed to allocate page: %v", err)
+		}
+	}
+	// Page 2 becomes the trunk and page 4 its leaf, which then points past
+	// the end of the file
+	for _, pageNum := range []uint32{2, 4} {
+		if err := p.FreePage(pageNum); err != nil {
+			t.Fatalf("Failed to free page %d: %v", pageNum, err)
+		}
+	}
+	trunk := make([]byte, p.PageSize())
+	binary.LittleEndian.PutUint32(trunk[trunkCountOffset:], 1)
+	binary.LittleEndian.PutUint32(trunk[trunkLeafOffset:], 999)
+	if err := p.WritePage(2, trunk); err != nil {
+		t.Fatalf("Failed to write page: %v", err)
+	}
+
+	if _, err := p.AllocatePage(); !errors.Is(err, ErrNotADatabase) {
+		t.Fatalf("Expected ErrNotADatabase, got %v", err)
+	}
+	page, err := p.ReadPage(2)
+	if err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	if n := binary.LittleEndian.Uint32(page.Data[trunkCountOffset:]); n != 1 {
+		t.Errorf("Expected the trunk to keep its leaf, got %d leaves", n)
+	}
+	p.UnpinPage(2, false)
+	if p.FreelistCount() != 2 {
+		t.Errorf("Expected 2 free pages, got %d", p.FreelistCount())
+	}
+}
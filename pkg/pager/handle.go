@@ -0,0 +1,114 @@
+package pager
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// ErrLeakedPins is returned by Close in debug mode when page handles were
+// never released
+var ErrLeakedPins = errors.New("page handles were not released")
+
+// PageHandle is a pinned page
+// A handle keeps its page in the cache until Release is called, which also
+// records whether the page was changed. It replaces the UnpinPage protocol,
+// where the caller has to remember both the page number and the dirty flag.
+// A handle is meant for one goroutine at a time.
+type PageHandle struct {
+	p        *Pager
+	pageNum  uint32
+	page     *Page
+	dirty    bool
+	latched  latchMode
+	released bool
+	stack    []byte // Where the handle was acquired, in debug mode
+}
+
+// Acquire reads a page like ReadPage and returns a handle to it
+// The handle must be released once the caller is done with the page.
+func (p *Pager) Acquire(pageNum uint32) (*PageHandle, error) {
+	page, err := p.ReadPage(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	return p.newHandle(pageNum, page), nil
+}
+
+// AcquireForWrite returns a handle to a page for modification, like GetPage
+// The RESERVED lock it takes is held until the changes are flushed.
+func (p *Pager) AcquireForWrite(pageNum uint32) (*PageHandle, error) {
+	page, err := p.GetPage(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	return p.newHandle(pageNum, page), nil
+}
+
+// newHandle wraps a page the caller has pinned
+func (p *Pager) newHandle(pageNum uint32, page *Page) *PageHandle {
+	h := &PageHandle{p: p, pageNum: pageNum, page: page}
+	if p.handles != nil {
+		h.stack = debug.Stack()
+		p.mu.Lock()
+		p.handles[h] = struct{}{}
+		p.mu.Unlock()
+	}
+	return h
+}
+
+// PageNum returns the number of the page
+func (h *PageHandle) PageNum() uint32 {
+	return h.pageNum
+}
+
+// Bytes returns the part of the page available to callers, which may be
+// modified in place until the handle is released
+// It returns nil once the handle is released.
+func (h *PageHandle) Bytes() []byte {
+	if h.released {
+		return nil
+	}
+	return h.page.Data[:h.p.usable]
+}
+
+// MarkDirty records that the page was modified, so it is written out after
+// the handle is released
+func (h *PageHandle) MarkDirty() {
+	h.dirty = true
+}
+
+// Release unlatches and unpins the page, marking it dirty if MarkDirty was
+// called
+// Releasing a handle again, or after the pager is closed, does nothing.
+func (h *PageHandle) Release() {
+	if h.released {
+		return
+	}
+	h.Unlatch()
+	h.released = true
+
+	p := h.p
+	if p.handles != nil {
+		p.mu.Lock()
+		delete(p.handles, h)
+		p.mu.Unlock()
+	}
+	if !p.closed.Load() {
+		p.UnpinPage(h.pageNum, h.dirty)
+	}
+}
+
+// leakedPins describes the handles that were never released (must hold lock)
+func (p *Pager) leakedPins() error {
+	if len(p.handles) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d still held", len(p.handles))
+	for h := range p.handles {
+		fmt.Fprintf(&b, "\n\npage %d acquired at:\n%s", h.pageNum, h.stack)
+	}
+	return fmt.Errorf("%w: %s", ErrLeakedPins, b.String())
+}
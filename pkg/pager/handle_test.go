@@ -0,0 +1,116 @@
+package pager
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPageHandle_RoundTrip(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+
+	h, err := p.AcquireForWrite(1)
+	if err != nil {
+		t.Fatalf("Failed to acquire page: %v", err)
+	}
+	if h.PageNum() != 1 {
+		t.Errorf("Expected page 1, got %d", h.PageNum())
+	}
+	if len(h.Bytes()) != p.UsableSize() {
+		t.Errorf("Expected %d usable bytes, got %d", p.UsableSize(), len(h.Bytes()))
+	}
+	copy(h.Bytes(), "hello")
+	h.MarkDirty()
+	h.Release()
+	h.Release()
+
+	if p.pinned.Load() != 0 {
+		t.Errorf("Expected no pins after release, got %d", p.pinned.Load())
+	}
+	if h.Bytes() != nil {
+		t.Error("Expected a released handle to give no bytes")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	p2, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer p2.Close()
+	h, err = p2.Acquire(1)
+	if err != nil {
+		t.Fatalf("Failed to acquire page: %v", err)
+	}
+	defer h.Release()
+	if got := string(h.Bytes()[:5]); got != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", got)
+	}
+}
+
+func TestPageHandle_NotDirtyUnlessMarked(t *testing.T) {
+	p, err := New(MemoryPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	h, err := p.Acquire(1)
+	if err != nil {
+		t.Fatalf("Failed to acquire page: %v", err)
+	}
+	h.Release()
+	if page := p.cache.Peek(1); page == nil || page.Dirty {
+		t.Error("Expected the page to be cached and clean")
+	}
+}
+
+func TestPageHandle_LeakDetection(t *testing.T) {
+	p, err := NewWithOptions(MemoryPath, Options{Debug: true})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+
+	released, err := p.Acquire(1)
+	if err != nil {
+		t.Fatalf("Failed to acquire page: %v", err)
+	}
+	released.Release()
+	if _, err := p.Acquire(2); err != nil {
+		t.Fatalf("Failed to acquire page: %v", err)
+	}
+
+	err = p.Close()
+	if !errors.Is(err, ErrLeakedPins) {
+		t.Fatalf("Expected ErrLeakedPins, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "page 2 acquired at") ||
+		!strings.Contains(err.Error(), "TestPageHandle_LeakDetection") {
+		t.Errorf("Expected the leak report to name page 2 and where it was acquired, got %v", err)
+	}
+	if strings.Contains(err.Error(), "page 1 ") {
+		t.Errorf("Released handle was reported as leaked: %v", err)
+	}
+	if _, err := p.ReadPage(1); !errors.Is(err, ErrFileClosed) {
+		t.Errorf("Expected the pager to be closed, got %v", err)
+	}
+}
+
+func TestPageHandle_NoLeakReportWithoutDebug(t *testing.T) {
+	p, err := New(MemoryPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	if _, err := p.Acquire(1); err != nil {
+		t.Fatalf("Failed to acquire page: %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("Expected Close to succeed, got %v", err)
+	}
+}
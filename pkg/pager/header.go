@@ -0,0 +1,185 @@
+package pager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"mash-db/internal/common"
+)
+
+const (
+	// FormatVersion is the on-disk format version written by this package
+	FormatVersion = 1
+
+	// headerSize is the number of bytes at the start of page 0 used by the header
+	// The rest of the header page is reserved and kept zeroed
+	headerSize = 100
+)
+
+// headerMagic identifies a MashDB database file
+var headerMagic = [16]byte{'M', 'a', 's', 'h', 'D', 'B', ' ', 'd', 'a', 't', 'a', 'b', 'a', 's', 'e', 0}
+
+// Header field offsets within page 0
+const (
+	offMagic         = 0
+	offVersion       = 16
+	offPageSize      = 20
+	offPageCount     = 24
+	offFreelistHead  = 28
+	offSchemaCookie  = 32
+	offFreelistCount = 36
+	offReservedBytes = 40
+	offChangeCounter = 44
+	offCompression   = 48
+	offPageMapSlot   = 52
+	offPageMapSlots  = 56
+	offPageMapCRC    = 60
+	offEncryption    = 64
+	offKeyCheck      = 68
+	offPageEpochs    = 84
+)
+
+var (
+	ErrNotADatabase        = errors.New("file is not a MashDB database")
+	ErrUnsupportedVersion  = errors.New("unsupported database format version")
+	ErrUnsupportedPageSize = errors.New("unsupported page size")
+	ErrReservedPage        = errors.New("page is reserved for the database header")
+	ErrUnsupportedCodec    = errors.New("unsupported page compression")
+	ErrUnsupportedCipher   = errors.New("unsupported page encryption")
+)
+
+// Header is the in-memory form of the database header stored on page 0
+type Header struct {
+	Version       uint32
+	PageSize      uint32
+	PageCount     uint32 // Total pages in the database, including the header page
+	FreelistHead  uint32 // First freelist trunk page, 0 if the freelist is empty
+	SchemaCookie  uint32 // Bumped by higher layers whenever the schema changes
+	FreelistCount uint32 // Total pages on the freelist, trunks included
+	ReservedBytes uint32 // Bytes at the end of every page owned by the pager
+	ChangeCounter uint32 // Incremented by every commit, so other processes can spot stale caches
+
+	// Compressed databases only
+	Compression  Compression // Codec pages are stored with
+	PageMapSlot  uint32      // First slot of the page map record, 0 if no page is stored yet
+	PageMapSlots uint32      // Slots taken by the page map record
+	PageMapCRC   uint32      // Checksum of the uncompressed page map
+
+	// Encrypted databases only
+	Encryption Encryption         // Cipher pages are encrypted with
+	KeyCheck   [keyCheckSize]byte // Identifies the key without revealing it
+
+	PageEpochs bool // Every page records the commit that last wrote it
+}
+
+// newHeader returns the header for a freshly created database
+func newHeader(pageSize int) Header {
+	return Header{
+		Version:       FormatVersion,
+		PageSize:      uint32(pageSize),
+		PageCount:     1,
+		ReservedBytes: checksumSize,
+	}
+}
+
+// encode writes the header into buf, which must be at least headerSize bytes
+func (h *Header) encode(buf []byte) {
+	copy(buf[offMagic:], headerMagic[:])
+	binary.LittleEndian.PutUint32(buf[offVersion:], h.Version)
+	binary.LittleEndian.PutUint32(buf[offPageSize:], h.PageSize)
+	binary.LittleEndian.PutUint32(buf[offPageCount:], h.PageCount)
+	binary.LittleEndian.PutUint32(buf[offFreelistHead:], h.FreelistHead)
+	binary.LittleEndian.PutUint32(buf[offSchemaCookie:], h.SchemaCookie)
+	binary.LittleEndian.PutUint32(buf[offFreelistCount:], h.FreelistCount)
+	binary.LittleEndian.PutUint32(buf[offReservedBytes:], h.ReservedBytes)
+	binary.LittleEndian.PutUint32(buf[offChangeCounter:], h.ChangeCounter)
+	binary.LittleEndian.PutUint32(buf[offCompression:], uint32(h.Compression))
+	binary.LittleEndian.PutUint32(buf[offPageMapSlot:], h.PageMapSlot)
+	binary.LittleEndian.PutUint32(buf[offPageMapSlots:], h.PageMapSlots)
+	binary.LittleEndian.PutUint32(buf[offPageMapCRC:], h.PageMapCRC)
+	binary.LittleEndian.PutUint32(buf[offEncryption:], uint32(h.Encryption))
+	copy(buf[offKeyCheck:], h.KeyCheck[:])
+	var epochs uint32
+	if h.PageEpochs {
+		epochs = 1
+	}
+	binary.LittleEndian.PutUint32(buf[offPageEpochs:], epochs)
+}
+
+// decodeHeader parses and validates a header from buf
+func decodeHeader(buf []byte) (Header, error) {
+	var h Header
+	if len(buf) < headerSize {
+		return h, ErrNotADatabase
+	}
+	if [16]byte(buf[offMagic:offMagic+16]) != headerMagic {
+		return h, ErrNotADatabase
+	}
+
+	h.Version = binary.LittleEndian.Uint32(buf[offVersion:])
+	h.PageSize = binary.LittleEndian.Uint32(buf[offPageSize:])
+	h.PageCount = binary.LittleEndian.Uint32(buf[offPageCount:])
+	h.FreelistHead = binary.LittleEndian.Uint32(buf[offFreelistHead:])
+	h.SchemaCookie = binary.LittleEndian.Uint32(buf[offSchemaCookie:])
+	h.FreelistCount = binary.LittleEndian.Uint32(buf[offFreelistCount:])
+	h.ReservedBytes = binary.LittleEndian.Uint32(buf[offReservedBytes:])
+	h.ChangeCounter = binary.LittleEndian.Uint32(buf[offChangeCounter:])
+	h.Compression = Compression(binary.LittleEndian.Uint32(buf[offCompression:]))
+	h.PageMapSlot = binary.LittleEndian.Uint32(buf[offPageMapSlot:])
+	h.PageMapSlots = binary.LittleEndian.Uint32(buf[offPageMapSlots:])
+	h.PageMapCRC = binary.LittleEndian.Uint32(buf[offPageMapCRC:])
+	h.Encryption = Encryption(binary.LittleEndian.Uint32(buf[offEncryption:]))
+	h.KeyCheck = [keyCheckSize]byte(buf[offKeyCheck : offKeyCheck+keyCheckSize])
+	epochs := binary.LittleEndian.Uint32(buf[offPageEpochs:])
+	h.PageEpochs = epochs == 1
+
+	if h.Version != FormatVersion {
+		return h, fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.Version)
+	}
+	if !validPageSize(int(h.PageSize)) {
+		return h, fmt.Errorf("%w: %d", ErrUnsupportedPageSize, h.PageSize)
+	}
+	if h.ReservedBytes < checksumSize || h.ReservedBytes > h.PageSize/2 {
+		return h, fmt.Errorf("%w: invalid reserved bytes %d", ErrNotADatabase, h.ReservedBytes)
+	}
+	if h.Compression > CompressionFlate {
+		return h, fmt.Errorf("%w: %d", ErrUnsupportedCodec, h.Compression)
+	}
+	if h.Encryption > EncryptionAESGCM {
+		return h, fmt.Errorf("%w: %d", ErrUnsupportedCipher, h.Encryption)
+	}
+	if epochs > 1 {
+		return h, fmt.Errorf("%w: invalid page epochs flag %d", ErrNotADatabase, epochs)
+	}
+	if h.ReservedBytes < h.minReserved() {
+		return h, fmt.Errorf("%w: invalid reserved bytes %d", ErrNotADatabase, h.ReservedBytes)
+	}
+	if h.PageCount == 0 || h.PageCount > common.MaxPages {
+		return h, fmt.Errorf("%w: invalid page count %d", ErrNotADatabase, h.PageCount)
+	}
+	if h.FreelistHead >= h.PageCount {
+		return h, fmt.Errorf("%w: invalid freelist head %d", ErrNotADatabase, h.FreelistHead)
+	}
+	if (h.FreelistHead == 0) != (h.FreelistCount == 0) || h.FreelistCount >= h.PageCount {
+		return h, fmt.Errorf("%w: invalid freelist count %d", ErrNotADatabase, h.FreelistCount)
+	}
+	return h, nil
+}
+
+// minReserved returns the bytes the pager needs at the end of every page
+func (h *Header) minReserved() uint32 {
+	n := uint32(checksumSize)
+	if h.Encryption != EncryptionNone {
+		n += cipherOverhead
+	}
+	if h.PageEpochs {
+		n += epochSize
+	}
+	return n
+}
+
+// validPageSize reports whether size is a power of two within the supported range
+func validPageSize(size int) bool {
+	return size >= common.MinPageSize && size <= common.MaxPageSize && size&(size-1) == 0
+}
@@ -0,0 +1,136 @@
+package pager
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mash-db/internal/common"
+)
+
+func TestHeader_NewFileInitialised(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	p.Close()
+
+	raw, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if len(raw) != common.PageSize {
+		t.Fatalf("Expected file size %d, got %d", common.PageSize, len(raw))
+	}
+
+	h, err := decodeHeader(raw)
+	if err != nil {
+		t.Fatalf("Failed to decode header: %v", err)
+	}
+	if h.Version != FormatVersion {
+		t.Errorf("Expected version %d, got %d", FormatVersion, h.Version)
+	}
+	if h.PageSize != common.PageSize {
+		t.Errorf("Expected page size %d, got %d", common.PageSize, h.PageSize)
+	}
+	if h.PageCount != 1 {
+		t.Errorf("Expected page count 1, got %d", h.PageCount)
+	}
+}
+
+func TestHeader_RejectsForeignFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "notes.txt")
+
+	original := []byte("these are not the pages you are looking for")
+	if err := os.WriteFile(dbPath, original, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	_, err := New(dbPath, 10)
+	if !errors.Is(err, ErrNotADatabase) {
+		t.Fatalf("Expected ErrNotADatabase, got %v", err)
+	}
+
+	// The file must be left untouched
+	raw, _ := os.ReadFile(dbPath)
+	if string(raw) != string(original) {
+		t.Error("Foreign file was modified")
+	}
+}
+
+func TestHeader_RejectsUnsupportedVersion(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	p.Close()
+
+	raw, _ := os.ReadFile(dbPath)
+	binary.LittleEndian.PutUint32(raw[offVersion:], FormatVersion+1)
+	os.WriteFile(dbPath, raw, 0644)
+
+	_, err = New(dbPath, 10)
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestHeader_ReservedPage(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	if _, err := p.ReadPage(common.HeaderPageNum); err != ErrReservedPage {
+		t.Errorf("Expected ErrReservedPage on read, got %v", err)
+	}
+
+	data := make([]byte, common.PageSize)
+	if err := p.WritePage(common.HeaderPageNum, data); err != ErrReservedPage {
+		t.Errorf("Expected ErrReservedPage on write, got %v", err)
+	}
+}
+
+func TestHeader_Persistence(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := p.AllocatePage(); err != nil {
+			t.Fatalf("Failed to allocate page: %v", err)
+		}
+	}
+	p.SetSchemaCookie(42)
+	p.Close()
+
+	p2, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen pager: %v", err)
+	}
+	defer p2.Close()
+
+	// Allocated pages were never written, so only the header records them
+	if p2.NumPages() != 3 {
+		t.Errorf("Expected 3 pages, got %d", p2.NumPages())
+	}
+	if p2.SchemaCookie() != 42 {
+		t.Errorf("Expected schema cookie 42, got %d", p2.SchemaCookie())
+	}
+}
@@ -0,0 +1,271 @@
+package pager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+
+	"mash-db/pkg/vfs"
+)
+
+// Rollback journal layout
+//
+// In the rollback journal modes the original image of every page is copied
+// into "<path>-journal" and synced before the page is first overwritten in
+// the database file. The journal starts with a fixed header followed by one
+// record per page:
+//
+//	header: magic, version, page size, nonce, original file size, checksum
+//	record: page number, checksum, original page image
+//
+// Record checksums are seeded with the nonce, so records left over from an
+// earlier journal are never replayed. A journal with a valid header found on
+// open is "hot": the previous session crashed mid-commit, and its records are
+// written back to restore the database to its last committed state.
+const (
+	journalMagic   = 0x4d4a4e31 // "MJN1"
+	journalVersion = 1
+
+	journalHeaderSize       = 32
+	journalRecordHeaderSize = 8
+)
+
+var ErrCorruptJournal = errors.New("corrupt rollback journal")
+
+// journalPath returns the path of the rollback journal for a database
+func journalPath(dbPath string) string {
+	return dbPath + "-journal"
+}
+
+// journal is the rollback journal of a single database
+// All methods must be called with the owning pager's lock held.
+type journal struct {
+	fs       vfs.FS
+	file     vfs.File // Open only while a transaction has journaled pages
+	path     string
+	pageSize int
+	truncate bool // Truncate instead of deleting the journal on commit
+
+	nonce    uint32
+	origSize int64           // Database file size when the transaction started
+	pages    map[uint32]bool // Pages whose original image is already journaled
+	writeOff int64
+	unsynced bool
+	recBuf   []byte
+}
+
+// newJournal returns an inactive journal for a database
+func newJournal(fs vfs.FS, path string, pageSize int, truncate bool) *journal {
+	return &journal{
+		fs:       fs,
+		path:     path,
+		pageSize: pageSize,
+		truncate: truncate,
+		pages:    make(map[uint32]bool),
+		recBuf:   make([]byte, journalRecordHeaderSize+pageSize),
+	}
+}
+
+// active reports whether the current transaction has written a journal
+func (j *journal) active() bool {
+	return j.file != nil
+}
+
+// begin creates the journal for a transaction on a database of origSize bytes
+func (j *journal) begin(origSize int64) error {
+	file, err := j.fs.Open(j.path, vfs.OpenCreate)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to truncate journal: %w", err)
+	}
+
+	j.nonce = rand.Uint32()
+	j.origSize = origSize
+
+	var hdr [journalHeaderSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:], journalMagic)
+	binary.LittleEndian.PutUint32(hdr[4:], journalVersion)
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(j.pageSize))
+	binary.LittleEndian.PutUint32(hdr[12:], j.nonce)
+	binary.LittleEndian.PutUint64(hdr[16:], uint64(origSize))
+	binary.LittleEndian.PutUint32(hdr[24:], crc32.Checksum(hdr[:24], castagnoli))
+	if _, err := file.WriteAt(hdr[:], 0); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write journal header: %w", err)
+	}
+
+	j.file = file
+	j.writeOff = journalHeaderSize
+	j.unsynced = true
+	return nil
+}
+
+// recordChecksum covers the nonce, the page number and the page image
+func recordChecksum(nonce, pageNum uint32, data []byte) uint32 {
+	var seed [8]byte
+	binary.LittleEndian.PutUint32(seed[0:], nonce)
+	binary.LittleEndian.PutUint32(seed[4:], pageNum)
+	crc := crc32.Update(0, castagnoli, seed[:])
+	return crc32.Update(crc, castagnoli, data)
+}
+
+// needs reports whether a page's original image still has to be journaled
+// Pages past the original end of the file need none: restoring the file size
+// removes them.
+func (j *journal) needs(pageNum uint32) bool {
+	return !j.pages[pageNum] && int64(pageNum)*int64(j.pageSize) < j.origSize
+}
+
+// add appends the original image of a page to the journal
+func (j *journal) add(pageNum uint32, data []byte) error {
+	buf := j.recBuf
+	binary.LittleEndian.PutUint32(buf[0:], pageNum)
+	binary.LittleEndian.PutUint32(buf[4:], recordChecksum(j.nonce, pageNum, data))
+	copy(buf[journalRecordHeaderSize:], data)
+
+	if _, err := j.file.WriteAt(buf, j.writeOff); err != nil {
+		return fmt.Errorf("failed to journal page %d: %w", pageNum, err)
+	}
+	j.writeOff += int64(len(buf))
+	j.pages[pageNum] = true
+	j.unsynced = true
+	return nil
+}
+
+// sync makes the journal durable before the database file is overwritten
+func (j *journal) sync() error {
+	if !j.unsynced {
+		return nil
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	j.unsynced = false
+	return nil
+}
+
+// finish ends the transaction once the database file is synced
+// Deleting or truncating the journal is the commit point.
+func (j *journal) finish() error {
+	clear(j.pages)
+	if j.file == nil {
+		return nil
+	}
+
+	file := j.file
+	j.file = nil
+	if j.truncate {
+		if err := file.Truncate(0); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to truncate journal: %w", err)
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to sync journal: %w", err)
+		}
+		return file.Close()
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return j.fs.Delete(j.path)
+}
+
+// playbackJournal writes every journaled page back into db and restores its size
+// A journal without a valid header is ignored: the transaction that created
+// it never got as far as touching the database file.
+func playbackJournal(file, db vfs.File) error {
+	var hdr [journalHeaderSize]byte
+	if n, _ := file.ReadAt(hdr[:], 0); n != len(hdr) {
+		return nil
+	}
+	if binary.LittleEndian.Uint32(hdr[0:]) != journalMagic ||
+		binary.LittleEndian.Uint32(hdr[4:]) != journalVersion ||
+		binary.LittleEndian.Uint32(hdr[24:]) != crc32.Checksum(hdr[:24], castagnoli) {
+		return nil
+	}
+	pageSize := int(binary.LittleEndian.Uint32(hdr[8:]))
+	if !validPageSize(pageSize) {
+		return fmt.Errorf("%w: invalid page size %d", ErrCorruptJournal, pageSize)
+	}
+	nonce := binary.LittleEndian.Uint32(hdr[12:])
+	origSize := int64(binary.LittleEndian.Uint64(hdr[16:]))
+
+	buf := make([]byte, journalRecordHeaderSize+pageSize)
+	for off := int64(journalHeaderSize); ; off += int64(len(buf)) {
+		if n, _ := file.ReadAt(buf, off); n != len(buf) {
+			break
+		}
+		pageNum := binary.LittleEndian.Uint32(buf[0:])
+		data := buf[journalRecordHeaderSize:]
+		if binary.LittleEndian.Uint32(buf[4:]) != recordChecksum(nonce, pageNum, data) {
+			// Torn record: its page was never overwritten
+			break
+		}
+		if _, err := db.WriteAt(data, int64(pageNum)*int64(pageSize)); err != nil {
+			return fmt.Errorf("failed to restore page %d: %w", pageNum, err)
+		}
+	}
+
+	if err := db.Truncate(origSize); err != nil {
+		return fmt.Errorf("failed to restore database size: %w", err)
+	}
+	if err := db.Sync(); err != nil {
+		return fmt.Errorf("failed to sync database: %w", err)
+	}
+	return nil
+}
+
+// recoverJournal rolls back a hot journal left behind by a crashed session
+// This runs before the header is read, since the crash may have left page 0
+// half written.
+func (p *Pager) recoverJournal() error {
+	path := journalPath(p.filePath)
+	file, err := p.fs.Open(path, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+
+	if err := playbackJournal(file, p.file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return p.fs.Delete(path)
+}
+
+// journalOriginal copies the on-disk image of a page into the journal before
+// it is overwritten for the first time in the current transaction (must hold lock)
+func (p *Pager) journalOriginal(pageNum uint32) error {
+	if !p.journal.active() {
+		size, err := p.file.Size()
+		if err != nil {
+			return fmt.Errorf("failed to stat file: %w", err)
+		}
+		if err := p.journal.begin(size); err != nil {
+			return err
+		}
+	}
+	if !p.journal.needs(pageNum) {
+		return nil
+	}
+
+	buf := make([]byte, p.pageSize)
+	n, err := p.file.ReadAt(buf, p.pageOffset(pageNum))
+	if err != nil && n != p.pageSize && err != io.EOF {
+		return fmt.Errorf("failed to read page %d: %w", pageNum, err)
+	}
+	return p.journal.add(pageNum, buf)
+}
@@ -0,0 +1,150 @@
+package pager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mash-db/internal/common"
+)
+
+func TestJournal_CommitRemovesJournal(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeDelete, JournalModeTruncate} {
+		tmpDir := t.TempDir()
+		dbPath := filepath.Join(tmpDir, "test.db")
+
+		p, err := NewWithOptions(dbPath, Options{CacheSize: 10, JournalMode: mode})
+		if err != nil {
+			t.Fatalf("Failed to create pager: %v", err)
+		}
+
+		p.WritePage(1, testPage(p, 1))
+		if err := p.Flush(); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+
+		info, err := os.Stat(journalPath(dbPath))
+		switch mode {
+		case JournalModeDelete:
+			if !os.IsNotExist(err) {
+				t.Errorf("Journal should be deleted on commit, stat err: %v", err)
+			}
+		case JournalModeTruncate:
+			if err != nil || info.Size() != 0 {
+				t.Errorf("Journal should be truncated on commit, stat: %v %v", info, err)
+			}
+		}
+
+		p.Close()
+		p2, err := New(dbPath, 10)
+		if err != nil {
+			t.Fatalf("Failed to reopen: %v", err)
+		}
+		page, err := p2.ReadPage(1)
+		if err != nil {
+			t.Fatalf("Failed to read page 1: %v", err)
+		}
+		if page.Data[0] != 1 {
+			t.Errorf("Expected 1, got %d", page.Data[0])
+		}
+		p2.Close()
+	}
+}
+
+func TestJournal_HotJournalRestoresOriginals(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := NewWithOptions(dbPath, Options{CacheSize: 2, JournalMode: JournalModeDelete})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	for i := uint32(1); i <= 3; i++ {
+		p.WritePage(i, testPage(p, byte(i)))
+	}
+	p.SetSchemaCookie(3)
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	// Overwrite existing pages and append new ones; the small cache forces
+	// several of them into the database file before any commit
+	for i := uint32(1); i <= 6; i++ {
+		p.WritePage(i, testPage(p, byte(100+i)))
+	}
+	p.SetSchemaCookie(4)
+
+	info, _ := os.Stat(dbPath)
+	if info.Size() <= 4*common.PageSize {
+		t.Fatalf("Expected uncommitted pages in the database file, size %d", info.Size())
+	}
+
+	crashed := snapshotFiles(t, dbPath, "-journal")
+	if _, err := os.Stat(journalPath(crashed)); err != nil {
+		t.Fatalf("Expected a hot journal: %v", err)
+	}
+
+	p2, err := New(crashed, 10)
+	if err != nil {
+		t.Fatalf("Failed to open crashed database: %v", err)
+	}
+	defer p2.Close()
+
+	if _, err := os.Stat(journalPath(crashed)); !os.IsNotExist(err) {
+		t.Errorf("Hot journal should be removed after playback, stat err: %v", err)
+	}
+	if p2.NumPages() != 4 {
+		t.Errorf("Expected 4 pages after rollback, got %d", p2.NumPages())
+	}
+	if p2.SchemaCookie() != 3 {
+		t.Errorf("Expected schema cookie 3, got %d", p2.SchemaCookie())
+	}
+	for i := uint32(1); i <= 3; i++ {
+		page, err := p2.ReadPage(i)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", i, err)
+		}
+		if page.Data[0] != byte(i) {
+			t.Errorf("Page %d: expected committed value %d, got %d", i, i, page.Data[0])
+		}
+		p2.UnpinPage(i, false)
+	}
+	info, _ = os.Stat(crashed)
+	if info.Size() != 4*common.PageSize {
+		t.Errorf("Expected file truncated to %d bytes, got %d", 4*common.PageSize, info.Size())
+	}
+}
+
+func TestJournal_TornJournalIgnored(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	p.WritePage(1, testPage(p, 1))
+	p.Close()
+
+	// A journal whose header never reached the disk must not be played back
+	os.WriteFile(journalPath(dbPath), []byte("garbage"), 0644)
+
+	p2, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer p2.Close()
+
+	if _, err := os.Stat(journalPath(dbPath)); !os.IsNotExist(err) {
+		t.Errorf("Stale journal should be removed, stat err: %v", err)
+	}
+	page, err := p2.ReadPage(1)
+	if err != nil {
+		t.Fatalf("Failed to read page 1: %v", err)
+	}
+	if page.Data[0] != 1 {
+		t.Errorf("Expected 1, got %d", page.Data[0])
+	}
+}
@@ -0,0 +1,163 @@
+package pager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Page latches guard the Data of cached pages between goroutines; the
+// pager's mutex only guards the cache and the file, and is never held while
+// a latch is waited for
+
+// ErrPageLatched is returned when a page cannot be latched without waiting,
+// or written while another goroutine holds its latch
+var ErrPageLatched = errors.New("page is latched")
+
+// latchWaitMax caps the interval at which a latch that is waited for is tried
+const latchWaitMax = 5 * time.Millisecond
+
+// latchedError reports a page the pager found latched by another goroutine
+type latchedError struct {
+	pageNum   uint32
+	page      *Page
+	exclusive bool // The pager needs the latch exclusively
+}
+
+func (e *latchedError) Error() string {
+	return fmt.Sprintf("failed to write page %d: %v", e.pageNum, ErrPageLatched)
+}
+
+func (e *latchedError) Unwrap() error {
+	return ErrPageLatched
+}
+
+// latchMode is the latch a PageHandle holds on its page
+type latchMode int
+
+const (
+	latchNone latchMode = iota
+	latchShared
+	latchExclusive
+)
+
+// RLatch reads a page like Acquire and latches it shared
+// It blocks while another goroutine holds the page latched exclusively.
+func (p *Pager) RLatch(pageNum uint32) (*PageHandle, error) {
+	h, err := p.Acquire(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	h.page.latch.RLock()
+	h.latched = latchShared
+	return h, nil
+}
+
+// WLatch returns a page for modification like AcquireForWrite and latches it
+// exclusively
+// It blocks while any other goroutine holds the page latched.
+func (p *Pager) WLatch(pageNum uint32) (*PageHandle, error) {
+	h, err := p.AcquireForWrite(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	h.page.latch.Lock()
+	h.latched = latchExclusive
+	return h, nil
+}
+
+// TryRLatch is RLatch, but fails with ErrPageLatched instead of blocking
+func (p *Pager) TryRLatch(pageNum uint32) (*PageHandle, error) {
+	h, err := p.Acquire(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	if !h.page.latch.TryRLock() {
+		h.Release()
+		return nil, fmt.Errorf("%w: page %d", ErrPageLatched, pageNum)
+	}
+	h.latched = latchShared
+	return h, nil
+}
+
+// TryWLatch is WLatch, but fails with ErrPageLatched instead of blocking
+func (p *Pager) TryWLatch(pageNum uint32) (*PageHandle, error) {
+	h, err := p.AcquireForWrite(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	if !h.page.latch.TryLock() {
+		h.Release()
+		return nil, fmt.Errorf("%w: page %d", ErrPageLatched, pageNum)
+	}
+	h.latched = latchExclusive
+	return h, nil
+}
+
+// Unlatch releases the handle's latch but keeps the page pinned
+// It does nothing if the handle holds no latch.
+func (h *PageHandle) Unlatch() {
+	switch h.latched {
+	case latchShared:
+		h.page.latch.RUnlock()
+	case latchExclusive:
+		h.page.latch.Unlock()
+	}
+	h.latched = latchNone
+}
+
+// retryLatched runs op until it stops failing on a page latched by another
+// goroutine, waiting for the latch to be released in between (must hold lock)
+// The lock is released while waiting, so op must check the pager's state
+// afresh each time. A nil ctx waits for up to the latch timeout.
+func (p *Pager) retryLatched(ctx context.Context, op func() error) error {
+	for {
+		err := op()
+		var latched *latchedError
+		if !errors.As(err, &latched) {
+			return err
+		}
+		if ctx == nil {
+			if p.latchTimeout <= 0 {
+				return err
+			}
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(context.Background(), p.latchTimeout)
+			defer cancel()
+		}
+
+		p.mu.Unlock()
+		waitErr := waitLatch(ctx, latched.page, latched.exclusive)
+		p.mu.Lock()
+		if waitErr != nil {
+			return fmt.Errorf("%w: %w", err, waitErr)
+		}
+	}
+}
+
+// waitLatch waits until a page's latch is free to take, shared or exclusively
+// A sync.RWMutex cannot be waited for with a deadline, so the latch is tried
+// at growing intervals instead.
+func waitLatch(ctx context.Context, page *Page, exclusive bool) error {
+	delay := 50 * time.Microsecond
+	for {
+		if exclusive && page.latch.TryLock() {
+			page.latch.Unlock()
+			return nil
+		}
+		if !exclusive && page.latch.TryRLock() {
+			page.latch.RUnlock()
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return context.Cause(ctx)
+		}
+		delay = min(2*delay, latchWaitMax)
+	}
+}
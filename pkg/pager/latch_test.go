@@ -0,0 +1,259 @@
+package pager
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLatch_Crabbing(t *testing.T) {
+	const (
+		children   = 4
+		writers    = 8
+		readers    = 4
+		iterations = 200
+	)
+	p, err := New(MemoryPath, 32)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	// Page 1 is the root; its first byte routes each operation to a child
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Go(func() {
+			for i := range iterations {
+				root, err := p.WLatch(1)
+				if err != nil {
+					t.Errorf("Failed to latch root: %v", err)
+					return
+				}
+				child := 2 + uint32(root.Bytes()[0])%children
+				root.Bytes()[0] = byte(w + i)
+				root.MarkDirty()
+
+				h, err := p.WLatch(child)
+				root.Release()
+				if err != nil {
+					t.Errorf("Failed to latch page %d: %v", child, err)
+					return
+				}
+				n := binary.LittleEndian.Uint32(h.Bytes())
+				binary.LittleEndian.PutUint32(h.Bytes(), n+1)
+				h.MarkDirty()
+				h.Release()
+			}
+		})
+	}
+	for range readers {
+		wg.Go(func() {
+			for range iterations {
+				root, err := p.RLatch(1)
+				if err != nil {
+					t.Errorf("Failed to latch root: %v", err)
+					return
+				}
+				child := 2 + uint32(root.Bytes()[0])%children
+				h, err := p.RLatch(child)
+				root.Release()
+				if err != nil {
+					t.Errorf("Failed to latch page %d: %v", child, err)
+					return
+				}
+				_ = binary.LittleEndian.Uint32(h.Bytes())
+				h.Release()
+			}
+		})
+	}
+	wg.Go(func() {
+		for range iterations {
+			if err := p.Flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+				return
+			}
+		}
+	})
+	wg.Wait()
+
+	total := uint32(0)
+	for pageNum := uint32(2); pageNum < 2+children; pageNum++ {
+		h, err := p.RLatch(pageNum)
+		if err != nil {
+			t.Fatalf("Failed to latch page %d: %v", pageNum, err)
+		}
+		total += binary.LittleEndian.Uint32(h.Bytes())
+		h.Release()
+	}
+	if total != writers*iterations {
+		t.Errorf("Expected %d increments, got %d", writers*iterations, total)
+	}
+	if p.pinned.Load() != 0 {
+		t.Errorf("Expected no pins left, got %d", p.pinned.Load())
+	}
+}
+
+func TestLatch_TryVariants(t *testing.T) {
+	p, err := New(MemoryPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	w, err := p.WLatch(1)
+	if err != nil {
+		t.Fatalf("Failed to latch page: %v", err)
+	}
+	if _, err := p.TryRLatch(1); !errors.Is(err, ErrPageLatched) {
+		t.Errorf("Expected ErrPageLatched for a shared latch, got %v", err)
+	}
+	if _, err := p.TryWLatch(1); !errors.Is(err, ErrPageLatched) {
+		t.Errorf("Expected ErrPageLatched for an exclusive latch, got %v", err)
+	}
+	if p.pinned.Load() != 1 {
+		t.Errorf("Expected a failed try to leave no pin, got %d pins", p.pinned.Load())
+	}
+
+	// Unlatching keeps the pin
+	w.Unlatch()
+	if p.pinned.Load() != 1 {
+		t.Errorf("Expected Unlatch to keep the pin, got %d pins", p.pinned.Load())
+	}
+	r1, err := p.TryRLatch(1)
+	if err != nil {
+		t.Fatalf("Failed to latch an unlatched page: %v", err)
+	}
+	r2, err := p.TryRLatch(1)
+	if err != nil {
+		t.Fatalf("Failed to share a shared latch: %v", err)
+	}
+	if _, err := p.TryWLatch(1); !errors.Is(err, ErrPageLatched) {
+		t.Errorf("Expected ErrPageLatched while shared, got %v", err)
+	}
+
+	r1.Release()
+	r2.Release()
+	w.Release()
+	w2, err := p.TryWLatch(1)
+	if err != nil {
+		t.Fatalf("Failed to latch a released page: %v", err)
+	}
+	w2.Release()
+	if p.pinned.Load() != 0 {
+		t.Errorf("Expected no pins left, got %d", p.pinned.Load())
+	}
+}
+
+func TestLatch_WritesWaitForExclusiveLatch(t *testing.T) {
+	p, err := NewWithOptions(MemoryPath, Options{CacheSize: 10, LatchTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	tx, err := p.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	h, err := p.WLatch(1)
+	if err != nil {
+		t.Fatalf("Failed to latch page: %v", err)
+	}
+	copy(h.Bytes(), "latched")
+	h.MarkDirty()
+	h.Unlatch()
+	h.Release()
+
+	// A latch that is never released times out
+	h, err = p.WLatch(1)
+	if err != nil {
+		t.Fatalf("Failed to latch page: %v", err)
+	}
+	if err := p.Flush(); !errors.Is(err, ErrPageLatched) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Flush to time out on the latched page, got %v", err)
+	}
+	if err := p.WritePage(1, make([]byte, p.PageSize())); !errors.Is(err, ErrPageLatched) {
+		t.Errorf("Expected WritePage to time out on the latched page, got %v", err)
+	}
+
+	// One that is released is waited for
+	time.AfterFunc(5*time.Millisecond, h.Release)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Expected Commit to wait for the latch, got %v", err)
+	}
+
+	h, err = p.RLatch(1)
+	if err != nil {
+		t.Fatalf("Failed to latch page: %v", err)
+	}
+	defer h.Release()
+	if got := string(h.Bytes()[:7]); got != "latched" {
+		t.Errorf("Expected %q, got %q", "latched", got)
+	}
+}
+
+func TestLatch_NoTimeoutFailsFast(t *testing.T) {
+	p, err := New(MemoryPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	h, err := p.WLatch(1)
+	if err != nil {
+		t.Fatalf("Failed to latch page: %v", err)
+	}
+	defer h.Release()
+	err = p.WritePage(1, make([]byte, p.PageSize()))
+	if !errors.Is(err, ErrPageLatched) || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected WritePage to fail on the latched page at once, got %v", err)
+	}
+}
+
+func TestLatch_RollbackWaitsForLatch(t *testing.T) {
+	p, err := NewWithOptions(MemoryPath, Options{CacheSize: 10, LatchTimeout: time.Minute})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	tx, err := p.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	h, err := p.WLatch(1)
+	if err != nil {
+		t.Fatalf("Failed to latch page: %v", err)
+	}
+	copy(h.Bytes(), "uncommitted")
+	h.MarkDirty()
+	h.Release()
+
+	// The page stays pinned and latched by a reader while the rollback
+	// reloads it
+	r, err := p.RLatch(1)
+	if err != nil {
+		t.Fatalf("Failed to latch page: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- tx.Rollback() }()
+	select {
+	case err := <-done:
+		t.Fatalf("Expected Rollback to wait for the latch, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if got := string(r.Bytes()[:11]); got != "uncommitted" {
+		t.Errorf("Expected the latched page untouched, got %q", got)
+	}
+	r.Unlatch()
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	if !allZero(r.Bytes()) {
+		t.Error("Expected the pinned page reloaded")
+	}
+	r.Release()
+}
@@ -0,0 +1,307 @@
+package pager
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"mash-db/pkg/vfs"
+)
+
+// Locking protocol
+//
+// Pagers in different processes coordinate through advisory byte-range locks
+// on the database file, following SQLite's scheme:
+//
+//	SHARED     read lock on the shared range; any number of readers
+//	RESERVED   write lock on the reserved byte; one writer preparing changes
+//	PENDING    write lock on the pending byte; a writer waiting for readers to
+//	           drain, which stops new readers from starting
+//	EXCLUSIVE  write lock on the shared range; the database file may be written
+//
+// The lock bytes sit at 1 GiB, as in SQLite. A database larger than that
+// keeps page data in them like anywhere else: the locks are advisory, so
+// unlike SQLite, which leaves the page holding them unused for platforms
+// with mandatory locks, the pager sets no page aside.
+const (
+	pendingByte     = 0x40000000
+	reservedByte    = pendingByte + 1
+	sharedFirstByte = pendingByte + 2
+	sharedSize      = 510
+)
+
+// LockLevel is the lock a pager holds on its database file
+type LockLevel int
+
+const (
+	LockNone LockLevel = iota
+	LockShared
+	LockReserved
+	LockPending
+	LockExclusive
+)
+
+func (l LockLevel) String() string {
+	switch l {
+	case LockNone:
+		return "none"
+	case LockShared:
+		return "shared"
+	case LockReserved:
+		return "reserved"
+	case LockPending:
+		return "pending"
+	case LockExclusive:
+		return "exclusive"
+	}
+	return fmt.Sprintf("LockLevel(%d)", int(l))
+}
+
+// LockingMode selects when a pager gives its locks back
+type LockingMode int
+
+const (
+	// LockingModeNormal drops to no lock whenever the pager is idle, so other
+	// processes can write between uses
+	LockingModeNormal LockingMode = iota
+
+	// LockingModeExclusive keeps every lock once acquired until Close. Where
+	// the platform has no file locks, the pager goes on without them.
+	LockingModeExclusive
+
+	// LockingModeNone takes no file locks at all; only one pager may have the
+	// file open
+	LockingModeNone
+)
+
+var ErrDatabaseLocked = errors.New("database is locked")
+
+// fileLock tracks the lock level held on one open database file
+type fileLock struct {
+	file  vfs.File
+	mode  LockingMode
+	level LockLevel
+}
+
+// set applies a lock to a byte range of the file
+// A pager that opted out of sharing the file gets by without file locks.
+func (l *fileLock) set(typ vfs.LockType, start, length int64) error {
+	if l.mode == LockingModeNone {
+		return nil
+	}
+	err := l.file.Lock(typ, start, length)
+	if l.mode == LockingModeExclusive && errors.Is(err, vfs.ErrLockingUnsupported) {
+		return nil
+	}
+	return err
+}
+
+// lock raises the lock to at least level without waiting
+// A failed attempt to reach EXCLUSIVE leaves PENDING in place so that the
+// next attempt does not have to compete with newly arriving readers.
+func (l *fileLock) lock(level LockLevel) error {
+	if l.level >= level {
+		return nil
+	}
+
+	if l.level == LockNone {
+		// A pending writer makes new readers wait
+		if err := l.set(vfs.ReadLock, pendingByte, 1); err != nil {
+			return err
+		}
+		err := l.set(vfs.ReadLock, sharedFirstByte, sharedSize)
+		l.set(vfs.Unlock, pendingByte, 1)
+		if err != nil {
+			return err
+		}
+		l.level = LockShared
+	}
+
+	if level >= LockReserved && l.level < LockReserved {
+		if err := l.set(vfs.WriteLock, reservedByte, 1); err != nil {
+			return err
+		}
+		l.level = LockReserved
+	}
+
+	if level >= LockPending && l.level < LockPending {
+		if err := l.set(vfs.WriteLock, pendingByte, 1); err != nil {
+			return err
+		}
+		l.level = LockPending
+	}
+
+	if level >= LockExclusive && l.level < LockExclusive {
+		if err := l.set(vfs.WriteLock, sharedFirstByte, sharedSize); err != nil {
+			return err
+		}
+		l.level = LockExclusive
+	}
+	return nil
+}
+
+// dropPending steps back from PENDING to RESERVED after giving up on EXCLUSIVE
+func (l *fileLock) dropPending() {
+	if l.level == LockPending && l.set(vfs.Unlock, pendingByte, 1) == nil {
+		l.level = LockReserved
+	}
+}
+
+// unlock lowers the lock to level, which must be LockShared or LockNone
+func (l *fileLock) unlock(level LockLevel) error {
+	if l.level <= level {
+		return nil
+	}
+
+	if level == LockShared {
+		if l.level == LockExclusive {
+			if err := l.set(vfs.ReadLock, sharedFirstByte, sharedSize); err != nil {
+				return err
+			}
+		}
+		if err := l.set(vfs.Unlock, pendingByte, 2); err != nil {
+			return err
+		}
+		l.level = LockShared
+		return nil
+	}
+
+	if err := l.set(vfs.Unlock, pendingByte, 2+sharedSize); err != nil {
+		return err
+	}
+	l.level = LockNone
+	return nil
+}
+
+// acquireLock raises the pager's lock to level, retrying until the busy
+// timeout expires (must hold lock)
+func (p *Pager) acquireLock(level LockLevel) error {
+	err := p.lock.lock(level)
+	if err == nil || !errors.Is(err, vfs.ErrBusy) {
+		return err
+	}
+
+	deadline := time.Now().Add(p.busyTimeout)
+	delay := time.Millisecond
+	for time.Now().Before(deadline) {
+		time.Sleep(min(delay, time.Until(deadline)))
+		if err = p.lock.lock(level); err == nil || !errors.Is(err, vfs.ErrBusy) {
+			return err
+		}
+		delay = min(2*delay, 100*time.Millisecond)
+	}
+
+	// Don't keep new readers out while nobody is waiting for them to leave
+	p.lock.dropPending()
+	return fmt.Errorf("%w: waiting for %v lock", ErrDatabaseLocked, level)
+}
+
+// lockShared makes sure the pager holds at least a SHARED lock (must hold lock)
+// Coming from no lock at all, another process may have committed in the
+// meantime: a hot journal is rolled back, and the cache is dropped if the
+// header's change counter moved.
+func (p *Pager) lockShared() error {
+	if p.lock.level >= LockShared {
+		return nil
+	}
+	if err := p.acquireLock(LockShared); err != nil {
+		return err
+	}
+
+	if err := p.rollbackHotJournal(); err != nil {
+		p.lock.unlock(LockNone)
+		return err
+	}
+
+	// Only a commit by another process changes the counter, and only then
+	// do the header and cache need reloading
+	counter := p.header.ChangeCounter
+	if probe, err := p.readChangeCounter(); err == nil && probe == counter {
+		return nil
+	}
+	size, err := p.file.Size()
+	if err == nil {
+		err = p.loadHeader(size)
+	}
+	if err != nil {
+		p.lock.unlock(LockNone)
+		return err
+	}
+	if p.header.ChangeCounter != counter {
+		p.cache.Clear()
+	}
+	return nil
+}
+
+// lockReserved declares the intent to modify the database (must hold lock)
+func (p *Pager) lockReserved() error {
+	if err := p.lockShared(); err != nil {
+		return err
+	}
+	if err := p.acquireLock(LockReserved); err != nil {
+		// Don't hold up the writer we lost to
+		p.releaseLock()
+		return err
+	}
+	return nil
+}
+
+// releaseLock gives locks back once the pager no longer needs them (must hold lock)
+// Writers keep RESERVED while uncommitted changes exist; readers keep SHARED
+// while pages are pinned.
+func (p *Pager) releaseLock() {
+	if p.lockingMode != LockingModeNormal || p.wal != nil || p.tx != nil || p.dirty {
+		return
+	}
+	if p.pinned.Load() > 0 {
+		p.lock.unlock(LockShared)
+		return
+	}
+	p.lock.unlock(LockNone)
+}
+
+// rollbackHotJournal plays back a journal left by a crashed writer (must hold lock)
+// A journal is only hot if no live process holds RESERVED: otherwise it
+// belongs to a transaction in progress.
+func (p *Pager) rollbackHotJournal() error {
+	// An empty journal is what JournalModeTruncate leaves behind on commit
+	if size, err := p.fileSize(journalPath(p.filePath)); err != nil || size == 0 {
+		return err
+	}
+	if p.journal != nil && p.journal.active() {
+		return nil
+	}
+
+	held := p.lock.level
+	if err := p.lock.lock(LockReserved); err != nil {
+		if errors.Is(err, vfs.ErrBusy) {
+			return nil
+		}
+		return err
+	}
+	err := p.acquireLock(LockExclusive)
+	if err == nil {
+		err = p.recoverJournal()
+	}
+	if held < LockReserved {
+		if unlockErr := p.lock.unlock(LockShared); err == nil {
+			err = unlockErr
+		}
+	}
+	return err
+}
+
+// refresh picks up changes committed by other processes before header fields
+// are read (must hold lock)
+func (p *Pager) refresh() {
+	if !p.closed.Load() && p.lockShared() == nil {
+		p.releaseLock()
+	}
+}
+
+// LockLevel returns the lock currently held on the database file
+func (p *Pager) LockLevel() LockLevel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lock.level
+}
@@ -0,0 +1,336 @@
+//go:build linux
+
+package pager
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Two pagers in one process stand in for two processes: OFD locks on Linux
+// belong to the open file, not the process.
+
+func openLockPager(t *testing.T, dbPath string, opts Options) *Pager {
+	t.Helper()
+	p, err := NewWithOptions(dbPath, opts)
+	if err != nil {
+		t.Fatalf("Failed to open pager: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestLock_IdlePagerHoldsNoLock(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p := openLockPager(t, dbPath, Options{})
+
+	if p.LockLevel() != LockNone {
+		t.Errorf("Expected no lock after open, got %v", p.LockLevel())
+	}
+
+	if err := p.WritePage(1, testPage(p, 1)); err != nil {
+		t.Fatalf("Failed to write page: %v", err)
+	}
+	if p.LockLevel() != LockReserved {
+		t.Errorf("Expected reserved lock with uncommitted changes, got %v", p.LockLevel())
+	}
+
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if p.LockLevel() != LockNone {
+		t.Errorf("Expected no lock after commit, got %v", p.LockLevel())
+	}
+
+	if _, err := p.ReadPage(1); err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	if p.LockLevel() != LockShared {
+		t.Errorf("Expected shared lock while a page is pinned, got %v", p.LockLevel())
+	}
+	p.UnpinPage(1, false)
+	if p.LockLevel() != LockNone {
+		t.Errorf("Expected no lock after unpin, got %v", p.LockLevel())
+	}
+}
+
+func TestLock_ReadersCoexist(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	writer := openLockPager(t, dbPath, Options{})
+	writer.WritePage(1, testPage(writer, 1))
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	r1 := openLockPager(t, dbPath, Options{})
+	r2 := openLockPager(t, dbPath, Options{})
+	for _, r := range []*Pager{r1, r2} {
+		page, err := r.ReadPage(1)
+		if err != nil {
+			t.Fatalf("Failed to read page: %v", err)
+		}
+		if page.Data[0] != 1 {
+			t.Errorf("Expected 1, got %d", page.Data[0])
+		}
+	}
+	r1.UnpinPage(1, false)
+	r2.UnpinPage(1, false)
+}
+
+func TestLock_WritersAreSerialized(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p1 := openLockPager(t, dbPath, Options{})
+	p2 := openLockPager(t, dbPath, Options{})
+
+	if err := p1.WritePage(1, testPage(p1, 1)); err != nil {
+		t.Fatalf("Failed to write page: %v", err)
+	}
+
+	err := p2.WritePage(1, testPage(p2, 2))
+	if !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("Expected ErrDatabaseLocked for second writer, got %v", err)
+	}
+	if _, err := p2.Begin(); !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("Expected ErrDatabaseLocked for Begin, got %v", err)
+	}
+
+	if err := p1.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if err := p2.WritePage(1, testPage(p2, 2)); err != nil {
+		t.Fatalf("Expected second writer to proceed after commit, got %v", err)
+	}
+}
+
+func TestLock_CommitWaitsForReaders(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	writer := openLockPager(t, dbPath, Options{BusyTimeout: time.Second})
+	reader := openLockPager(t, dbPath, Options{})
+
+	writer.WritePage(1, testPage(writer, 1))
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	if _, err := reader.ReadPage(1); err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	writer.WritePage(1, testPage(writer, 2))
+
+	// The writer blocks new readers while it waits for the current one
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		reader.UnpinPage(1, false)
+	}()
+
+	start := time.Now()
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Expected commit to wait for the reader, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("Commit did not wait for the reader")
+	}
+}
+
+func TestLock_BusyTimeout(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	writer := openLockPager(t, dbPath, Options{BusyTimeout: 100 * time.Millisecond})
+	reader := openLockPager(t, dbPath, Options{})
+
+	if _, err := reader.ReadPage(1); err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	defer reader.UnpinPage(1, false)
+
+	writer.WritePage(1, testPage(writer, 1))
+	start := time.Now()
+	err := writer.Flush()
+	if !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("Expected ErrDatabaseLocked, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Gave up after %v, before the busy timeout", elapsed)
+	}
+
+	// Giving up must not leave readers locked out
+	other := openLockPager(t, dbPath, Options{})
+	if _, err := other.ReadPage(1); err != nil {
+		t.Fatalf("Expected a new reader to get in, got %v", err)
+	}
+	other.UnpinPage(1, false)
+}
+
+func TestLock_CacheInvalidatedByOtherWriter(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p1 := openLockPager(t, dbPath, Options{})
+	p2 := openLockPager(t, dbPath, Options{})
+
+	p1.WritePage(1, testPage(p1, 1))
+	if err := p1.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	expectPages(t, p2, 1, func(uint32) byte { return 1 })
+
+	p1.WritePage(1, testPage(p1, 2))
+	p1.WritePage(2, testPage(p1, 2))
+	if err := p1.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	// p2 still caches the old page 1
+	expectPages(t, p2, 2, func(uint32) byte { return 2 })
+	if p2.NumPages() != 3 {
+		t.Errorf("Expected 3 pages, got %d", p2.NumPages())
+	}
+}
+
+func TestLock_CachedReadSkipsHeader(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p := openLockPager(t, dbPath, Options{})
+	p.WritePage(1, testPage(p, 1))
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	expectPages(t, p, 1, func(uint32) byte { return 1 })
+
+	// Nobody committed since, so the lock only probes the change counter
+	before := p.IOStats()
+	expectPages(t, p, 1, func(uint32) byte { return 1 })
+	if after := p.IOStats(); after != before {
+		t.Errorf("Expected no page reads, got %+v then %+v", before, after)
+	}
+}
+
+func TestLock_CacheInvalidatedByEvictedPage(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	writer := openLockPager(t, dbPath, Options{CacheSize: 1})
+	reader := openLockPager(t, dbPath, Options{})
+
+	writer.WritePage(1, testPage(writer, 1))
+	writer.WritePage(2, testPage(writer, 2))
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	expectPages(t, reader, 1, func(uint32) byte { return 1 })
+
+	// Reading page 2 evicts the dirty page 1 straight into the file, leaving
+	// nothing dirty in the cache for the commit
+	writer.WritePage(1, testPage(writer, 9))
+	if _, err := writer.ReadPage(2); err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	writer.UnpinPage(2, false)
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	expectPages(t, reader, 1, func(uint32) byte { return 9 })
+}
+
+func TestLock_ExclusiveLockingMode(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p1 := openLockPager(t, dbPath, Options{LockingMode: LockingModeExclusive})
+	p1.WritePage(1, testPage(p1, 1))
+	if err := p1.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if p1.LockLevel() != LockExclusive {
+		t.Errorf("Expected exclusive lock to be kept, got %v", p1.LockLevel())
+	}
+
+	if _, err := NewWithOptions(dbPath, Options{}); !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("Expected ErrDatabaseLocked opening a locked database, got %v", err)
+	}
+}
+
+func TestLock_WALModeIsExclusive(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	openLockPager(t, dbPath, Options{JournalMode: JournalModeWAL})
+
+	if _, err := NewWithOptions(dbPath, Options{}); !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("Expected ErrDatabaseLocked, got %v", err)
+	}
+}
+
+// BenchmarkCachedReadPage reads a cached page in normal locking mode, where
+// every read takes and gives back the SHARED lock
+func BenchmarkCachedReadPage(b *testing.B) {
+	p, err := NewWithOptions(filepath.Join(b.TempDir(), "test.db"), Options{})
+	if err != nil {
+		b.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+	p.WritePage(1, testPage(p, 1))
+	if err := p.Flush(); err != nil {
+		b.Fatalf("Failed to flush: %v", err)
+	}
+
+	for b.Loop() {
+		if _, err := p.ReadPage(1); err != nil {
+			b.Fatalf("Failed to read page: %v", err)
+		}
+		p.UnpinPage(1, false)
+	}
+}
+
+func TestLock_BackupWhileOtherCommits(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	writer := openLockPager(t, dbPath, Options{})
+	src := openLockPager(t, dbPath, Options{})
+	for i := uint32(1); i <= 10; i++ {
+		writer.WritePage(i, testPage(writer, 1))
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	// A page spilled mid-commit holds the EXCLUSIVE lock
+	tx, err := writer.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	for i := uint32(1); i <= 10; i++ {
+		writer.WritePage(i, testPage(writer, 2))
+	}
+	if err := writer.FlushPage(1); err != nil {
+		t.Fatalf("Failed to flush page: %v", err)
+	}
+
+	dst := openLockPager(t, MemoryPath, Options{})
+	b, err := src.Backup(dst)
+	if err != nil {
+		t.Fatalf("Failed to start backup: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- b.Run(1, time.Millisecond) }()
+
+	// The backup waits the commit out and copies what it committed
+	time.Sleep(50 * time.Millisecond)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to back up: %v", err)
+	}
+	expectPages(t, dst, 10, func(uint32) byte { return 2 })
+
+	// A source locked for longer than BusyTimeout fails the backup
+	tx, err = writer.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	defer tx.Rollback()
+	writer.WritePage(1, testPage(writer, 3))
+	if err := writer.FlushPage(1); err != nil {
+		t.Fatalf("Failed to flush page: %v", err)
+	}
+	var buf bytes.Buffer
+	b = src.BackupWriter(&buf)
+	b.BusyTimeout = 20 * time.Millisecond
+	if err := b.Run(1, time.Millisecond); !errors.Is(err, ErrDatabaseLocked) {
+		t.Errorf("Expected ErrDatabaseLocked, got %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package pager
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"mash-db/pkg/vfs"
+)
+
+// flushBuckets are the upper bounds of the flush latency histogram
+var flushBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// Metrics is a snapshot of a pager's counters and gauges
+// Counters start at zero when the pager is opened. Bytes and syncs cover
+// every file the pager uses: the database file, its write-ahead log and its
+// rollback journal.
+type Metrics struct {
+	IOStats
+
+	CacheHits      uint64
+	CacheMisses    uint64
+	CacheHitRate   float64 // Percentage of lookups that hit
+	PrefetchHits   uint64  // First uses of prefetched pages, neither hits nor misses
+	Evictions      uint64  // Pages the cache evicted to make room
+	DirtyEvictions uint64  // Evicted pages that had to be written out
+	CachedPages    int
+	CacheCapacity  int
+	PinnedPages    int64 // Outstanding pins, counting a page pinned twice twice
+
+	BytesRead    uint64
+	BytesWritten uint64
+	Syncs        uint64
+
+	Pages      uint32 // Pages in the database, including the header
+	FileSize   int64  // Size of the database file in bytes
+	FileGrowth int64  // Bytes the database file grew since open; negative once it shrinks
+
+	FlushLatency Histogram // Flushes that commit: Flush, Commit, checkpoints and Close
+}
+
+// Histogram counts observed durations into buckets
+type Histogram struct {
+	Bounds []time.Duration // Upper bound of each bucket but the last
+	Counts []uint64        // Observations per bucket; the last is past every bound
+	Count  uint64
+	Sum    time.Duration
+}
+
+func newHistogram(bounds []time.Duration) Histogram {
+	return Histogram{Bounds: bounds, Counts: make([]uint64, len(bounds)+1)}
+}
+
+// observe records the time since start
+func (h *Histogram) observe(start time.Time) {
+	d := time.Since(start)
+	i := 0
+	for i < len(h.Bounds) && d > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// clone returns a copy that shares no memory with h
+func (h Histogram) clone() Histogram {
+	h.Counts = append([]uint64(nil), h.Counts...)
+	return h
+}
+
+// Metrics returns a snapshot of the pager's metrics
+func (p *Pager) Metrics() Metrics {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m := Metrics{
+		IOStats:       p.io,
+		CachedPages:   p.cache.Size(),
+		CacheCapacity: p.cache.Capacity(),
+		PinnedPages:   p.pinned.Load(),
+		BytesRead:     p.files.bytesRead.Load(),
+		BytesWritten:  p.files.bytesWritten.Load(),
+		Syncs:         p.files.syncs.Load(),
+		Pages:         p.numPages.Load(),
+		FlushLatency:  p.flushLatency.clone(),
+	}
+	m.CacheHits, m.CacheMisses = p.cache.Stats()
+	m.CacheHitRate = p.cache.HitRate()
+	m.PrefetchHits = p.cache.PrefetchHits()
+	m.Evictions, m.DirtyEvictions = p.cache.Evictions()
+	if !p.closed.Load() {
+		if size, err := p.file.Size(); err == nil {
+			m.FileSize = size
+			m.FileGrowth = size - p.openSize
+		}
+	}
+	return m
+}
+
+// PublishExpvar publishes the pager's metrics as the expvar variable name
+// Like expvar.Publish, it panics if the name is already in use.
+func (p *Pager) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any { return p.Metrics() }))
+}
+
+// MetricsHandler returns an HTTP handler serving the pager's metrics in the
+// Prometheus text exposition format
+func (p *Pager) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		p.Metrics().WritePrometheus(w)
+	})
+}
+
+// WritePrometheus writes m in the Prometheus text exposition format, with
+// every metric named mashdb_*
+func (m Metrics) WritePrometheus(w io.Writer) error {
+	var b strings.Builder
+	metric := func(name, typ, help string, value any) {
+		fmt.Fprintf(&b, "# HELP mashdb_%s %s\n# TYPE mashdb_%s %s\nmashdb_%s %v\n", name, help, name, typ, name, value)
+	}
+	metric("cache_hits_total", "counter", "Page lookups served from the cache.", m.CacheHits)
+	metric("cache_misses_total", "counter", "Page lookups that went to disk.", m.CacheMisses)
+	metric("cache_prefetch_hits_total", "counter", "First lookups of prefetched pages.", m.PrefetchHits)
+	metric("cache_evictions_total", "counter", "Pages evicted from the cache.", m.Evictions)
+	metric("cache_dirty_evictions_total", "counter", "Evicted pages that had to be written out.", m.DirtyEvictions)
+	metric("cache_pages", "gauge", "Pages in the cache.", m.CachedPages)
+	metric("cache_capacity_pages", "gauge", "Pages the cache can hold.", m.CacheCapacity)
+	metric("pinned_pages", "gauge", "Outstanding page pins.", m.PinnedPages)
+	metric("page_reads_total", "counter", "Read operations issued for page images.", m.Reads)
+	metric("pages_read_total", "counter", "Page images read.", m.PagesRead)
+	metric("page_writes_total", "counter", "Write operations issued for page images.", m.Writes)
+	metric("pages_written_total", "counter", "Page images written.", m.PagesWritten)
+	metric("read_bytes_total", "counter", "Bytes read from the database, log and journal files.", m.BytesRead)
+	metric("written_bytes_total", "counter", "Bytes written to the database, log and journal files.", m.BytesWritten)
+	metric("syncs_total", "counter", "Syncs of the database, log and journal files.", m.Syncs)
+	metric("pages", "gauge", "Pages in the database.", m.Pages)
+	metric("file_size_bytes", "gauge", "Size of the database file.", m.FileSize)
+	metric("file_growth_bytes", "gauge", "Bytes the database file grew since it was opened.", m.FileGrowth)
+
+	const flush = "mashdb_flush_duration_seconds"
+	h := m.FlushLatency
+	fmt.Fprintf(&b, "# HELP %s Time taken by flushes that commit.\n# TYPE %s histogram\n", flush, flush)
+	cumulative := uint64(0)
+	for i, count := range h.Counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = fmt.Sprint(h.Bounds[i].Seconds())
+		}
+		fmt.Fprintf(&b, "%s_bucket{le=%q} %d\n", flush, le, cumulative)
+	}
+	fmt.Fprintf(&b, "%s_sum %v\n%s_count %d\n", flush, h.Sum.Seconds(), flush, h.Count)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// fileCounters counts the bytes and syncs of every file a pager opens
+type fileCounters struct {
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	syncs        atomic.Uint64
+}
+
+// meteredFS wraps the FS a pager opens its files through to count their I/O
+type meteredFS struct {
+	vfs.FS
+	counters *fileCounters
+}
+
+type meteredFile struct {
+	vfs.File
+	counters *fileCounters
+}
+
+func (f meteredFS) Open(name string, flag vfs.OpenFlag) (vfs.File, error) {
+	file, err := f.FS.Open(name, flag)
+	if err != nil {
+		return nil, err
+	}
+	return meteredFile{File: file, counters: f.counters}, nil
+}
+
+func (f meteredFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	f.counters.bytesRead.Add(uint64(n))
+	return n, err
+}
+
+func (f meteredFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	f.counters.bytesWritten.Add(uint64(n))
+	return n, err
+}
+
+func (f meteredFile) Sync() error {
+	f.counters.syncs.Add(1)
+	return f.File.Sync()
+}
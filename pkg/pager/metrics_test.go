@@ -0,0 +1,104 @@
+package pager
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	p, err := NewWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{CacheSize: 10})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	m := p.Metrics()
+	if m.FlushLatency.Count != 0 || m.Evictions != 0 || m.CacheMisses != 0 {
+		t.Errorf("Expected a fresh pager to start at zero, got %+v", m)
+	}
+
+	// Writing 30 pages through 10 cache slots evicts 20 of them dirty
+	for i := uint32(1); i <= 30; i++ {
+		p.WritePage(i, testPage(p, byte(i)))
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	page, err := p.ReadPage(1)
+	if err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	defer p.UnpinPage(1, false)
+
+	m = p.Metrics()
+	if m.Evictions != 21 || m.DirtyEvictions != 20 {
+		t.Errorf("Expected 21 evictions, 20 dirty, got %d and %d", m.Evictions, m.DirtyEvictions)
+	}
+	if m.PinnedPages != 1 || m.CachedPages != 10 || m.CacheCapacity != 10 {
+		t.Errorf("Expected 1 pin and 10 of 10 pages cached, got %d pins and %d of %d", m.PinnedPages, m.CachedPages, m.CacheCapacity)
+	}
+	// The header is written on creation and again by the flush
+	if m.CacheMisses != 31 || m.PagesWritten != 32 {
+		t.Errorf("Expected 31 misses and 32 pages written, got %d and %d", m.CacheMisses, m.PagesWritten)
+	}
+	size := int64(31 * p.PageSize())
+	if m.Pages != 31 || m.FileSize != size || m.FileGrowth != size {
+		t.Errorf("Expected 31 pages in %d bytes, got %d pages in %d bytes, %d grown", size, m.Pages, m.FileSize, m.FileGrowth)
+	}
+	if m.BytesWritten < uint64(size) || m.BytesRead < uint64(len(page.Data)) || m.Syncs == 0 {
+		t.Errorf("Expected the file I/O to be counted, got %d bytes written, %d read, %d syncs", m.BytesWritten, m.BytesRead, m.Syncs)
+	}
+	if m.FlushLatency.Count != 1 || m.FlushLatency.Sum <= 0 {
+		t.Errorf("Expected one flush timed, got %d taking %v", m.FlushLatency.Count, m.FlushLatency.Sum)
+	}
+	total := uint64(0)
+	for _, n := range m.FlushLatency.Counts {
+		total += n
+	}
+	if total != 1 {
+		t.Errorf("Expected one flush in the buckets, got %d", total)
+	}
+}
+
+func TestMetrics_Exposition(t *testing.T) {
+	p, err := New(MemoryPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+	p.WritePage(1, testPage(p, 1))
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	m := p.Metrics()
+	rec := httptest.NewRecorder()
+	p.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Expected the Prometheus text format, got %q", ct)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	for _, line := range []string{
+		"# TYPE mashdb_cache_hits_total counter",
+		fmt.Sprintf("mashdb_pages_written_total %d", m.PagesWritten),
+		"mashdb_pages 2",
+		"# TYPE mashdb_flush_duration_seconds histogram",
+		`mashdb_flush_duration_seconds_bucket{le="+Inf"} 1`,
+		"mashdb_flush_duration_seconds_count 1",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("Expected line %q in:\n%s", line, body)
+		}
+	}
+
+	p.PublishExpvar("mashdb_test")
+	v := expvar.Get("mashdb_test")
+	if v == nil || !strings.Contains(v.String(), fmt.Sprintf(`"PagesWritten":%d`, m.PagesWritten)) {
+		t.Errorf("Expected the metrics under expvar, got %v", v)
+	}
+}
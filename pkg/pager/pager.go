@@ -1,12 +1,19 @@
 package pager
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"os"
+	"io"
+	"io/fs"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"mash-db/internal/common"
+	"mash-db/pkg/vfs"
 )
 
 var (
@@ -17,191 +24,993 @@ var (
 )
 
 // Page represents a single page of data
+// Data is sized to the page size of the pager that owns the page. The last
+// Pager.ReservedBytes() bytes of Data belong to the pager (for example the
+// page checksum) and are overwritten when the page is written to disk.
 type Page struct {
-	Data   [common.PageSize]byte
+	Data   []byte
 	Dirty  bool // Has been modified but not flushed
 	PinCnt int  // Number of users currently using this page
+
+	latch sync.RWMutex // Guards Data between holders of latched handles
 }
 
 // Pager manages reading and writing fixed-size pages to/from disk
 type Pager struct {
-	file     *os.File
+	fs       vfs.FS
+	file     vfs.File
 	filePath string
-	numPages uint32
-	cache    *LRUCache
+	numPages atomic.Uint32 // Written with mu held; read without it by NumPages
+	pageSize int
+	usable   int    // Bytes per page available to callers, fixed once open
+	sealBuf  []byte // Scratch buffer for page images being written
+	runBuf   []byte // Scratch buffer for runs of adjacent pages being written
+	io       IOStats
+	files    *fileCounters // Bytes and syncs of every file opened through fs
+	openSize int64         // Size of the database file when opened
+	cache    *PageCache
+	header   Header
 	mu       sync.Mutex
-	closed   bool
+	closed   atomic.Bool
+
+	journalMode       JournalMode
+	wal               *wal        // Non-nil in JournalModeWAL
+	journal           *journal    // Non-nil in the rollback journal modes and during a Tx
+	store             *slotStore  // Non-nil for compressed databases
+	cipher            *pageCipher // Non-nil for encrypted databases
+	tx                *Tx         // Active transaction, if any
+	committed         Header      // Header as of the last commit
+	walAutoCheckpoint int
+
+	lock        *fileLock
+	lockingMode LockingMode
+	busyTimeout time.Duration
+	dirty       bool            // Uncommitted changes exist, in the cache or on disk
+	spilled     bool            // Pages were written to the database file since the last commit
+	staleEnd    uint32          // In WAL mode, pages past the end but below this have images from before a Truncate
+	free        map[uint32]bool // Pages on the freelist; nil until read after the header loads, see freeSet
+
+	lastCheckpoint time.Time // When the log was last checkpointed, for the background writer
+
+	// Pins are counted without mu where the file lock allows, see pinCached
+	pinned       atomic.Int64 // Outstanding pins across all cached pages
+	owned        atomic.Bool  // The file lock is never given up before Close
+	pinWaiters   atomic.Int32 // Goroutines in retryPinned
+	pinTimeout   time.Duration
+	latchTimeout time.Duration
+	unpinned     chan struct{} // Closed when a page is unpinned; nil without waiters
+
+	flushLatency Histogram // Latency of flushAllInternal
+
+	writer    *bgWriter                // Non-nil if a background writer runs
+	readAhead *readAhead               // Non-nil if read-ahead is enabled
+	handles   map[*PageHandle]struct{} // Unreleased handles; non-nil in debug mode
 }
 
+// JournalMode selects how the pager makes writes crash-safe
+type JournalMode int
+
+const (
+	// JournalModeOff writes dirty pages straight into the database file
+	JournalModeOff JournalMode = iota
+
+	// JournalModeWAL appends dirty pages to a write-ahead log next to the
+	// database and copies them back into the database file on checkpoint
+	JournalModeWAL
+
+	// JournalModeDelete copies original page images into a rollback journal
+	// before overwriting them and deletes the journal on commit
+	JournalModeDelete
+
+	// JournalModeTruncate is JournalModeDelete, but truncates the journal to
+	// zero bytes on commit instead of deleting it
+	JournalModeTruncate
+)
+
+// Options configures a Pager
+type Options struct {
+	// PageSize is the page size used when creating a new database file.
+	// It must be a power of two between common.MinPageSize and
+	// common.MaxPageSize; zero selects common.PageSize. Existing files always
+	// use the page size recorded in their header.
+	PageSize int
+
+	// CacheSize is the maximum number of pages held in memory; zero selects
+	// the default of 100.
+	CacheSize int
+
+	// Replacement selects which cached page is evicted when the cache is
+	// full; the zero value is ReplacementLRU.
+	Replacement Replacement
+
+	// CacheShards splits the cache by page number into shards with a lock
+	// of their own, so that goroutines reading different pages do not wait
+	// for each other. Each shard holds an even share of CacheSize and evicts
+	// on its own. Zero selects one shard per 64 cached pages, up to
+	// GOMAXPROCS.
+	CacheShards int
+
+	// PinTimeout is how long ReadPage, WritePage and GetPage wait for
+	// another goroutine to unpin a page when the cache is full and every
+	// page in it is pinned, before failing with ErrAllPagesPinned; zero
+	// fails immediately. The cache never holds more than CacheSize pages.
+	PinTimeout time.Duration
+
+	// LatchTimeout is how long writes, flushes, commits, rollbacks and
+	// checkpoints wait for another goroutine to release the latch of a page
+	// they change or write out, before failing with ErrPageLatched; zero
+	// fails immediately.
+	LatchTimeout time.Duration
+
+	// JournalMode selects how writes are made crash-safe. A leftover
+	// write-ahead log or hot rollback journal is always recovered on open,
+	// whatever the mode.
+	JournalMode JournalMode
+
+	// WALAutoCheckpoint is the WAL size in frames that triggers a checkpoint
+	// after a commit; zero selects DefaultWALAutoCheckpoint and a negative
+	// value disables automatic checkpoints.
+	WALAutoCheckpoint int
+
+	// BusyTimeout is how long to keep retrying when another process holds a
+	// conflicting lock before failing with ErrDatabaseLocked; zero fails
+	// immediately.
+	BusyTimeout time.Duration
+
+	// LockingMode selects whether locks are released while the pager is idle,
+	// or taken at all. A pager in JournalModeWAL always holds an exclusive
+	// lock. Where the platform has no file locks, LockingModeNormal fails
+	// with vfs.ErrLockingUnsupported.
+	LockingMode LockingMode
+
+	// FS is the storage the database, its log and its journal live on; nil
+	// selects vfs.OS. It is ignored for MemoryPath.
+	FS vfs.FS
+
+	// Compression selects how pages are stored when creating a new database
+	// file. Existing files keep the compression recorded in their header.
+	Compression Compression
+
+	// WriterInterval is how often a background goroutine writes dirty,
+	// unpinned pages out ahead of eviction; zero disables the background
+	// writer. The pages are written as eviction would write them, so nothing
+	// is committed by it.
+	WriterInterval time.Duration
+
+	// WriterDirtyRatio is the fraction of the cache that may be dirty before
+	// the background writer starts writing pages out; zero writes every
+	// dirty page on each run.
+	WriterDirtyRatio float64
+
+	// ReadAhead is the number of pages prefetched in the background once
+	// ReadPage sees sequential reads; zero disables read-ahead. It is
+	// limited to a quarter of CacheSize.
+	ReadAhead int
+
+	// CheckpointInterval is how long the background goroutine lets the
+	// write-ahead log go without a checkpoint in JournalModeWAL; zero leaves
+	// checkpoints to WALAutoCheckpoint and Checkpoint.
+	CheckpointInterval time.Duration
+
+	// OnWriteError is called from the background goroutine when writing
+	// pages or checkpointing has failed several times in a row. The failed
+	// work keeps being retried on later runs.
+	OnWriteError func(error)
+
+	// Key encrypts every page with AES-GCM; it must be 16, 24 or 32 bytes
+	// long to select AES-128, AES-192 or AES-256. A new database file is
+	// created encrypted when a key is given, and an encrypted database can
+	// only be opened with the key it was last rekeyed to.
+	Key []byte
+
+	// TrackChanges creates a new database file whose pages each record the
+	// commit that last wrote them, at the cost of four bytes per page, so
+	// that BackupDelta can copy just the pages changed since an earlier
+	// backup. Existing files keep the layout recorded in their header;
+	// Pager.EnableTrackChanges turns tracking on for one.
+	TrackChanges bool
+
+	// Debug records where every PageHandle was acquired, so that Close can
+	// report the handles that were never released with ErrLeakedPins.
+	Debug bool
+}
+
+// MemoryPath opens a private database that lives only in memory
+// Nothing is ever written to disk and the database is gone once the pager
+// is closed.
+const MemoryPath = ":memory:"
+
 // New creates a new Pager for the given file path
-// If the file doesn't exist, it will be created
+// If the file doesn't exist, it will be created and a header written to page 0.
+// Existing files must carry a valid MashDB header. MemoryPath opens an
+// in-memory database instead.
 func New(filePath string, cacheSize int) (*Pager, error) {
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	return NewWithOptions(filePath, Options{CacheSize: cacheSize})
+}
+
+// NewWithOptions creates a new Pager for the given file path using opts
+func NewWithOptions(filePath string, opts Options) (*Pager, error) {
+	if opts.PageSize == 0 {
+		opts.PageSize = common.PageSize
+	}
+	if !validPageSize(opts.PageSize) {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedPageSize, opts.PageSize)
+	}
+	if opts.Compression > CompressionFlate {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedCodec, opts.Compression)
+	}
+	var pc *pageCipher
+	if opts.Key != nil {
+		var err error
+		if pc, err = newPageCipher(opts.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	if filePath == MemoryPath {
+		// A fresh FS per pager keeps in-memory databases apart
+		opts.FS = vfs.NewMemFS()
+	}
+	if opts.FS == nil {
+		opts.FS = vfs.OS
+	}
+
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = 100 // Default cache size
+	}
+	if opts.CacheShards <= 0 {
+		opts.CacheShards = max(1, min(runtime.GOMAXPROCS(0), opts.CacheSize/minShardPages))
+	}
+	opts.CacheShards = min(opts.CacheShards, opts.CacheSize)
+	policies := make([]ReplacementPolicy, opts.CacheShards)
+	for i := range policies {
+		var err error
+		policies[i], err = NewReplacementPolicy(opts.Replacement, shardCapacity(opts.CacheSize, opts.CacheShards, i))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	files := &fileCounters{}
+	opts.FS = meteredFS{FS: opts.FS, counters: files}
+	file, err := opts.FS.Open(filePath, vfs.OpenCreate)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
+	openSize, err := file.Size()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	if opts.WALAutoCheckpoint == 0 {
+		opts.WALAutoCheckpoint = DefaultWALAutoCheckpoint
+	}
 
-	// Get file size to determine number of existing pages
-	stat, err := file.Stat()
+	p := &Pager{
+		fs:                opts.FS,
+		file:              file,
+		filePath:          filePath,
+		files:             files,
+		openSize:          openSize,
+		flushLatency:      newHistogram(flushBuckets),
+		cache:             NewShardedPageCache(opts.CacheSize, policies),
+		lock:              &fileLock{file: file, mode: opts.LockingMode},
+		lockingMode:       opts.LockingMode,
+		busyTimeout:       opts.BusyTimeout,
+		pinTimeout:        opts.PinTimeout,
+		latchTimeout:      opts.LatchTimeout,
+		journalMode:       opts.JournalMode,
+		walAutoCheckpoint: opts.WALAutoCheckpoint,
+		cipher:            pc,
+	}
+	if opts.Debug {
+		p.handles = make(map[*PageHandle]struct{})
+	}
+	if window := min(opts.ReadAhead, opts.CacheSize/4); window > 0 {
+		p.readAhead = &readAhead{window: uint32(window)}
+	}
+
+	if err = p.acquireLock(LockShared); err == nil {
+		err = p.open(opts)
+	}
+	if err == nil {
+		switch p.journalMode {
+		case JournalModeWAL:
+			// Without a shared-memory index other processes cannot see the
+			// log, so a WAL pager keeps the database to itself
+			if err = p.acquireLock(LockExclusive); err == nil {
+				p.wal, err = openWAL(p.fs, walPath(filePath), p.pageSize)
+			}
+		case JournalModeDelete, JournalModeTruncate:
+			p.journal = newJournal(p.fs, journalPath(filePath), p.pageSize, p.journalMode == JournalModeTruncate)
+		}
+	}
 	if err != nil {
+		p.lock.unlock(LockNone)
 		file.Close()
-		return nil, fmt.Errorf("failed to stat file: %w", err)
+		return nil, err
+	}
+
+	p.releaseLock()
+	p.usable = p.pageSize - p.ReservedBytes()
+	p.owned.Store(p.lockingMode != LockingModeNormal || p.wal != nil)
+	p.startWriter(opts)
+	return p, nil
+}
+
+// removeIfExists removes a file, ignoring a missing one
+func (p *Pager) removeIfExists(path string) error {
+	if err := p.fs.Delete(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// fileSize returns the size of a file next to the database, or zero if it
+// does not exist
+func (p *Pager) fileSize(path string) (int64, error) {
+	file, err := p.fs.Open(path, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.Size()
+}
+
+// open initialises a new database file or brings an existing one back to its
+// last committed state (must hold a SHARED lock)
+// A hot rollback journal is played back first, then the header is loaded
+// and any write-ahead log is replayed.
+func (p *Pager) open(opts Options) error {
+	size, err := p.file.Size()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	if size == 0 {
+		if err := p.acquireLock(LockExclusive); err != nil {
+			return err
+		}
+		// Another process may have initialised the file while we waited
+		if size, err = p.file.Size(); err != nil {
+			return fmt.Errorf("failed to stat file: %w", err)
+		}
+	}
+	if size == 0 {
+		// Any log or journal next to an empty file belongs to a database that is gone
+		if err := p.removeIfExists(walPath(p.filePath)); err != nil {
+			return err
+		}
+		if err := p.removeIfExists(journalPath(p.filePath)); err != nil {
+			return err
+		}
+		return p.initHeader(opts)
+	}
+
+	if err := p.rollbackHotJournal(); err != nil {
+		return err
+	}
+
+	// A checkpoint cut short may have left page 0 torn, so the log is
+	// replayed before the header page is verified. Only the page size is
+	// needed for that, and it is the same in every version of the header.
+	// Compressed pages are found through the page map the header points to.
+	header, err := p.readHeaderPrefix(size)
+	if err != nil {
+		return err
+	}
+	p.pageSize = int(header.PageSize)
+	if header.Compression != CompressionNone {
+		p.store = newSlotStore(p.file, p.pageSize)
+		if err := p.store.load(header); err != nil {
+			return err
+		}
+	}
+	if err := p.recoverWAL(); err != nil {
+		return err
+	}
+
+	if size, err = p.file.Size(); err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	return p.loadHeader(size)
+}
+
+// recoverWAL replays a write-ahead log left behind by an earlier session
+// Committed frames are checkpointed into the database file and the log
+// itself is removed.
+func (p *Pager) recoverWAL() error {
+	if exists, err := p.fs.Exists(walPath(p.filePath)); !exists {
+		return err
+	}
+	if err := p.acquireLock(LockExclusive); err != nil {
+		return err
 	}
 
-	numPages := uint32(stat.Size() / common.PageSize)
+	w, err := openWAL(p.fs, walPath(p.filePath), p.pageSize)
+	if err != nil {
+		return err
+	}
+	if err := p.checkpointWAL(w); err != nil {
+		w.close(false)
+		return err
+	}
+	if err := w.close(true); err != nil {
+		return fmt.Errorf("failed to remove wal: %w", err)
+	}
+	return nil
+}
 
-	if cacheSize <= 0 {
-		cacheSize = 100 // Default cache size
+// initHeader writes the header of a brand new database file
+func (p *Pager) initHeader(opts Options) error {
+	p.header = newHeader(opts.PageSize)
+	p.header.Compression = opts.Compression
+	if p.cipher != nil {
+		p.header.Encryption = EncryptionAESGCM
+		p.header.KeyCheck = p.cipher.check
+	}
+	p.header.PageEpochs = opts.TrackChanges
+	p.header.ReservedBytes = p.header.minReserved()
+	p.pageSize = opts.PageSize
+	if opts.Compression != CompressionNone {
+		p.store = newSlotStore(p.file, opts.PageSize)
 	}
+	p.numPages.Store(p.header.PageCount)
+	if err := p.writeHeader(); err != nil {
+		return err
+	}
+	p.committed = p.header
+	return p.file.Sync()
+}
 
-	return &Pager{
-		file:     file,
-		filePath: filePath,
-		numPages: numPages,
-		cache:    NewLRUCache(cacheSize),
-	}, nil
+// readHeaderPrefix reads and decodes the header fields at the start of page 0
+func (p *Pager) readHeaderPrefix(fileSize int64) (Header, error) {
+	buf := make([]byte, headerSize)
+	if _, err := p.file.ReadAt(buf, 0); err != nil {
+		if fileSize < headerSize {
+			return Header{}, ErrNotADatabase
+		}
+		return Header{}, fmt.Errorf("failed to read header: %w", err)
+	}
+	return decodeHeader(buf)
+}
+
+// readChangeCounter reads the change counter alone from the header on disk
+// The probe runs on every shared lock and is left out of IOStats.
+func (p *Pager) readChangeCounter() (uint32, error) {
+	var buf [4]byte
+	if _, err := p.file.ReadAt(buf[:], offChangeCounter); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(buf[:]), nil
+}
+
+// loadHeader reads and validates the header of an existing database file
+func (p *Pager) loadHeader(fileSize int64) error {
+	header, err := p.readHeaderPrefix(fileSize)
+	if err != nil {
+		return err
+	}
+	if err := p.checkKey(header); err != nil {
+		return err
+	}
+	p.header = header
+	p.committed = header
+	p.pageSize = int(header.PageSize)
+	p.free = nil
+
+	// Now that the page size is known, verify the whole header page
+	if err := p.readPageFromDisk(common.HeaderPageNum, make([]byte, p.pageSize)); err != nil {
+		return err
+	}
+
+	p.numPages.Store(header.PageCount)
+	if p.store != nil {
+		return p.store.load(header)
+	}
+
+	// Pages evicted after the last header write may extend past the recorded count
+	if filePages := uint32(fileSize / int64(p.pageSize)); filePages > p.numPages.Load() {
+		p.numPages.Store(filePages)
+	}
+	return nil
+}
+
+// writeHeader writes the header page to disk (must hold lock)
+func (p *Pager) writeHeader() error {
+	if err := p.writePageToDisk(common.HeaderPageNum, p.headerPage()); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	return nil
+}
+
+// headerPage returns the current header encoded as a full page (must hold lock)
+func (p *Pager) headerPage() []byte {
+	p.header.PageCount = p.numPages.Load()
+	buf := make([]byte, p.pageSize)
+	p.header.encode(buf)
+	return buf
 }
 
 // NumPages returns the total number of pages in the file
 func (p *Pager) NumPages() uint32 {
+	if p.lockHeld() {
+		// Nobody else can have changed the file
+		return p.numPages.Load()
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	return p.numPages
+	p.refresh()
+	return p.numPages.Load()
 }
 
 // ReadPage reads a page from disk or cache and pins it
-// Caller must call UnpinPage when done with the page
+// Caller must call UnpinPage when done with the page, or use Acquire
+// instead. If the cache is full and every page in it is pinned, ReadPage
+// waits up to Options.PinTimeout for one to be unpinned before failing with
+// ErrAllPagesPinned.
 func (p *Pager) ReadPage(pageNum uint32) (*Page, error) {
+	return p.readPage(nil, pageNum)
+}
+
+// ReadPageContext is ReadPage, but waits for a pinned page to be unpinned
+// for as long as ctx allows instead of Options.PinTimeout
+func (p *Pager) ReadPageContext(ctx context.Context, pageNum uint32) (*Page, error) {
+	return p.readPage(ctx, pageNum)
+}
+
+// readPage implements ReadPage and ReadPageContext
+func (p *Pager) readPage(ctx context.Context, pageNum uint32) (*Page, error) {
+	page := p.pinCached(pageNum)
+	if page == nil {
+		var err error
+		if page, err = p.readPageLocked(ctx, pageNum); err != nil {
+			return nil, err
+		}
+	}
+	if p.readAhead != nil {
+		p.noteRead(pageNum)
+	}
+	return page, nil
+}
+
+// readPageLocked is the part of readPage that takes the pager's lock
+func (p *Pager) readPageLocked(ctx context.Context, pageNum uint32) (*Page, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if p.closed {
-		return nil, ErrFileClosed
-	}
+	var page *Page
+	err := p.retryPinned(ctx, func() error {
+		if p.closed.Load() {
+			return ErrFileClosed
+		}
 
-	if pageNum >= common.MaxPages {
-		return nil, ErrPageOutOfBounds
-	}
+		if pageNum == common.HeaderPageNum {
+			return ErrReservedPage
+		}
+
+		if pageNum >= common.MaxPages {
+			return ErrPageOutOfBounds
+		}
+
+		if err := p.lockShared(); err != nil {
+			return err
+		}
+		defer p.releaseLock()
 
+		var err error
+		page, err = p.readPageInternal(pageNum)
+		return err
+	})
+	return page, err
+}
+
+// readPageInternal returns a pinned page from cache or disk (must hold lock)
+func (p *Pager) readPageInternal(pageNum uint32) (*Page, error) {
 	// Check cache first
-	if page := p.cache.Get(pageNum); page != nil {
-		page.PinCnt++
+	if page := p.cache.GetPinned(pageNum); page != nil {
+		p.pinned.Add(1)
 		return page, nil
 	}
 
 	// Page not in cache, read from disk
-	page := NewPage()
+	page := newPage(p.pageSize)
 	page.PinCnt = 1
 
 	// If page exists in file, read it
-	if pageNum < p.numPages {
-		offset := int64(pageNum) * common.PageSize
-		n, err := p.file.ReadAt(page.Data[:], offset)
-		if err != nil && n != common.PageSize {
-			return nil, fmt.Errorf("failed to read page %d: %w", pageNum, err)
+	// If page doesn't exist yet, it's a new page (zeroed out)
+	if pageNum < p.numPages.Load() {
+		if err := p.readPageFromDisk(pageNum, page.Data); err != nil {
+			return nil, err
 		}
 	}
-	// If page doesn't exist yet, it's a new page (zeroed out)
 
-	// Add to cache, handle eviction
-	if evicted := p.cache.Put(pageNum, page); evicted != nil {
-		if evicted.Page.Dirty {
-			if err := p.flushPageInternal(evicted.PageNum, evicted.Page); err != nil {
-				// Log error but continue - page is already evicted
-				fmt.Printf("warning: failed to flush evicted page %d: %v\n", evicted.PageNum, err)
-			}
-		}
+	if err := p.cachePage(pageNum, page); err != nil {
+		return nil, err
 	}
 
+	p.pinned.Add(1)
 	return page, nil
 }
 
+// cachePage adds a page to the cache and writes out the dirty page it evicts
+// (must hold lock). Should that write fail, the evicted page is put back and
+// the new one is not cached, so no change is ever lost.
+func (p *Pager) cachePage(pageNum uint32, page *Page) error {
+	evicted, err := p.cache.Put(pageNum, page)
+	if err != nil || evicted == nil || !evicted.Page.Dirty {
+		return err
+	}
+
+	if p.writer != nil {
+		// Eviction should not have had to write; catch up in the background
+		p.writer.nudge()
+	}
+	if err := p.flushPageInternal(evicted.PageNum, evicted.Page); err != nil {
+		p.cache.Remove(pageNum)
+		p.cache.Put(evicted.PageNum, evicted.Page)
+		return fmt.Errorf("failed to write evicted page %d: %w", evicted.PageNum, err)
+	}
+	return nil
+}
+
 // WritePage writes data to a page (creates if doesn't exist)
-// The page is marked dirty and will be flushed on Flush() or eviction
+// The page is marked dirty and will be flushed on Flush() or eviction. Like
+// ReadPage, it waits up to Options.PinTimeout for room in a cache full of
+// pinned pages, and up to Options.LatchTimeout for another goroutine to
+// release the page's latch.
 func (p *Pager) WritePage(pageNum uint32, data []byte) error {
+	return p.writePage(nil, pageNum, data)
+}
+
+// WritePageContext is WritePage, but waits for a pinned page to be unpinned
+// or a latched one to be released for as long as ctx allows instead of
+// Options.PinTimeout and Options.LatchTimeout
+func (p *Pager) WritePageContext(ctx context.Context, pageNum uint32, data []byte) error {
+	return p.writePage(ctx, pageNum, data)
+}
+
+// writePage implements WritePage and WritePageContext
+func (p *Pager) writePage(ctx context.Context, pageNum uint32, data []byte) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if p.closed {
-		return ErrFileClosed
-	}
+	return p.retryLatched(ctx, func() error {
+		return p.retryPinned(ctx, func() error {
+			if p.closed.Load() {
+				return ErrFileClosed
+			}
 
-	if len(data) != common.PageSize {
-		return ErrInvalidPageSize
-	}
+			if len(data) != p.pageSize {
+				return ErrInvalidPageSize
+			}
 
-	if pageNum >= common.MaxPages {
-		return ErrPageOutOfBounds
-	}
+			if pageNum == common.HeaderPageNum {
+				return ErrReservedPage
+			}
 
+			if pageNum >= common.MaxPages {
+				return ErrPageOutOfBounds
+			}
+
+			if err := p.lockReserved(); err != nil {
+				return err
+			}
+			defer p.releaseLock()
+
+			return p.writePageInternal(pageNum, data)
+		})
+	})
+}
+
+// writePageInternal copies data into the cached page and marks it dirty (must hold lock)
+func (p *Pager) writePageInternal(pageNum uint32, data []byte) error {
 	// Check if page is in cache
 	page := p.cache.Get(pageNum)
 	if page == nil {
 		// Create new page
-		page = NewPage()
-		if evicted := p.cache.Put(pageNum, page); evicted != nil {
-			if evicted.Page.Dirty {
-				if err := p.flushPageInternal(evicted.PageNum, evicted.Page); err != nil {
-					return fmt.Errorf("failed to flush evicted page: %w", err)
-				}
-			}
+		page = newPage(p.pageSize)
+		if err := p.cachePage(pageNum, page); err != nil {
+			return err
 		}
 	}
 
-	copy(page.Data[:], data)
+	if !page.latch.TryLock() {
+		return &latchedError{pageNum: pageNum, page: page, exclusive: true}
+	}
+	copy(page.Data, data)
+	page.latch.Unlock()
 	page.Dirty = true
+	p.dirty = true
 
 	// Extend file tracking if necessary
-	if pageNum >= p.numPages {
-		p.numPages = pageNum + 1
+	if old := p.numPages.Load(); pageNum >= old {
+		p.numPages.Store(pageNum + 1)
+		return p.zeroStale(old, pageNum)
 	}
 
 	return nil
 }
 
 // GetPage returns a page for modification (creates if doesn't exist)
-// The page is pinned - caller must call UnpinPage when done
+// The page is pinned - caller must call UnpinPage when done, or use
+// AcquireForWrite instead. Unlike ReadPage it takes the RESERVED lock,
+// which is held until the changes are flushed. Like ReadPage, it waits up to
+// Options.PinTimeout for room in a cache full of pinned pages.
 func (p *Pager) GetPage(pageNum uint32) (*Page, error) {
-	return p.ReadPage(pageNum)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var page *Page
+	err := p.retryPinned(nil, func() error {
+		if p.closed.Load() {
+			return ErrFileClosed
+		}
+
+		if pageNum == common.HeaderPageNum {
+			return ErrReservedPage
+		}
+
+		if pageNum >= common.MaxPages {
+			return ErrPageOutOfBounds
+		}
+
+		if err := p.lockReserved(); err != nil {
+			return err
+		}
+		var err error
+		if page, err = p.readPageInternal(pageNum); err != nil {
+			p.releaseLock()
+			return err
+		}
+		p.dirty = true
+		return nil
+	})
+	return page, err
 }
 
 // UnpinPage decrements the pin count for a page
 // If dirty is true, marks the page as dirty
 func (p *Pager) UnpinPage(pageNum uint32, dirty bool) {
+	if !dirty {
+		if dropped, last := p.cache.Unpin(pageNum); dropped {
+			p.dropPin(last)
+		}
+		return
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	p.unpinPageInternal(pageNum, dirty)
+	p.releaseLock()
+}
 
-	if page := p.cache.Get(pageNum); page != nil {
-		if page.PinCnt > 0 {
-			page.PinCnt--
+// unpinPageInternal decrements the pin count for a page (must hold lock)
+func (p *Pager) unpinPageInternal(pageNum uint32, dirty bool) {
+	if dirty && p.cache.MarkDirty(pageNum) {
+		p.dirty = true
+	}
+	if dropped, last := p.cache.Unpin(pageNum); dropped {
+		p.pinned.Add(-1)
+		if last {
+			p.notifyUnpinned()
 		}
-		if dirty {
-			page.Dirty = true
+	}
+}
+
+// pinCached pins a cached page without taking the pager's lock, or returns
+// nil if that is not possible
+// Pins keep the SHARED lock on the file, so no other process can change a
+// page while any page is pinned. Another pin can therefore only be counted
+// without the lock while at least one is outstanding, or when the file lock
+// is held for good anyway.
+func (p *Pager) pinCached(pageNum uint32) *Page {
+	if p.closed.Load() {
+		return nil
+	}
+	for {
+		n := p.pinned.Load()
+		if n == 0 && !p.owned.Load() {
+			return nil
 		}
+		if p.pinned.CompareAndSwap(n, n+1) {
+			break
+		}
+	}
+	page := p.cache.TryPin(pageNum)
+	if page == nil {
+		p.dropPin(false)
+	}
+	return page
+}
+
+// dropPin uncounts a pin whose page was already unpinned in the cache
+// The last pin may have to give up the file lock and, if it was the last
+// pin on its page, goroutines waiting for an unpinned page are woken; both
+// need the pager's lock.
+func (p *Pager) dropPin(last bool) {
+	if !last || p.pinWaiters.Load() == 0 {
+		for {
+			n := p.pinned.Load()
+			if n <= 1 && !p.owned.Load() {
+				break
+			}
+			if p.pinned.CompareAndSwap(n, n-1) {
+				return
+			}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pinned.Add(-1)
+	if last {
+		p.notifyUnpinned()
+	}
+	p.releaseLock()
+}
+
+// lockHeld reports whether the file lock is known to be held without taking
+// the pager's lock
+func (p *Pager) lockHeld() bool {
+	return !p.closed.Load() && (p.owned.Load() || p.pinned.Load() > 0)
+}
+
+// retryPinned runs op until it stops failing with ErrAllPagesPinned, waiting
+// for a page to be unpinned in between (must hold lock)
+// The lock is released while waiting, so op must check the pager's state
+// afresh each time. A nil ctx waits for up to the pin timeout.
+func (p *Pager) retryPinned(ctx context.Context, op func() error) error {
+	waiting := false
+	defer func() {
+		if waiting {
+			p.pinWaiters.Add(-1)
+		}
+	}()
+
+	for {
+		err := op()
+		if !errors.Is(err, ErrAllPagesPinned) {
+			return err
+		}
+		if !waiting {
+			if ctx == nil {
+				if p.pinTimeout <= 0 {
+					return err
+				}
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(context.Background(), p.pinTimeout)
+				defer cancel()
+			}
+
+			// Pages unpinned from now on notify under the lock. One may have
+			// been unpinned without it just before, so look again first.
+			p.pinWaiters.Add(1)
+			waiting = true
+			continue
+		}
+
+		if p.unpinned == nil {
+			p.unpinned = make(chan struct{})
+		}
+		unpinned := p.unpinned
+		p.mu.Unlock()
+		select {
+		case <-unpinned:
+			p.mu.Lock()
+		case <-ctx.Done():
+			p.mu.Lock()
+			return fmt.Errorf("%w: %w", ErrAllPagesPinned, context.Cause(ctx))
+		}
+	}
+}
+
+// notifyUnpinned wakes every goroutine waiting in retryPinned (must hold lock)
+func (p *Pager) notifyUnpinned() {
+	if p.unpinned != nil {
+		close(p.unpinned)
+		p.unpinned = nil
 	}
 }
 
 // Flush writes all dirty pages to disk
+// Inside a transaction the pages are written out without committing; they
+// are still undone by Tx.Rollback.
 func (p *Pager) Flush() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if p.closed {
-		return ErrFileClosed
-	}
+	return p.retryLatched(nil, func() error {
+		if p.closed.Load() {
+			return ErrFileClosed
+		}
+		defer p.releaseLock()
 
-	return p.flushAllInternal()
+		if p.tx != nil {
+			return p.flushPages(p.sortedDirty())
+		}
+
+		return p.flushAllInternal()
+	})
 }
 
-// flushAllInternal flushes all dirty pages (must hold lock)
+// flushAllInternal flushes all dirty pages and the header (must hold lock)
+// In WAL mode this commits a transaction to the log; in the rollback journal
+// modes every original image is journaled and synced up front, and the
+// transaction commits when the journal is finished.
 func (p *Pager) flushAllInternal() error {
-	dirtyPages := p.cache.GetAllDirty()
-	for _, entry := range dirtyPages {
-		if err := p.flushPageInternal(entry.PageNum, entry.Page); err != nil {
+	defer p.flushLatency.observe(time.Now())
+
+	dirtyPages := p.sortedDirty()
+	if p.wal != nil {
+		if err := p.flushPages(dirtyPages); err != nil {
 			return err
 		}
+		if err := p.commitWAL(); err != nil {
+			return err
+		}
+		p.dirty = false
+		return nil
 	}
-	return p.file.Sync()
+
+	// Pages evicted outside a transaction may have reached the file
+	// already; other pagers only notice them through the change counter
+	header := p.header
+	header.PageCount = p.numPages.Load()
+	if len(dirtyPages) == 0 && !p.spilled && header == p.committed &&
+		(p.journal == nil || !p.journal.active()) && (p.store == nil || !p.store.changed) {
+		p.dirty = false
+		return nil
+	}
+	p.header.ChangeCounter++
+
+	if p.journal != nil {
+		if err := p.journalOriginal(common.HeaderPageNum); err != nil {
+			return err
+		}
+		// Compressed pages never overwrite committed records, so only the
+		// header needs its original saved
+		if p.store == nil {
+			for _, entry := range dirtyPages {
+				if err := p.journalOriginal(entry.PageNum); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := p.flushPages(dirtyPages); err != nil {
+		return err
+	}
+	if p.store != nil {
+		if err := p.writePageMap(); err != nil {
+			return err
+		}
+	}
+	if err := p.writeHeader(); err != nil {
+		return err
+	}
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+	if p.journal != nil {
+		if err := p.journal.finish(); err != nil {
+			return err
+		}
+	}
+	if p.store != nil {
+		if err := p.store.commit(); err != nil {
+			return err
+		}
+	}
+	p.committed = p.header
+	p.dirty = false
+	p.spilled = false
+	return nil
 }
 
 // FlushPage writes a specific page to disk if dirty
@@ -209,53 +1018,293 @@ func (p *Pager) FlushPage(pageNum uint32) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if p.closed {
-		return ErrFileClosed
+	return p.retryLatched(nil, func() error {
+		if p.closed.Load() {
+			return ErrFileClosed
+		}
+
+		page := p.cache.Peek(pageNum)
+		if page == nil || !page.Dirty {
+			return nil
+		}
+
+		return p.flushPageInternal(pageNum, page)
+	})
+}
+
+// flushPageInternal writes a page to disk (must hold lock)
+// A page latched exclusively is being changed and fails with ErrPageLatched.
+func (p *Pager) flushPageInternal(pageNum uint32, page *Page) error {
+	if !page.latch.TryRLock() {
+		return &latchedError{pageNum: pageNum, page: page}
 	}
+	defer page.latch.RUnlock()
 
-	page := p.cache.Get(pageNum)
-	if page == nil || !page.Dirty {
+	if err := p.writePageToDisk(pageNum, page.Data); err != nil {
+		return err
+	}
+	page.Dirty = false
+	return nil
+}
+
+// fillHoles writes sealed pages of zeroes from the end of the database file
+// up to pageNum, so that writing pageNum leaves no page inside the file that
+// reads as zeroes (must hold lock and EXCLUSIVE)
+// The pages are journaled like any page written in a transaction.
+func (p *Pager) fillHoles(pageNum uint32) error {
+	size, err := p.file.Size()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	first := uint32((size + int64(p.pageSize) - 1) / int64(p.pageSize))
+	if first >= pageNum {
 		return nil
 	}
 
-	return p.flushPageInternal(pageNum, page)
+	if p.journal != nil {
+		for hole := first; hole < pageNum; hole++ {
+			if err := p.journalOriginal(hole); err != nil {
+				return err
+			}
+		}
+		if err := p.journal.sync(); err != nil {
+			return err
+		}
+	}
+	// The holes go out in a single write
+	buf := make([]byte, int(pageNum-first)*p.pageSize)
+	for hole := first; hole < pageNum; hole++ {
+		if p.tx != nil {
+			p.tx.written[hole] = true
+		}
+		image := buf[int(hole-first)*p.pageSize:][:p.pageSize]
+		p.sealInto(hole, image, image)
+	}
+	if _, err := p.file.WriteAt(buf, p.pageOffset(first)); err != nil {
+		return fmt.Errorf("failed to write pages %d-%d: %w", first, pageNum-1, err)
+	}
+	p.spilled = true
+	p.io.Writes++
+	p.io.PagesWritten += uint64(pageNum - first)
+	return nil
 }
 
-// flushPageInternal writes a page to disk (must hold lock)
-func (p *Pager) flushPageInternal(pageNum uint32, page *Page) error {
-	offset := int64(pageNum) * common.PageSize
-	_, err := p.file.WriteAt(page.Data[:], offset)
+// readPageFromDisk reads a page into buf, verified and decrypted (must hold lock)
+func (p *Pager) readPageFromDisk(pageNum uint32, buf []byte) error {
+	if err := p.readPageImage(pageNum, buf); err != nil {
+		return err
+	}
+	// Zeroes from readPageImage are a page never written
+	if p.isEncryptedPage(pageNum) && !allZero(buf) {
+		return p.cipher.open(pageNum, buf)
+	}
+	return nil
+}
+
+// readPageImage reads the on-disk image of a page into buf and verifies its
+// checksum (must hold lock)
+// The write-ahead log takes precedence over the database file. Pages
+// allocated but never written past the end of the file, or without a record
+// in a compressed database, read as zeroes; inside the file a page of zeroes
+// is corrupt, as every page there is sealed.
+func (p *Pager) readPageImage(pageNum uint32, buf []byte) error {
+	p.io.Reads++
+	p.io.PagesRead++
+	if p.wal != nil {
+		found, err := p.wal.readPage(pageNum, buf)
+		if err != nil {
+			return err
+		}
+		if found {
+			return p.verifyPage(pageNum, buf)
+		}
+	}
+
+	if p.store != nil && pageNum != common.HeaderPageNum {
+		found, err := p.store.read(pageNum, buf)
+		if err != nil {
+			return err
+		}
+		if !found {
+			clear(buf)
+			return nil
+		}
+		return p.verifyPage(pageNum, buf)
+	}
+
+	n, err := p.file.ReadAt(buf, p.pageOffset(pageNum))
+	if err != nil && n != p.pageSize && err != io.EOF {
+		return fmt.Errorf("failed to read page %d: %w", pageNum, err)
+	}
+	clear(buf[n:])
+	if n < p.pageSize && allZero(buf) {
+		return nil
+	}
+	return p.verifyPage(pageNum, buf)
+}
+
+// writePageToDisk seals a page image and writes it to the file (must hold lock)
+// In WAL mode the image is appended to the log instead.
+func (p *Pager) writePageToDisk(pageNum uint32, data []byte) error {
+	if p.tx != nil {
+		p.tx.written[pageNum] = true
+	}
+
+	if p.wal != nil {
+		if err := p.wal.appendFrame(pageNum, p.sealPage(pageNum, data), 0); err != nil {
+			return err
+		}
+		p.countWrite()
+		return nil
+	}
+
+	if p.store != nil && pageNum != common.HeaderPageNum {
+		if err := p.acquireLock(LockExclusive); err != nil {
+			return err
+		}
+		if err := p.store.write(pageNum, p.sealPage(pageNum, data)); err != nil {
+			return err
+		}
+		p.countWrite()
+		return nil
+	}
+
+	if p.journal != nil {
+		if err := p.journalOriginal(pageNum); err != nil {
+			return err
+		}
+		if err := p.journal.sync(); err != nil {
+			return err
+		}
+	}
+
+	if err := p.acquireLock(LockExclusive); err != nil {
+		return err
+	}
+	if err := p.fillHoles(pageNum); err != nil {
+		return err
+	}
+
+	_, err := p.file.WriteAt(p.sealPage(pageNum, data), p.pageOffset(pageNum))
 	if err != nil {
 		return fmt.Errorf("failed to write page %d: %w", pageNum, err)
 	}
-	page.Dirty = false
+	if pageNum != common.HeaderPageNum {
+		p.spilled = true
+	}
+	p.countWrite()
 	return nil
 }
 
-// AllocatePage returns the next available page number
-func (p *Pager) AllocatePage() uint32 {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	pageNum := p.numPages
-	p.numPages++
-	return pageNum
+// countWrite records a single page image written (must hold lock)
+func (p *Pager) countWrite() {
+	p.io.Writes++
+	p.io.PagesWritten++
 }
 
 // Close flushes all pages and closes the file
+// The background writer is stopped and read-ahead finished first. An active
+// transaction is rolled back. In WAL mode the log is checkpointed and
+// removed. In debug mode the pager is closed even if page handles are still
+// held, but ErrLeakedPins reports where they were acquired.
 func (p *Pager) Close() error {
+	if p.writer != nil {
+		p.writer.close()
+	}
+	if p.readAhead != nil {
+		p.readAhead.wg.Wait()
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if p.closed {
+	if p.closed.Load() {
 		return nil
 	}
 
+	if p.tx != nil {
+		if err := p.rollbackInternal(); err != nil {
+			return err
+		}
+	}
+
 	if err := p.flushAllInternal(); err != nil {
 		return err
 	}
 
-	p.closed = true
-	return p.file.Close()
+	if p.wal != nil {
+		if err := p.checkpointWAL(p.wal); err != nil {
+			return err
+		}
+		if err := p.wal.close(true); err != nil {
+			return fmt.Errorf("failed to remove wal: %w", err)
+		}
+		p.wal = nil
+	}
+
+	p.closed.Store(true)
+	p.notifyUnpinned()
+	p.lock.unlock(LockNone)
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	return p.leakedPins()
+}
+
+// Header returns a copy of the current database header
+func (p *Pager) Header() Header {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refresh()
+	h := p.header
+	h.PageCount = p.numPages.Load()
+	return h
+}
+
+// SchemaCookie returns the schema cookie stored in the header
+func (p *Pager) SchemaCookie() uint32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refresh()
+	return p.header.SchemaCookie
+}
+
+// SetSchemaCookie updates the schema cookie
+// The new value is written to disk on the next Flush or Close
+func (p *Pager) SetSchemaCookie(cookie uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed.Load() {
+		return ErrFileClosed
+	}
+
+	if err := p.lockReserved(); err != nil {
+		return err
+	}
+	p.header.SchemaCookie = cookie
+	p.dirty = true
+	return nil
+}
+
+// pageOffset returns the file offset of a page
+func (p *Pager) pageOffset(pageNum uint32) int64 {
+	return int64(pageNum) * int64(p.pageSize)
+}
+
+// PageSize returns the page size of the database in bytes
+func (p *Pager) PageSize() int {
+	return p.pageSize
+}
+
+// ReservedBytes returns the number of bytes at the end of each page owned by the pager
+func (p *Pager) ReservedBytes() int {
+	return int(p.header.ReservedBytes)
+}
+
+// UsableSize returns the number of bytes per page available to callers
+func (p *Pager) UsableSize() int {
+	return p.usable
 }
 
 // FilePath returns the path to the database file
@@ -264,6 +1313,7 @@ func (p *Pager) FilePath() string {
 }
 
 // CacheStats returns cache hit/miss statistics
+// Metrics reports these along with the rest of the pager's counters.
 func (p *Pager) CacheStats() (hits, misses uint64, hitRate float64) {
 	hits, misses = p.cache.Stats()
 	hitRate = p.cache.HitRate()
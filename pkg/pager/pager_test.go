@@ -1,11 +1,21 @@
 package pager
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"mash-db/internal/common"
+	"mash-db/pkg/vfs"
 )
 
 func TestNewPager(t *testing.T) {
@@ -18,8 +28,9 @@ func TestNewPager(t *testing.T) {
 	}
 	defer p.Close()
 
-	if p.NumPages() != 0 {
-		t.Errorf("Expected 0 pages, got %d", p.NumPages())
+	// A new database only contains the header page
+	if p.NumPages() != 1 {
+		t.Errorf("Expected 1 page, got %d", p.NumPages())
 	}
 
 	if p.FilePath() != dbPath {
@@ -40,7 +51,7 @@ func TestWriteAndReadPage(t *testing.T) {
 	testData := make([]byte, common.PageSize)
 	copy(testData, []byte("Hello, MashDB!"))
 
-	err = p.WritePage(0, testData)
+	err = p.WritePage(1, testData)
 	if err != nil {
 		t.Fatalf("Failed to write page: %v", err)
 	}
@@ -60,11 +71,11 @@ func TestWriteAndReadPage(t *testing.T) {
 	}
 	defer p2.Close()
 
-	if p2.NumPages() != 1 {
-		t.Errorf("Expected 1 page, got %d", p2.NumPages())
+	if p2.NumPages() != 2 {
+		t.Errorf("Expected 2 pages, got %d", p2.NumPages())
 	}
 
-	page, err := p2.ReadPage(0)
+	page, err := p2.ReadPage(1)
 	if err != nil {
 		t.Fatalf("Failed to read page: %v", err)
 	}
@@ -85,7 +96,7 @@ func TestMultiplePages(t *testing.T) {
 	defer p.Close()
 
 	// Write multiple pages
-	for i := uint32(0); i < 5; i++ {
+	for i := uint32(1); i <= 5; i++ {
 		data := make([]byte, common.PageSize)
 		data[0] = byte(i)
 		err = p.WritePage(i, data)
@@ -99,12 +110,12 @@ func TestMultiplePages(t *testing.T) {
 		t.Fatalf("Failed to flush: %v", err)
 	}
 
-	if p.NumPages() != 5 {
-		t.Errorf("Expected 5 pages, got %d", p.NumPages())
+	if p.NumPages() != 6 {
+		t.Errorf("Expected 6 pages, got %d", p.NumPages())
 	}
 
 	// Verify each page
-	for i := uint32(0); i < 5; i++ {
+	for i := uint32(1); i <= 5; i++ {
 		page, err := p.ReadPage(i)
 		if err != nil {
 			t.Fatalf("Failed to read page %d: %v", i, err)
@@ -125,16 +136,22 @@ func TestAllocatePage(t *testing.T) {
 	}
 	defer p.Close()
 
-	page0 := p.AllocatePage()
-	page1 := p.AllocatePage()
-	page2 := p.AllocatePage()
+	// Page 0 holds the header, so allocation starts at page 1
+	var pages [3]uint32
+	for i := range pages {
+		pages[i], err = p.AllocatePage()
+		if err != nil {
+			t.Fatalf("Failed to allocate page: %v", err)
+		}
+	}
+	page1, page2, page3 := pages[0], pages[1], pages[2]
 
-	if page0 != 0 || page1 != 1 || page2 != 2 {
-		t.Errorf("Expected pages 0,1,2 got %d,%d,%d", page0, page1, page2)
+	if page1 != 1 || page2 != 2 || page3 != 3 {
+		t.Errorf("Expected pages 1,2,3 got %d,%d,%d", page1, page2, page3)
 	}
 
-	if p.NumPages() != 3 {
-		t.Errorf("Expected 3 pages, got %d", p.NumPages())
+	if p.NumPages() != 4 {
+		t.Errorf("Expected 4 pages, got %d", p.NumPages())
 	}
 }
 
@@ -150,7 +167,7 @@ func TestCacheEviction(t *testing.T) {
 	defer p.Close()
 
 	// Write more pages than cache can hold
-	for i := uint32(0); i < 10; i++ {
+	for i := uint32(1); i <= 10; i++ {
 		data := make([]byte, common.PageSize)
 		data[0] = byte(i)
 		err = p.WritePage(i, data)
@@ -167,7 +184,7 @@ func TestCacheEviction(t *testing.T) {
 	}
 
 	// All pages should still be readable
-	for i := uint32(0); i < 10; i++ {
+	for i := uint32(1); i <= 10; i++ {
 		page, err := p.ReadPage(i)
 		if err != nil {
 			t.Fatalf("Failed to read page %d: %v", i, err)
@@ -179,6 +196,90 @@ func TestCacheEviction(t *testing.T) {
 	}
 }
 
+func TestAllPagesPinned(t *testing.T) {
+	p, err := New(filepath.Join(t.TempDir(), "test.db"), 2)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	for i := uint32(1); i <= 2; i++ {
+		if _, err := p.ReadPage(i); err != nil {
+			t.Fatalf("Failed to read page %d: %v", i, err)
+		}
+	}
+
+	if _, err := p.ReadPage(3); !errors.Is(err, ErrAllPagesPinned) {
+		t.Errorf("ReadPage: expected ErrAllPagesPinned, got %v", err)
+	}
+	if _, err := p.GetPage(3); !errors.Is(err, ErrAllPagesPinned) {
+		t.Errorf("GetPage: expected ErrAllPagesPinned, got %v", err)
+	}
+	if err := p.WritePage(3, make([]byte, p.PageSize())); !errors.Is(err, ErrAllPagesPinned) {
+		t.Errorf("WritePage: expected ErrAllPagesPinned, got %v", err)
+	}
+	if p.CacheSize() != 2 {
+		t.Errorf("Expected the cache to stay at 2 pages, got %d", p.CacheSize())
+	}
+
+	// Pages already cached are still served
+	if _, err := p.ReadPage(1); err != nil {
+		t.Errorf("Failed to read cached page: %v", err)
+	}
+	p.UnpinPage(1, false)
+	p.UnpinPage(1, false)
+	p.UnpinPage(2, false)
+}
+
+func TestPinTimeout_WaitsForUnpin(t *testing.T) {
+	p, err := NewWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{CacheSize: 1, PinTimeout: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	if _, err := p.ReadPage(1); err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		p.UnpinPage(1, false)
+	}()
+
+	start := time.Now()
+	if _, err := p.ReadPage(2); err != nil {
+		t.Fatalf("Expected ReadPage to wait for the unpin, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("ReadPage returned after %v, before the page was unpinned", elapsed)
+	}
+	p.UnpinPage(2, false)
+}
+
+func TestReadPageContext_Deadline(t *testing.T) {
+	p, err := NewWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{CacheSize: 1, PinTimeout: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	if _, err := p.ReadPage(1); err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	defer p.UnpinPage(1, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = p.ReadPageContext(ctx, 2)
+	if !errors.Is(err, ErrAllPagesPinned) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected ErrAllPagesPinned and DeadlineExceeded, got %v", err)
+	}
+	err = p.WritePageContext(ctx, 2, make([]byte, p.PageSize()))
+	if !errors.Is(err, ErrAllPagesPinned) {
+		t.Errorf("Expected ErrAllPagesPinned, got %v", err)
+	}
+}
+
 func TestPageOutOfBounds(t *testing.T) {
 	tmpDir := t.TempDir()
 	dbPath := filepath.Join(tmpDir, "test.db")
@@ -205,7 +306,7 @@ func TestInvalidPageSize(t *testing.T) {
 	}
 	defer p.Close()
 
-	err = p.WritePage(0, []byte("too small"))
+	err = p.WritePage(1, []byte("too small"))
 	if err != ErrInvalidPageSize {
 		t.Errorf("Expected ErrInvalidPageSize, got %v", err)
 	}
@@ -223,7 +324,7 @@ func TestPersistence(t *testing.T) {
 
 	data := make([]byte, common.PageSize)
 	copy(data, []byte("Persistent data"))
-	p.WritePage(0, data)
+	p.WritePage(1, data)
 	p.Flush()
 	p.Close()
 
@@ -233,8 +334,9 @@ func TestPersistence(t *testing.T) {
 		t.Fatalf("Database file not found: %v", err)
 	}
 
-	if info.Size() != common.PageSize {
-		t.Errorf("Expected file size %d, got %d", common.PageSize, info.Size())
+	// Header page plus one data page
+	if info.Size() != 2*common.PageSize {
+		t.Errorf("Expected file size %d, got %d", 2*common.PageSize, info.Size())
 	}
 
 	// Reopen and verify
@@ -244,8 +346,304 @@ func TestPersistence(t *testing.T) {
 	}
 	defer p2.Close()
 
-	page, _ := p2.ReadPage(0)
+	page, _ := p2.ReadPage(1)
 	if string(page.Data[:15]) != "Persistent data" {
 		t.Errorf("Data not persisted correctly")
 	}
 }
+
+func TestConfigurablePageSize(t *testing.T) {
+	for _, size := range []int{common.MinPageSize, 1024, 16384, common.MaxPageSize} {
+		tmpDir := t.TempDir()
+		dbPath := filepath.Join(tmpDir, "test.db")
+
+		p, err := NewWithOptions(dbPath, Options{PageSize: size, CacheSize: 4})
+		if err != nil {
+			t.Fatalf("Failed to create pager with page size %d: %v", size, err)
+		}
+		if p.PageSize() != size {
+			t.Errorf("Expected page size %d, got %d", size, p.PageSize())
+		}
+
+		// Page size must match the pager, not the default
+		if size != common.PageSize {
+			if err := p.WritePage(1, make([]byte, common.PageSize)); err != ErrInvalidPageSize {
+				t.Errorf("Expected ErrInvalidPageSize, got %v", err)
+			}
+		}
+
+		last := p.UsableSize() - 1
+		for i := uint32(1); i <= 8; i++ {
+			data := make([]byte, size)
+			data[0] = byte(i)
+			data[last] = byte(i)
+			if err := p.WritePage(i, data); err != nil {
+				t.Fatalf("Failed to write page %d: %v", i, err)
+			}
+			p.UnpinPage(i, false)
+		}
+		p.Close()
+
+		info, _ := os.Stat(dbPath)
+		if info.Size() != int64(9*size) {
+			t.Errorf("Expected file size %d, got %d", 9*size, info.Size())
+		}
+
+		// Reopen without options: the page size comes from the header
+		p2, err := New(dbPath, 4)
+		if err != nil {
+			t.Fatalf("Failed to reopen pager: %v", err)
+		}
+		if p2.PageSize() != size {
+			t.Errorf("Expected page size %d after reopen, got %d", size, p2.PageSize())
+		}
+		for i := uint32(1); i <= 8; i++ {
+			page, err := p2.ReadPage(i)
+			if err != nil {
+				t.Fatalf("Failed to read page %d: %v", i, err)
+			}
+			if len(page.Data) != size || page.Data[0] != byte(i) || page.Data[last] != byte(i) {
+				t.Errorf("Page %d: data mismatch with page size %d", i, size)
+			}
+			p2.UnpinPage(i, false)
+		}
+		p2.Close()
+	}
+}
+
+func TestInvalidConfiguredPageSize(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	for _, size := range []int{256, 1000, 3000, 131072} {
+		dbPath := filepath.Join(tmpDir, "test.db")
+		_, err := NewWithOptions(dbPath, Options{PageSize: size})
+		if !errors.Is(err, ErrUnsupportedPageSize) {
+			t.Errorf("Page size %d: expected ErrUnsupportedPageSize, got %v", size, err)
+		}
+	}
+}
+
+// recordingFS is a vfs.FS that notes every file the pager opens or deletes
+type recordingFS struct {
+	vfs.FS
+	opened  []string
+	deleted []string
+}
+
+func (r *recordingFS) Open(name string, flag vfs.OpenFlag) (vfs.File, error) {
+	r.opened = append(r.opened, filepath.Base(name))
+	return r.FS.Open(name, flag)
+}
+
+func (r *recordingFS) Delete(name string) error {
+	r.deleted = append(r.deleted, filepath.Base(name))
+	return r.FS.Delete(name)
+}
+
+func TestCustomFS(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+	fs := &recordingFS{FS: vfs.OS}
+
+	p, err := NewWithOptions(dbPath, Options{CacheSize: 10, JournalMode: JournalModeDelete, FS: fs})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	if err := p.WritePage(1, make([]byte, common.PageSize)); err != nil {
+		t.Fatalf("Failed to write page: %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	if len(fs.opened) == 0 || fs.opened[0] != "test.db" {
+		t.Errorf("Expected the database to be opened through the FS, got %v", fs.opened)
+	}
+	if !slices.Contains(fs.opened, "test.db-journal") || !slices.Contains(fs.deleted, "test.db-journal") {
+		t.Errorf("Expected the journal to go through the FS, opened %v, deleted %v", fs.opened, fs.deleted)
+	}
+}
+
+// noLockFS is a vfs.FS on a platform without file locks
+type noLockFS struct {
+	vfs.FS
+}
+
+type noLockFile struct {
+	vfs.File
+}
+
+func (f noLockFS) Open(name string, flag vfs.OpenFlag) (vfs.File, error) {
+	file, err := f.FS.Open(name, flag)
+	if err != nil {
+		return nil, err
+	}
+	return noLockFile{file}, nil
+}
+
+func (noLockFile) Lock(vfs.LockType, int64, int64) error {
+	return vfs.ErrLockingUnsupported
+}
+
+func TestLockingUnsupported(t *testing.T) {
+	fs := noLockFS{vfs.NewMemFS()}
+	if _, err := NewWithOptions("test.db", Options{FS: fs}); !errors.Is(err, vfs.ErrLockingUnsupported) {
+		t.Fatalf("Expected ErrLockingUnsupported, got %v", err)
+	}
+
+	// Pagers that keep the file to themselves do without locks
+	for _, mode := range []LockingMode{LockingModeExclusive, LockingModeNone} {
+		p, err := NewWithOptions("test.db", Options{FS: fs, LockingMode: mode})
+		if err != nil {
+			t.Fatalf("Mode %d: failed to create pager: %v", mode, err)
+		}
+		if err := p.WritePage(1, testPage(p, byte(mode))); err != nil {
+			t.Fatalf("Mode %d: failed to write page: %v", mode, err)
+		}
+		if err := p.Close(); err != nil {
+			t.Fatalf("Mode %d: failed to close: %v", mode, err)
+		}
+		p, err = NewWithOptions("test.db", Options{FS: fs, LockingMode: mode})
+		if err != nil {
+			t.Fatalf("Mode %d: failed to reopen: %v", mode, err)
+		}
+		expectPages(t, p, 1, func(uint32) byte { return byte(mode) })
+		p.Close()
+	}
+}
+
+func TestMemoryDatabase(t *testing.T) {
+	// A cache of 2 forces pages out to the in-memory file
+	p, err := New(MemoryPath, 2)
+	if err != nil {
+		t.Fatalf("Failed to create in-memory pager: %v", err)
+	}
+
+	for i := uint32(1); i <= 5; i++ {
+		data := make([]byte, common.PageSize)
+		data[0] = byte(i)
+		if err := p.WritePage(i, data); err != nil {
+			t.Fatalf("Failed to write page %d: %v", i, err)
+		}
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	for i := uint32(1); i <= 5; i++ {
+		page, err := p.ReadPage(i)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", i, err)
+		}
+		if page.Data[0] != byte(i) {
+			t.Errorf("Page %d: expected %d, got %d", i, i, page.Data[0])
+		}
+		p.UnpinPage(i, false)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	if _, err := os.Stat(MemoryPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected no file on disk, got %v", err)
+	}
+
+	// Every in-memory database starts out empty
+	p2, err := New(MemoryPath, 2)
+	if err != nil {
+		t.Fatalf("Failed to create in-memory pager: %v", err)
+	}
+	defer p2.Close()
+	if p2.NumPages() != 1 {
+		t.Errorf("Expected a fresh database, got %d pages", p2.NumPages())
+	}
+}
+
+func TestCacheShards_ConcurrentReads(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeOff, JournalModeWAL} {
+		p, err := NewWithOptions(filepath.Join(t.TempDir(), "test.db"),
+			Options{CacheSize: 64, CacheShards: 4, JournalMode: mode})
+		if err != nil {
+			t.Fatalf("Failed to create pager: %v", err)
+		}
+		if p.cache.Shards() != 4 {
+			t.Errorf("Expected 4 shards, got %d", p.cache.Shards())
+		}
+		for i := uint32(1); i <= 40; i++ {
+			p.WritePage(i, testPage(p, byte(i)))
+		}
+		if err := p.Flush(); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for g := range 8 {
+			wg.Go(func() {
+				for i := range 500 {
+					pageNum := uint32(1 + (g*7+i)%40)
+					page, err := p.ReadPage(pageNum)
+					if err != nil {
+						t.Errorf("Failed to read page %d: %v", pageNum, err)
+						return
+					}
+					if page.Data[0] != byte(pageNum) {
+						t.Errorf("Page %d: expected %d, got %d", pageNum, pageNum, page.Data[0])
+					}
+					p.UnpinPage(pageNum, false)
+				}
+			})
+		}
+		wg.Wait()
+
+		if n := p.pinned.Load(); n != 0 {
+			t.Errorf("Expected no pins left, got %d", n)
+		}
+		if mode == JournalModeOff && p.LockLevel() != LockNone {
+			t.Errorf("Expected the file lock to be released, got %v", p.LockLevel())
+		}
+		if p.NumPages() != 41 {
+			t.Errorf("Expected 41 pages, got %d", p.NumPages())
+		}
+		if err := p.Close(); err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+	}
+}
+
+// BenchmarkParallelReadPage reads cached pages from 32 goroutines with the
+// cache split into a varying number of shards
+func BenchmarkParallelReadPage(b *testing.B) {
+	const pages = 1024
+	for _, shards := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			p, err := NewWithOptions(MemoryPath, Options{CacheSize: 2 * pages, CacheShards: shards})
+			if err != nil {
+				b.Fatalf("Failed to create pager: %v", err)
+			}
+			defer p.Close()
+			for i := uint32(1); i <= pages; i++ {
+				p.WritePage(i, make([]byte, p.PageSize()))
+			}
+			// Holding one page keeps the SHARED lock, as a busy database would
+			if _, err := p.ReadPage(pages); err != nil {
+				b.Fatalf("Failed to read page: %v", err)
+			}
+			defer p.UnpinPage(pages, false)
+
+			var seed atomic.Uint64
+			b.SetParallelism(max(1, 32/runtime.GOMAXPROCS(0)))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewPCG(seed.Add(1), 0))
+				for pb.Next() {
+					pageNum := uint32(1 + rng.IntN(pages))
+					if _, err := p.ReadPage(pageNum); err != nil {
+						b.Errorf("Failed to read page %d: %v", pageNum, err)
+						return
+					}
+					p.UnpinPage(pageNum, false)
+				}
+			})
+		})
+	}
+}
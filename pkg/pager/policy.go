@@ -0,0 +1,351 @@
+package pager
+
+import (
+	"container/list"
+	"fmt"
+)
+
+// ReplacementPolicy decides which page a full PageCache evicts
+// The cache calls it with its own lock held, so implementations need no
+// locking of their own. When the cache is full, Evict is called to make room
+// right before the new page is passed to Insert.
+type ReplacementPolicy interface {
+	// Insert records that a page was added to the cache
+	Insert(pageNum uint32)
+
+	// Access records a use of a cached page
+	Access(pageNum uint32)
+
+	// Remove forgets a page dropped from the cache other than by Evict
+	Remove(pageNum uint32)
+
+	// Evict chooses a cached page for which evictable returns true and
+	// forgets it. It returns false if there is no such page.
+	Evict(evictable func(pageNum uint32) bool) (uint32, bool)
+}
+
+// Replacement selects the ReplacementPolicy of the pager's page cache
+type Replacement int
+
+const (
+	// ReplacementLRU evicts the least recently used page
+	ReplacementLRU Replacement = iota
+
+	// ReplacementClock approximates LRU with a reference bit per page,
+	// which makes a cache hit much cheaper
+	ReplacementClock
+
+	// Replacement2Q keeps pages seen only once in a small FIFO queue, so a
+	// sequential scan cannot flush the frequently used pages
+	Replacement2Q
+
+	// ReplacementARC balances recency and frequency adaptively, learning
+	// from recently evicted pages
+	ReplacementARC
+)
+
+// NewReplacementPolicy returns a policy of the given kind for a cache
+// holding capacity pages
+func NewReplacementPolicy(kind Replacement, capacity int) (ReplacementPolicy, error) {
+	switch kind {
+	case ReplacementLRU:
+		return NewLRUPolicy(), nil
+	case ReplacementClock:
+		return NewClockPolicy(), nil
+	case Replacement2Q:
+		return New2QPolicy(capacity), nil
+	case ReplacementARC:
+		return NewARCPolicy(capacity), nil
+	}
+	return nil, fmt.Errorf("unknown replacement policy %d", kind)
+}
+
+// pageList is an ordered set of page numbers, most recent at the front
+type pageList struct {
+	order list.List
+	elems map[uint32]*list.Element
+}
+
+func newPageList() *pageList {
+	return &pageList{elems: make(map[uint32]*list.Element)}
+}
+
+func (l *pageList) len() int {
+	return len(l.elems)
+}
+
+func (l *pageList) contains(pageNum uint32) bool {
+	_, ok := l.elems[pageNum]
+	return ok
+}
+
+func (l *pageList) pushFront(pageNum uint32) {
+	l.elems[pageNum] = l.order.PushFront(pageNum)
+}
+
+// moveToFront reports whether the page was in the list
+func (l *pageList) moveToFront(pageNum uint32) bool {
+	e, ok := l.elems[pageNum]
+	if ok {
+		l.order.MoveToFront(e)
+	}
+	return ok
+}
+
+// remove reports whether the page was in the list
+func (l *pageList) remove(pageNum uint32) bool {
+	e, ok := l.elems[pageNum]
+	if ok {
+		l.order.Remove(e)
+		delete(l.elems, pageNum)
+	}
+	return ok
+}
+
+// removeBack removes the least recent page for which evictable returns true
+// A nil evictable accepts any page.
+func (l *pageList) removeBack(evictable func(uint32) bool) (uint32, bool) {
+	for e := l.order.Back(); e != nil; e = e.Prev() {
+		pageNum := e.Value.(uint32)
+		if evictable == nil || evictable(pageNum) {
+			l.order.Remove(e)
+			delete(l.elems, pageNum)
+			return pageNum, true
+		}
+	}
+	return 0, false
+}
+
+// lruPolicy evicts the least recently used page
+type lruPolicy struct {
+	pages *pageList
+}
+
+// NewLRUPolicy returns a least recently used policy
+func NewLRUPolicy() ReplacementPolicy {
+	return &lruPolicy{pages: newPageList()}
+}
+
+func (p *lruPolicy) Insert(pageNum uint32) {
+	p.pages.pushFront(pageNum)
+}
+
+func (p *lruPolicy) Access(pageNum uint32) {
+	p.pages.moveToFront(pageNum)
+}
+
+func (p *lruPolicy) Remove(pageNum uint32) {
+	p.pages.remove(pageNum)
+}
+
+func (p *lruPolicy) Evict(evictable func(uint32) bool) (uint32, bool) {
+	return p.pages.removeBack(evictable)
+}
+
+// clockFrame is one position on the clock
+type clockFrame struct {
+	pageNum uint32
+	used    bool // Holds a page
+	ref     bool // Accessed since the hand last passed
+}
+
+// clockPolicy sweeps a hand over the cached pages, evicting the first one
+// not referenced since the last sweep. New pages start unreferenced, so a
+// page read once is evicted before one that was used again.
+type clockPolicy struct {
+	frames []clockFrame
+	index  map[uint32]int // Frame of every cached page
+	free   []int          // Frames without a page
+	hand   int
+}
+
+// NewClockPolicy returns a CLOCK (second chance) policy
+func NewClockPolicy() ReplacementPolicy {
+	return &clockPolicy{index: make(map[uint32]int)}
+}
+
+func (p *clockPolicy) Insert(pageNum uint32) {
+	frame := clockFrame{pageNum: pageNum, used: true}
+	if n := len(p.free); n > 0 {
+		i := p.free[n-1]
+		p.free = p.free[:n-1]
+		p.frames[i] = frame
+		p.index[pageNum] = i
+		return
+	}
+	p.frames = append(p.frames, frame)
+	p.index[pageNum] = len(p.frames) - 1
+}
+
+func (p *clockPolicy) Access(pageNum uint32) {
+	if i, ok := p.index[pageNum]; ok {
+		p.frames[i].ref = true
+	}
+}
+
+func (p *clockPolicy) Remove(pageNum uint32) {
+	if i, ok := p.index[pageNum]; ok {
+		p.frames[i] = clockFrame{}
+		delete(p.index, pageNum)
+		p.free = append(p.free, i)
+	}
+}
+
+func (p *clockPolicy) Evict(evictable func(uint32) bool) (uint32, bool) {
+	// Two full turns clear every reference bit on the way
+	for range 2 * len(p.frames) {
+		f := &p.frames[p.hand]
+		p.hand = (p.hand + 1) % len(p.frames)
+		switch {
+		case !f.used:
+		case f.ref:
+			f.ref = false
+		case evictable(f.pageNum):
+			pageNum := f.pageNum
+			p.Remove(pageNum)
+			return pageNum, true
+		}
+	}
+	return 0, false
+}
+
+// twoQPolicy is the full 2Q algorithm of Johnson and Shasha
+// Pages seen once enter the FIFO queue a1in. Pages evicted from it are
+// remembered in the ghost queue a1out, and only a page referenced again while
+// remembered there is promoted to the LRU list am of frequently used pages.
+type twoQPolicy struct {
+	kin, kout int
+	a1in      *pageList
+	a1out     *pageList // Ghost: page numbers only
+	am        *pageList
+}
+
+// New2QPolicy returns a 2Q policy for a cache holding capacity pages
+func New2QPolicy(capacity int) ReplacementPolicy {
+	return &twoQPolicy{
+		kin:   max(1, capacity/4),
+		kout:  max(1, capacity/2),
+		a1in:  newPageList(),
+		a1out: newPageList(),
+		am:    newPageList(),
+	}
+}
+
+func (p *twoQPolicy) Insert(pageNum uint32) {
+	if p.a1out.remove(pageNum) {
+		p.am.pushFront(pageNum)
+		return
+	}
+	p.a1in.pushFront(pageNum)
+}
+
+func (p *twoQPolicy) Access(pageNum uint32) {
+	// A hit in a1in is a correlated reference and does not count
+	p.am.moveToFront(pageNum)
+}
+
+func (p *twoQPolicy) Remove(pageNum uint32) {
+	if !p.a1in.remove(pageNum) {
+		p.am.remove(pageNum)
+	}
+}
+
+func (p *twoQPolicy) Evict(evictable func(uint32) bool) (uint32, bool) {
+	if p.a1in.len() > p.kin {
+		if pageNum, ok := p.evictA1in(evictable); ok {
+			return pageNum, true
+		}
+	}
+	if pageNum, ok := p.am.removeBack(evictable); ok {
+		return pageNum, true
+	}
+	return p.evictA1in(evictable)
+}
+
+// evictA1in evicts from a1in and remembers the page in a1out
+func (p *twoQPolicy) evictA1in(evictable func(uint32) bool) (uint32, bool) {
+	pageNum, ok := p.a1in.removeBack(evictable)
+	if !ok {
+		return 0, false
+	}
+	p.a1out.pushFront(pageNum)
+	if p.a1out.len() > p.kout {
+		p.a1out.removeBack(nil)
+	}
+	return pageNum, true
+}
+
+// arcPolicy is the Adaptive Replacement Cache of Megiddo and Modha
+// t1 holds pages seen once recently and t2 pages seen at least twice. The
+// ghost lists b1 and b2 remember pages recently evicted from each; a miss
+// on a ghost moves the target size of t1 towards the list that would have
+// kept the page.
+type arcPolicy struct {
+	capacity int
+	target   int // Target size of t1
+	t1, t2   *pageList
+	b1, b2   *pageList // Ghosts: page numbers only
+}
+
+// NewARCPolicy returns an ARC policy for a cache holding capacity pages
+func NewARCPolicy(capacity int) ReplacementPolicy {
+	return &arcPolicy{
+		capacity: max(1, capacity),
+		t1:       newPageList(),
+		t2:       newPageList(),
+		b1:       newPageList(),
+		b2:       newPageList(),
+	}
+}
+
+func (p *arcPolicy) Insert(pageNum uint32) {
+	switch {
+	case p.b1.remove(pageNum):
+		p.target = min(p.capacity, p.target+max(1, p.b2.len()/max(1, p.b1.len())))
+		p.t2.pushFront(pageNum)
+	case p.b2.remove(pageNum):
+		p.target = max(0, p.target-max(1, p.b1.len()/max(1, p.b2.len())))
+		p.t2.pushFront(pageNum)
+	default:
+		// Keep the directory within its bounds: |t1|+|b1| <= c and the
+		// four lists together <= 2c
+		if p.t1.len()+p.b1.len() >= p.capacity && p.b1.len() > 0 {
+			p.b1.removeBack(nil)
+		} else if p.t1.len()+p.t2.len()+p.b1.len()+p.b2.len() >= 2*p.capacity && p.b2.len() > 0 {
+			p.b2.removeBack(nil)
+		}
+		p.t1.pushFront(pageNum)
+	}
+}
+
+func (p *arcPolicy) Access(pageNum uint32) {
+	if p.t1.remove(pageNum) {
+		p.t2.pushFront(pageNum)
+		return
+	}
+	p.t2.moveToFront(pageNum)
+}
+
+func (p *arcPolicy) Remove(pageNum uint32) {
+	if !p.t1.remove(pageNum) {
+		p.t2.remove(pageNum)
+	}
+}
+
+func (p *arcPolicy) Evict(evictable func(uint32) bool) (uint32, bool) {
+	first, second := p.t1, p.t2
+	if p.t1.len() <= p.target {
+		first, second = p.t2, p.t1
+	}
+	for _, l := range []*pageList{first, second} {
+		if pageNum, ok := l.removeBack(evictable); ok {
+			if l == p.t1 {
+				p.b1.pushFront(pageNum)
+			} else {
+				p.b2.pushFront(pageNum)
+			}
+			return pageNum, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,232 @@
+package pager
+
+import (
+	"errors"
+	"math/rand/v2"
+	"path/filepath"
+	"testing"
+)
+
+var replacements = []struct {
+	name string
+	kind Replacement
+}{
+	{"lru", ReplacementLRU},
+	{"clock", ReplacementClock},
+	{"2q", Replacement2Q},
+	{"arc", ReplacementARC},
+}
+
+func newPolicyCache(t testing.TB, kind Replacement, capacity int) *PageCache {
+	t.Helper()
+	policy, err := NewReplacementPolicy(kind, capacity)
+	if err != nil {
+		t.Fatalf("Failed to create policy: %v", err)
+	}
+	return NewPageCache(capacity, policy)
+}
+
+// access reads a page through the cache, loading it on a miss
+func access(c *PageCache, pageNum uint32, page *Page) {
+	if c.Get(pageNum) == nil {
+		c.Put(pageNum, page)
+	}
+}
+
+func TestReplacementPolicies_RandomOps(t *testing.T) {
+	const capacity = 8
+	for _, tc := range replacements {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newPolicyCache(t, tc.kind, capacity)
+			rng := rand.New(rand.NewPCG(1, 2))
+			pages := make(map[uint32]*Page)
+			pinned := 0
+
+			for range 5000 {
+				pageNum := uint32(rng.IntN(40))
+				switch rng.IntN(10) {
+				case 0:
+					if page := c.Peek(pageNum); page == nil || page.PinCnt == 0 {
+						c.Remove(pageNum)
+						delete(pages, pageNum)
+					}
+				case 1:
+					if page := c.Get(pageNum); page != nil && page.PinCnt == 0 && pinned < capacity/2 {
+						page.PinCnt++
+						pinned++
+					}
+				case 2:
+					if page := c.Get(pageNum); page != nil && page.PinCnt > 0 {
+						page.PinCnt--
+						pinned--
+					}
+				default:
+					if page := c.Get(pageNum); page != nil {
+						if page != pages[pageNum] {
+							t.Fatalf("Page %d: got the wrong page back", pageNum)
+						}
+						continue
+					}
+					page := NewPage()
+					evicted, err := c.Put(pageNum, page)
+					if err != nil {
+						t.Fatalf("Failed to add page %d with %d pinned: %v", pageNum, pinned, err)
+					}
+					pages[pageNum] = page
+					if evicted != nil {
+						if evicted.Page.PinCnt != 0 {
+							t.Fatalf("Pinned page %d was evicted", evicted.PageNum)
+						}
+						if pages[evicted.PageNum] != evicted.Page {
+							t.Fatalf("Evicted page %d is not the cached one", evicted.PageNum)
+						}
+						delete(pages, evicted.PageNum)
+					}
+				}
+
+				if c.Size() != len(pages) {
+					t.Fatalf("Cache holds %d pages, expected %d", c.Size(), len(pages))
+				}
+				if c.Size() > capacity {
+					t.Fatalf("Cache grew to %d pages", c.Size())
+				}
+			}
+		})
+	}
+}
+
+func TestReplacementPolicies_AllPinned(t *testing.T) {
+	for _, tc := range replacements {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newPolicyCache(t, tc.kind, 3)
+			for i := uint32(1); i <= 3; i++ {
+				page := NewPage()
+				page.PinCnt = 1
+				c.Put(i, page)
+			}
+			if _, err := c.Put(4, NewPage()); !errors.Is(err, ErrAllPagesPinned) {
+				t.Errorf("Expected ErrAllPagesPinned, got %v", err)
+			}
+			if c.Size() != 3 {
+				t.Errorf("Expected the cache to stay at 3 pages, got %d", c.Size())
+			}
+		})
+	}
+}
+
+func TestClockPolicy_SecondChance(t *testing.T) {
+	c := newPolicyCache(t, ReplacementClock, 3)
+	for i := uint32(1); i <= 3; i++ {
+		c.Put(i, NewPage())
+	}
+	c.Get(1)
+
+	evicted, _ := c.Put(4, NewPage())
+	if evicted == nil || evicted.PageNum != 2 {
+		t.Fatalf("Expected page 2 to be evicted, got %+v", evicted)
+	}
+}
+
+func TestReplacementPolicies_ScanResistance(t *testing.T) {
+	for _, kind := range []Replacement{Replacement2Q, ReplacementARC} {
+		c := newPolicyCache(t, kind, 10)
+		page := NewPage()
+		next := uint32(1000)
+
+		// The hot pages are used twice in a row to start with. Each round then
+		// touches them again and scans as many fresh pages as the cache holds,
+		// which leaves nothing of the hot set under LRU.
+		for range 2 {
+			for pageNum := uint32(1); pageNum <= 4; pageNum++ {
+				access(c, pageNum, page)
+			}
+		}
+		for round := range 20 {
+			hits, _ := c.Stats()
+			for pageNum := uint32(1); pageNum <= 4; pageNum++ {
+				access(c, pageNum, page)
+			}
+			after, _ := c.Stats()
+			if round == 19 && after-hits != 4 {
+				t.Errorf("Policy %d: only %d of 4 hot pages survived the scans", kind, after-hits)
+			}
+			for range 10 {
+				access(c, next, page)
+				next++
+			}
+		}
+	}
+}
+
+func TestPager_ReplacementOption(t *testing.T) {
+	for _, tc := range replacements {
+		t.Run(tc.name, func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "test.db")
+			p, err := NewWithOptions(dbPath, Options{CacheSize: 4, Replacement: tc.kind})
+			if err != nil {
+				t.Fatalf("Failed to create pager: %v", err)
+			}
+			for i := uint32(1); i <= 20; i++ {
+				p.WritePage(i, testPage(p, byte(i)))
+			}
+			expectPages(t, p, 20, func(i uint32) byte { return byte(i) })
+			if err := p.Close(); err != nil {
+				t.Fatalf("Failed to close: %v", err)
+			}
+		})
+	}
+
+	if _, err := NewWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{Replacement: 99}); err == nil {
+		t.Error("Expected an unknown replacement policy to be rejected")
+	}
+}
+
+// BenchmarkReplacementPolicy reports the hit rate of each policy as "hit%"
+// on workloads that are hard on plain LRU
+func BenchmarkReplacementPolicy(b *testing.B) {
+	const capacity = 100
+	workloads := []struct {
+		name string
+		next func(rng *rand.Rand) func() uint32
+	}{
+		// 70% of accesses go to a hot set that fits the cache, the rest are
+		// one long sequential scan
+		{"scan", func(rng *rand.Rand) func() uint32 {
+			scan := uint32(0)
+			return func() uint32 {
+				if rng.IntN(10) < 7 {
+					return uint32(rng.IntN(capacity * 8 / 10))
+				}
+				scan++
+				return 1000 + scan%100000
+			}
+		}},
+		// Zipf-distributed accesses over a table 100 times the cache size
+		{"zipf", func(rng *rand.Rand) func() uint32 {
+			z := rand.NewZipf(rng, 1.1, 1, capacity*100-1)
+			return func() uint32 { return uint32(z.Uint64()) }
+		}},
+		// Repeated sequential loops slightly larger than the cache
+		{"loop", func(*rand.Rand) func() uint32 {
+			i := uint32(0)
+			return func() uint32 {
+				i++
+				return i % (capacity * 12 / 10)
+			}
+		}},
+	}
+
+	for _, w := range workloads {
+		for _, tc := range replacements {
+			b.Run(w.name+"/"+tc.name, func(b *testing.B) {
+				c := newPolicyCache(b, tc.kind, capacity)
+				next := w.next(rand.New(rand.NewPCG(1, 2)))
+				page := NewPage()
+				for b.Loop() {
+					access(c, next(), page)
+				}
+				b.ReportMetric(c.HitRate(), "hit%")
+			})
+		}
+	}
+}
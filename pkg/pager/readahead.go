@@ -0,0 +1,193 @@
+package pager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"mash-db/internal/common"
+)
+
+// Prefetching and read-ahead
+//
+// Prefetch loads pages into the cache ahead of use, without pinning them and
+// without counting towards CacheStats. The first use of a prefetched page is
+// not counted as a hit either, since the page was read for it all the same,
+// but as a prefetch hit in Metrics. Runs of adjacent pages in the database
+// file are read with a single read.
+//
+// With Options.ReadAhead set, ReadPage watches for sequential reads. Once a
+// scan is detected, the next window of pages is prefetched by a background
+// goroutine, and the next window again as soon as the scan is halfway
+// through it, so a scan rarely waits for the disk.
+const (
+	readAheadTrigger = 2  // Sequential reads after the first that start read-ahead
+	prefetchBatch    = 32 // Pages loaded per hold of the pager's lock
+)
+
+// readAhead detects sequential reads and prefetches ahead of them
+type readAhead struct {
+	window uint32
+
+	mu     sync.Mutex
+	last   uint32 // Last page read
+	streak int    // Sequential reads up to last
+	end    uint32 // First page past the last window requested
+	mark   uint32 // Reading this page requests the next window
+	busy   bool   // A window is being prefetched
+	wg     sync.WaitGroup
+}
+
+// Prefetch loads up to count pages starting at start into the cache without
+// pinning them
+// Pages that are cached already or lie past the end of the file are skipped.
+// Prefetching stops early without an error once the cache has no unpinned
+// page left to evict.
+func (p *Pager) Prefetch(start uint32, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	end := min(uint64(start)+uint64(count), uint64(p.NumPages()))
+	for next := uint64(start); next < end; next += prefetchBatch {
+		batchEnd := min(end, next+prefetchBatch)
+		if err := p.prefetchBatch(uint32(next), uint32(batchEnd)); err != nil {
+			if errors.Is(err, ErrAllPagesPinned) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// prefetchBatch loads the uncached pages in [start, end)
+func (p *Pager) prefetchBatch(start, end uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed.Load() {
+		return ErrFileClosed
+	}
+	if err := p.lockShared(); err != nil {
+		return err
+	}
+	defer p.releaseLock()
+
+	start = max(start, common.HeaderPageNum+1)
+	end = min(end, p.numPages.Load())
+	for pageNum := start; pageNum < end; {
+		if p.cache.Contains(pageNum) {
+			pageNum++
+			continue
+		}
+		n := uint32(1)
+		for pageNum+n < end && !p.cache.Contains(pageNum+n) {
+			n++
+		}
+		if err := p.prefetchRun(pageNum, n); err != nil {
+			return err
+		}
+		pageNum += n
+	}
+	return nil
+}
+
+// prefetchRun reads n uncached pages starting at first into the cache (must
+// hold lock)
+func (p *Pager) prefetchRun(first, n uint32) error {
+	pages := make([]*Page, n)
+	for i := range pages {
+		pages[i] = newPage(p.pageSize)
+	}
+
+	if p.wal != nil || p.store != nil || n == 1 {
+		for i, page := range pages {
+			if err := p.readPageFromDisk(first+uint32(i), page.Data); err != nil {
+				return err
+			}
+		}
+	} else if err := p.readRun(first, pages); err != nil {
+		return err
+	}
+
+	for i, page := range pages {
+		if err := p.cachePage(first+uint32(i), page); err != nil {
+			return err
+		}
+		p.cache.markPrefetched(first + uint32(i))
+	}
+	return nil
+}
+
+// readRun reads adjacent pages from the database file with a single read
+// (must hold lock)
+func (p *Pager) readRun(first uint32, pages []*Page) error {
+	size := len(pages) * p.pageSize
+	if cap(p.runBuf) < size {
+		p.runBuf = make([]byte, size)
+	}
+	buf := p.runBuf[:size]
+
+	n, err := p.file.ReadAt(buf, p.pageOffset(first))
+	if err != nil && n != size && err != io.EOF {
+		return fmt.Errorf("failed to read pages %d-%d: %w", first, first+uint32(len(pages))-1, err)
+	}
+	clear(buf[n:])
+	p.io.Reads++
+	p.io.PagesRead += uint64(len(pages))
+
+	for i, page := range pages {
+		pageNum := first + uint32(i)
+		copy(page.Data, buf[i*p.pageSize:])
+		if (i+1)*p.pageSize > n && allZero(page.Data) {
+			// Never written, past the end of the file
+			continue
+		}
+		if err := p.verifyPage(pageNum, page.Data); err != nil {
+			return err
+		}
+		if p.isEncryptedPage(pageNum) {
+			if err := p.cipher.open(pageNum, page.Data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// noteRead feeds a page read by a caller to the read-ahead detector
+func (p *Pager) noteRead(pageNum uint32) {
+	ra := p.readAhead
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	switch {
+	case pageNum == ra.last:
+		return
+	case pageNum == ra.last+1 && ra.last != 0:
+		ra.streak++
+	default:
+		// Zero is also the last page before any read, so a scan from page 1
+		// starts its streak with its second read like any other
+		ra.streak = 0
+		ra.end, ra.mark = 0, 0
+	}
+	ra.last = pageNum
+	if ra.streak < readAheadTrigger || pageNum < ra.mark || ra.busy {
+		return
+	}
+
+	start := max(pageNum+1, ra.end)
+	ra.end = start + ra.window
+	ra.mark = start + ra.window/2
+	ra.busy = true
+	ra.wg.Go(func() {
+		// A failed prefetch is reported by the read that needs the page
+		p.Prefetch(start, int(ra.window))
+
+		ra.mu.Lock()
+		ra.busy = false
+		ra.mu.Unlock()
+	})
+}
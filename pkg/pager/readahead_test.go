@@ -0,0 +1,151 @@
+package pager
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// newScanDB creates a database of n data pages and reopens it with opts
+func newScanDB(t *testing.T, n uint32, opts Options) *Pager {
+	t.Helper()
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p := newTestDB(t, dbPath, Options{Key: opts.Key, JournalMode: opts.JournalMode, Compression: opts.Compression}, n, ownNumber)
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	p, err := NewWithOptions(dbPath, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestPrefetch(t *testing.T) {
+	// The exclusive lock keeps the header from being reloaded for each batch
+	p := newScanDB(t, 100, Options{CacheSize: 200, LockingMode: LockingModeExclusive})
+
+	before := p.IOStats()
+	if err := p.Prefetch(0, 51); err != nil {
+		t.Fatalf("Failed to prefetch: %v", err)
+	}
+	after := p.IOStats()
+	if p.CacheSize() != 50 {
+		t.Errorf("Expected 50 cached pages, got %d", p.CacheSize())
+	}
+	if hits, misses, _ := p.CacheStats(); hits != 0 || misses != 0 {
+		t.Errorf("Expected prefetching to stay out of the stats, got %d hits and %d misses", hits, misses)
+	}
+	if n := p.pinned.Load(); n != 0 {
+		t.Errorf("Expected prefetched pages to be unpinned, got %d pins", n)
+	}
+	// Two batches, each a single read
+	if reads, pages := after.Reads-before.Reads, after.PagesRead-before.PagesRead; reads != 2 || pages != 50 {
+		t.Errorf("Expected 50 pages in 2 reads, got %d pages in %d reads", pages, reads)
+	}
+
+	// Their first uses are prefetch hits, the next ones hits
+	expectPages(t, p, 50, func(i uint32) byte { return byte(i) })
+	if hits, misses, _ := p.CacheStats(); hits != 0 || misses != 0 {
+		t.Errorf("Expected no hits or misses, got %d hits and %d misses", hits, misses)
+	}
+	if n := p.Metrics().PrefetchHits; n != 50 {
+		t.Errorf("Expected 50 prefetch hits, got %d", n)
+	}
+	expectPages(t, p, 50, func(i uint32) byte { return byte(i) })
+	if hits, _, _ := p.CacheStats(); hits != 50 || p.Metrics().PrefetchHits != 50 {
+		t.Errorf("Expected 50 hits, got %d hits and %d prefetch hits", hits, p.Metrics().PrefetchHits)
+	}
+
+	// Pages past the end of the file are not loaded
+	if err := p.Prefetch(95, 20); err != nil {
+		t.Fatalf("Failed to prefetch: %v", err)
+	}
+	if p.CacheSize() != 56 {
+		t.Errorf("Expected 56 cached pages, got %d", p.CacheSize())
+	}
+}
+
+func TestPrefetch_Bounds(t *testing.T) {
+	p := newScanDB(t, 100, Options{CacheSize: 200, LockingMode: LockingModeExclusive})
+
+	// A start near the top of the page numbers must not wrap around to the
+	// pages at the start of the file
+	if err := p.Prefetch(math.MaxUint32-10, 100); err != nil {
+		t.Fatalf("Failed to prefetch: %v", err)
+	}
+	if p.CacheSize() != 0 {
+		t.Errorf("Expected nothing prefetched, got %d pages", p.CacheSize())
+	}
+
+	// A huge count stops at the end of the file
+	before := p.IOStats()
+	if err := p.Prefetch(1, math.MaxInt); err != nil {
+		t.Fatalf("Failed to prefetch: %v", err)
+	}
+	if p.CacheSize() != 100 {
+		t.Errorf("Expected 100 cached pages, got %d", p.CacheSize())
+	}
+	if reads := p.IOStats().Reads - before.Reads; reads != 4 {
+		t.Errorf("Expected 4 reads, got %d", reads)
+	}
+}
+
+func TestPrefetch_Modes(t *testing.T) {
+	for _, opts := range []Options{
+		{CacheSize: 200, Key: testKey},
+		{CacheSize: 200, JournalMode: JournalModeWAL},
+		{CacheSize: 200, Compression: CompressionFlate},
+	} {
+		p := newScanDB(t, 40, opts)
+		if err := p.Prefetch(1, 40); err != nil {
+			t.Fatalf("Failed to prefetch: %v", err)
+		}
+		if p.CacheSize() != 40 {
+			t.Errorf("Expected 40 cached pages, got %d", p.CacheSize())
+		}
+		expectPages(t, p, 40, func(i uint32) byte { return byte(i) })
+	}
+}
+
+func TestReadAhead_SequentialScan(t *testing.T) {
+	p := newScanDB(t, 100, Options{CacheSize: 200, ReadAhead: 16})
+
+	for i := uint32(1); i <= 100; i++ {
+		page, err := p.ReadPage(i)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", i, err)
+		}
+		if page.Data[0] != byte(i) {
+			t.Errorf("Page %d: expected %d, got %d", i, i, page.Data[0])
+		}
+		p.UnpinPage(i, false)
+		p.readAhead.wg.Wait()
+	}
+
+	// Only the reads that revealed the scan missed; the others found pages
+	// read ahead
+	hits, misses, _ := p.CacheStats()
+	if prefetched := p.Metrics().PrefetchHits; hits != 0 || misses != readAheadTrigger+1 || prefetched != 100-readAheadTrigger-1 {
+		t.Errorf("Expected %d misses and %d prefetch hits, got %d hits, %d misses and %d prefetch hits",
+			readAheadTrigger+1, 100-readAheadTrigger-1, hits, misses, prefetched)
+	}
+}
+
+func TestReadAhead_RandomReads(t *testing.T) {
+	p := newScanDB(t, 100, Options{CacheSize: 200, ReadAhead: 16})
+
+	pages := []uint32{40, 7, 93, 8, 20, 61, 62, 5}
+	for _, pageNum := range pages {
+		if _, err := p.ReadPage(pageNum); err != nil {
+			t.Fatalf("Failed to read page %d: %v", pageNum, err)
+		}
+		p.UnpinPage(pageNum, false)
+		p.readAhead.wg.Wait()
+	}
+	if p.CacheSize() != len(pages) {
+		t.Errorf("Expected only the pages read to be cached, got %d", p.CacheSize())
+	}
+}
@@ -0,0 +1,217 @@
+package pager
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrTxActive = errors.New("a transaction is already active")
+	ErrTxDone   = errors.New("transaction has already been committed or rolled back")
+)
+
+// Tx is a pager-level unit of work
+// Every page modified between Begin and Commit becomes durable atomically on
+// Commit, or is restored to its pre-transaction image on Rollback. Only one
+// transaction can be active on a Pager at a time.
+//
+// Changes are protected by the pager's journal mode. In JournalModeOff the
+// transaction uses a rollback journal of its own for its duration.
+type Tx struct {
+	p          *Pager
+	header     Header          // Header as of Begin
+	written    map[uint32]bool // Pages written to disk while the transaction ran
+	ownJournal bool            // Journal created for this transaction only
+	done       bool
+}
+
+// Begin starts a transaction
+// Outstanding changes made outside a transaction are committed first so the
+// transaction starts from a clean state.
+func (p *Pager) Begin() (*Tx, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.retryLatched(nil, func() error {
+		if p.closed.Load() {
+			return ErrFileClosed
+		}
+
+		if p.tx != nil {
+			return ErrTxActive
+		}
+
+		if err := p.lockReserved(); err != nil {
+			return err
+		}
+		defer p.releaseLock()
+
+		return p.beginInternal()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p.tx, nil
+}
+
+// beginInternal commits outstanding changes and starts a transaction
+// (must hold lock)
+func (p *Pager) beginInternal() error {
+	if err := p.flushAllInternal(); err != nil {
+		return err
+	}
+
+	tx := &Tx{
+		p:       p,
+		header:  p.header,
+		written: make(map[uint32]bool),
+	}
+	tx.header.PageCount = p.numPages.Load()
+
+	if p.wal == nil && p.journal == nil {
+		p.journal = newJournal(p.fs, journalPath(p.filePath), p.pageSize, false)
+		tx.ownJournal = true
+	}
+
+	p.tx = tx
+	return nil
+}
+
+// Commit makes every change of the transaction durable atomically
+// If Commit fails the transaction stays active and should be rolled back.
+func (tx *Tx) Commit() error {
+	p := tx.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.retryLatched(nil, func() error {
+		if tx.done {
+			return ErrTxDone
+		}
+
+		if p.closed.Load() {
+			return ErrFileClosed
+		}
+
+		if err := p.flushAllInternal(); err != nil {
+			return err
+		}
+		p.endTx()
+		p.releaseLock()
+		return nil
+	})
+}
+
+// Rollback discards every change of the transaction
+// Pages written to disk during the transaction, for example by eviction,
+// are restored from the journal or dropped from the write-ahead log.
+func (tx *Tx) Rollback() error {
+	p := tx.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.retryLatched(nil, func() error {
+		if tx.done {
+			return ErrTxDone
+		}
+
+		if err := p.rollbackInternal(); err != nil {
+			return err
+		}
+		p.releaseLock()
+		return nil
+	})
+}
+
+// rollbackInternal undoes the active transaction (must hold lock)
+func (p *Pager) rollbackInternal() error {
+	tx := p.tx
+
+	// Pinned pages are reloaded in place below, so their latches are taken
+	// before anything changes
+	var stale []uint32
+	p.cache.ForEach(func(pageNum uint32, page *Page) bool {
+		if page.Dirty || tx.written[pageNum] {
+			stale = append(stale, pageNum)
+		}
+		return true
+	})
+	var latched []*Page
+	defer func() {
+		for _, page := range latched {
+			page.latch.Unlock()
+		}
+	}()
+	for _, pageNum := range stale {
+		if !p.cache.Pinned(pageNum) {
+			continue
+		}
+		page := p.cache.Peek(pageNum)
+		if !page.latch.TryLock() {
+			return &latchedError{pageNum: pageNum, page: page, exclusive: true}
+		}
+		latched = append(latched, page)
+	}
+
+	// Restore the on-disk state first
+	switch {
+	case p.wal != nil:
+		if err := p.wal.rollback(); err != nil {
+			return err
+		}
+	case p.journal.active():
+		if err := playbackJournal(p.journal.file, p.file); err != nil {
+			return fmt.Errorf("failed to roll back: %w", err)
+		}
+		if err := p.journal.finish(); err != nil {
+			return err
+		}
+	}
+
+	p.header = tx.header
+	p.free = nil
+	p.numPages.Store(tx.header.PageCount)
+	p.dirty = false
+	p.spilled = false
+	if p.store != nil {
+		// Records written by the transaction are simply forgotten
+		if err := p.store.load(tx.header); err != nil {
+			return err
+		}
+	}
+
+	// Then drop every cached page that no longer matches the disk. Pinned
+	// pages are reloaded in place so callers holding them see the old data.
+	for _, pageNum := range stale {
+		if p.cache.RemoveUnpinned(pageNum) {
+			continue
+		}
+		page := p.cache.Peek(pageNum)
+		clear(page.Data)
+		if pageNum < p.numPages.Load() {
+			if err := p.readPageFromDisk(pageNum, page.Data); err != nil {
+				return err
+			}
+		}
+		page.Dirty = false
+	}
+
+	p.endTx()
+	return nil
+}
+
+// endTx detaches the active transaction from the pager (must hold lock)
+func (p *Pager) endTx() {
+	if p.tx.ownJournal {
+		p.journal = nil
+	}
+	p.tx.done = true
+	p.tx = nil
+}
+
+// InTx reports whether a transaction is active
+func (p *Pager) InTx() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.tx != nil
+}
@@ -0,0 +1,232 @@
+package pager
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+var txModes = []struct {
+	name string
+	mode JournalMode
+}{
+	{"off", JournalModeOff},
+	{"wal", JournalModeWAL},
+	{"delete", JournalModeDelete},
+	{"truncate", JournalModeTruncate},
+}
+
+// testPage returns a page for p with every usable byte set to value
+func testPage(p *Pager, value byte) []byte {
+	data := make([]byte, p.PageSize())
+	for i := range p.UsableSize() {
+		data[i] = value
+	}
+	return data
+}
+
+// ownNumber is a fill for newTestDB giving every page its own number
+func ownNumber(p *Pager, i uint32) []byte {
+	return testPage(p, byte(i))
+}
+
+// newTestDB creates a database at dbPath with opts and commits pages 1..n
+// as fill returns them
+// A failed write fails the test, and the pager is closed when it ends.
+func newTestDB(t *testing.T, dbPath string, opts Options, n uint32, fill func(p *Pager, i uint32) []byte) *Pager {
+	t.Helper()
+	p, err := NewWithOptions(dbPath, opts)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	for i := uint32(1); i <= n; i++ {
+		if err := p.WritePage(i, fill(p, i)); err != nil {
+			t.Fatalf("Failed to write page %d: %v", i, err)
+		}
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	return p
+}
+
+func expectPages(t *testing.T, p *Pager, n uint32, value func(i uint32) byte) {
+	t.Helper()
+	for i := uint32(1); i <= n; i++ {
+		page, err := p.ReadPage(i)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", i, err)
+		}
+		if page.Data[0] != value(i) {
+			t.Errorf("Page %d: expected %d, got %d", i, value(i), page.Data[0])
+		}
+		p.UnpinPage(i, false)
+	}
+}
+
+func TestTx_RollbackRestoresPages(t *testing.T) {
+	for _, tc := range txModes {
+		t.Run(tc.name, func(t *testing.T) {
+			// A cache of 2 forces most modified pages to disk mid-transaction
+			p := newTestDB(t, filepath.Join(t.TempDir(), "test.db"), Options{CacheSize: 2, JournalMode: tc.mode}, 4, ownNumber)
+			defer p.Close()
+
+			tx, err := p.Begin()
+			if err != nil {
+				t.Fatalf("Failed to begin: %v", err)
+			}
+			for i := uint32(1); i <= 6; i++ {
+				if err := p.WritePage(i, testPage(p, byte(50+i))); err != nil {
+					t.Fatalf("Failed to write page %d: %v", i, err)
+				}
+			}
+			p.SetSchemaCookie(9)
+			if err := p.Flush(); err != nil {
+				t.Fatalf("Failed to flush inside transaction: %v", err)
+			}
+
+			if err := tx.Rollback(); err != nil {
+				t.Fatalf("Failed to roll back: %v", err)
+			}
+
+			if p.NumPages() != 5 {
+				t.Errorf("Expected 5 pages after rollback, got %d", p.NumPages())
+			}
+			if p.SchemaCookie() != 0 {
+				t.Errorf("Expected schema cookie 0 after rollback, got %d", p.SchemaCookie())
+			}
+			expectPages(t, p, 4, func(i uint32) byte { return byte(i) })
+		})
+	}
+}
+
+func TestTx_CommitIsDurable(t *testing.T) {
+	for _, tc := range txModes {
+		t.Run(tc.name, func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "test.db")
+			p := newTestDB(t, dbPath, Options{CacheSize: 2, JournalMode: tc.mode}, 4, ownNumber)
+			defer p.Close()
+
+			tx, err := p.Begin()
+			if err != nil {
+				t.Fatalf("Failed to begin: %v", err)
+			}
+			for i := uint32(1); i <= 6; i++ {
+				p.WritePage(i, testPage(p, byte(50+i)))
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Failed to commit: %v", err)
+			}
+
+			crashed := snapshotFiles(t, dbPath, "-wal", "-journal")
+			p2, err := New(crashed, 10)
+			if err != nil {
+				t.Fatalf("Failed to open crashed database: %v", err)
+			}
+			defer p2.Close()
+
+			if p2.NumPages() != 7 {
+				t.Errorf("Expected 7 pages, got %d", p2.NumPages())
+			}
+			expectPages(t, p2, 6, func(i uint32) byte { return byte(50 + i) })
+		})
+	}
+}
+
+func TestTx_CrashBeforeCommit(t *testing.T) {
+	for _, tc := range txModes {
+		t.Run(tc.name, func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "test.db")
+			p := newTestDB(t, dbPath, Options{CacheSize: 2, JournalMode: tc.mode}, 4, ownNumber)
+			defer p.Close()
+
+			if _, err := p.Begin(); err != nil {
+				t.Fatalf("Failed to begin: %v", err)
+			}
+			for i := uint32(1); i <= 6; i++ {
+				p.WritePage(i, testPage(p, byte(50+i)))
+			}
+
+			crashed := snapshotFiles(t, dbPath, "-wal", "-journal")
+			p2, err := New(crashed, 10)
+			if err != nil {
+				t.Fatalf("Failed to open crashed database: %v", err)
+			}
+			defer p2.Close()
+
+			if p2.NumPages() != 5 {
+				t.Errorf("Expected 5 pages, got %d", p2.NumPages())
+			}
+			expectPages(t, p2, 4, func(i uint32) byte { return byte(i) })
+		})
+	}
+}
+
+func TestTx_PinnedPageReloadedOnRollback(t *testing.T) {
+	p := newTestDB(t, filepath.Join(t.TempDir(), "test.db"), Options{CacheSize: 10, JournalMode: JournalModeOff}, 2, ownNumber)
+	defer p.Close()
+
+	tx, _ := p.Begin()
+	page, err := p.GetPage(1)
+	if err != nil {
+		t.Fatalf("Failed to get page: %v", err)
+	}
+	page.Data[0] = 77
+	page.Dirty = true
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	if page.Data[0] != 1 {
+		t.Errorf("Pinned page should be reloaded, got %d", page.Data[0])
+	}
+	p.UnpinPage(1, false)
+}
+
+func TestTx_Errors(t *testing.T) {
+	p := newTestDB(t, filepath.Join(t.TempDir(), "test.db"), Options{CacheSize: 10, JournalMode: JournalModeOff}, 1, ownNumber)
+	defer p.Close()
+
+	tx, err := p.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	if !p.InTx() {
+		t.Error("Expected an active transaction")
+	}
+	if _, err := p.Begin(); err != ErrTxActive {
+		t.Errorf("Expected ErrTxActive, got %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if p.InTx() {
+		t.Error("Expected no active transaction")
+	}
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Errorf("Expected ErrTxDone, got %v", err)
+	}
+	if err := tx.Rollback(); err != ErrTxDone {
+		t.Errorf("Expected ErrTxDone, got %v", err)
+	}
+}
+
+func TestTx_CloseRollsBack(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p := newTestDB(t, dbPath, Options{CacheSize: 2, JournalMode: JournalModeDelete}, 3, ownNumber)
+
+	p.Begin()
+	for i := uint32(1); i <= 3; i++ {
+		p.WritePage(i, testPage(p, byte(50+i)))
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	p2, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer p2.Close()
+	expectPages(t, p2, 3, func(i uint32) byte { return byte(i) })
+}
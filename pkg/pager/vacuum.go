@@ -0,0 +1,315 @@
+package pager
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"mash-db/internal/common"
+)
+
+// Truncation and vacuum
+//
+// Truncate cuts pages off the end of the database. How the space comes back
+// depends on the storage:
+//
+//   - In the rollback journal modes the database file shrinks at once. The
+//     pages cut off are journaled first, so a rollback or a hot journal
+//     brings them back.
+//   - A compressed database releases the records of the pages cut off, and
+//     the file shrinks when the change commits.
+//   - In WAL mode the database file shrinks at the next checkpoint. Until
+//     then the pages cut off keep their old images in the log and the file,
+//     so a page regrown in the meantime is written out as zeroes first.
+//
+// Vacuum builds on it: live pages in the tail of the file are moved into
+// free pages further down, so that the whole freelist can be cut off.
+
+// Truncate shrinks the database to n pages, discarding every page from n on
+// Pages from n on must not be pinned; any of them on the freelist are taken
+// off it. The change commits like any other write.
+func (p *Pager) Truncate(n uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed.Load() {
+		return ErrFileClosed
+	}
+
+	if err := p.lockReserved(); err != nil {
+		return err
+	}
+	defer p.releaseLock()
+
+	if n == 0 || n > p.numPages.Load() {
+		return ErrPageOutOfBounds
+	}
+	return p.truncateInternal(n)
+}
+
+// truncateInternal implements Truncate (must hold lock and RESERVED)
+func (p *Pager) truncateInternal(n uint32) error {
+	old := p.numPages.Load()
+	if n == old {
+		return nil
+	}
+
+	free, err := p.freeSet()
+	if err != nil {
+		return err
+	}
+	var keep []uint32
+	for pageNum := range free {
+		if pageNum < n {
+			keep = append(keep, pageNum)
+		}
+	}
+	slices.Sort(keep)
+
+	var drop []uint32
+	pinned := false
+	p.cache.ForEach(func(pageNum uint32, page *Page) bool {
+		if pageNum >= n {
+			pinned = page.PinCnt > 0
+			drop = append(drop, pageNum)
+		}
+		return !pinned
+	})
+	if pinned {
+		return ErrPagePinned
+	}
+
+	switch {
+	case p.wal != nil:
+		p.staleEnd = max(p.staleEnd, old)
+	case p.store != nil:
+		p.store.truncate(n)
+	default:
+		if err := p.truncateFile(n); err != nil {
+			return err
+		}
+	}
+
+	for _, pageNum := range drop {
+		p.cache.Remove(pageNum)
+	}
+	p.numPages.Store(n)
+	p.dirty = true
+
+	if len(keep) != len(free) {
+		p.header.FreelistHead, p.header.FreelistCount = 0, 0
+		clear(p.free)
+		for _, pageNum := range keep {
+			if err := p.freePageInternal(pageNum); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// truncateFile shrinks the database file to n pages, journaling the pages
+// cut off first (must hold lock)
+func (p *Pager) truncateFile(n uint32) error {
+	size, err := p.file.Size()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	end := p.pageOffset(n)
+	if size <= end {
+		return nil
+	}
+
+	if p.journal != nil {
+		for pageNum := n; p.pageOffset(pageNum) < size; pageNum++ {
+			if err := p.journalOriginal(pageNum); err != nil {
+				return err
+			}
+		}
+		if err := p.journal.sync(); err != nil {
+			return err
+		}
+	}
+	if err := p.acquireLock(LockExclusive); err != nil {
+		return err
+	}
+	if err := p.file.Truncate(end); err != nil {
+		return fmt.Errorf("failed to truncate database: %w", err)
+	}
+	return nil
+}
+
+// zeroStale writes zeroes over the pages in [from, to) that still have
+// images from before a Truncate in the log or the database file (must hold
+// lock)
+func (p *Pager) zeroStale(from, to uint32) error {
+	var zero []byte
+	for pageNum := from; pageNum < min(to, p.staleEnd); pageNum++ {
+		// A cached page past the end was never read from disk
+		if p.cache.Contains(pageNum) {
+			continue
+		}
+		if zero == nil {
+			zero = make([]byte, p.pageSize)
+		}
+		if err := p.writePageInternal(pageNum, zero); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TruncateFree cuts the free pages at the end of the database off and
+// returns how many there were
+// Unlike Vacuum it moves no page, so it is safe without knowing how pages
+// refer to each other; free pages further down stay on the freelist. The
+// change commits like any other write.
+func (p *Pager) TruncateFree() (uint32, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed.Load() {
+		return 0, ErrFileClosed
+	}
+
+	if err := p.lockReserved(); err != nil {
+		return 0, err
+	}
+	defer p.releaseLock()
+
+	free, err := p.freeSet()
+	if err != nil {
+		return 0, err
+	}
+	total := p.numPages.Load()
+	n := total
+	for n > common.HeaderPageNum+1 && free[n-1] {
+		n--
+	}
+	if err := p.truncateInternal(n); err != nil {
+		return 0, err
+	}
+	return total - n, nil
+}
+
+// pageMove is a page Vacuum moves out of the tail of the file
+type pageMove struct {
+	from, to uint32
+}
+
+// Vacuum moves the live pages at the end of the database into free pages
+// and truncates the database to the pages in use, leaving the freelist empty
+// Every move copies the page and then calls relocate, without the pager's
+// lock held, to update whatever refers to the page by number. relocate may
+// read and write pages but must not allocate or free them. Pages that have
+// to move must not be pinned.
+//
+// Vacuum runs in a transaction of its own, so a failed vacuum leaves the
+// database as it was. Inside an active transaction it joins that instead,
+// and the caller rolls back on failure.
+func (p *Pager) Vacuum(relocate func(from, to uint32) error) error {
+	tx, err := p.Begin()
+	if errors.Is(err, ErrTxActive) {
+		return p.vacuum(relocate)
+	}
+	if err != nil {
+		return err
+	}
+	if err := p.vacuum(relocate); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// vacuum implements Vacuum
+func (p *Pager) vacuum(relocate func(from, to uint32) error) error {
+	moves, n, err := p.planVacuum()
+	if err != nil {
+		return err
+	}
+	for _, m := range moves {
+		if err := p.movePage(m.from, m.to); err != nil {
+			return err
+		}
+		if relocate == nil {
+			continue
+		}
+		if err := relocate(m.from, m.to); err != nil {
+			return fmt.Errorf("failed to relocate page %d to %d: %w", m.from, m.to, err)
+		}
+	}
+	return p.Truncate(n)
+}
+
+// planVacuum takes every page off the freelist and pairs each live page
+// past the pages in use with a free page to move it to
+// It returns the moves and the number of pages left once they are done.
+func (p *Pager) planVacuum() ([]pageMove, uint32, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed.Load() {
+		return nil, 0, ErrFileClosed
+	}
+
+	if err := p.lockReserved(); err != nil {
+		return nil, 0, err
+	}
+	defer p.releaseLock()
+
+	free, err := p.freeSet()
+	if err != nil {
+		return nil, 0, err
+	}
+	total := p.numPages.Load()
+	n := total - uint32(len(free))
+
+	var slots []uint32 // Free pages below n, lowest first
+	for pageNum := range free {
+		if pageNum < n {
+			slots = append(slots, pageNum)
+		}
+	}
+	slices.Sort(slots)
+
+	// The live pages past n exactly fill the free pages below it
+	var moves []pageMove
+	for pageNum := total - 1; pageNum >= n; pageNum-- {
+		if p.cache.Pinned(pageNum) {
+			return nil, 0, fmt.Errorf("failed to move page %d: %w", pageNum, ErrPagePinned)
+		}
+		if !free[pageNum] {
+			moves = append(moves, pageMove{from: pageNum, to: slots[len(moves)]})
+		}
+	}
+
+	if len(free) > 0 {
+		p.header.FreelistHead, p.header.FreelistCount = 0, 0
+		clear(p.free)
+		p.dirty = true
+	}
+	return moves, n, nil
+}
+
+// movePage copies a page over another
+func (p *Pager) movePage(from, to uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed.Load() {
+		return ErrFileClosed
+	}
+
+	if err := p.lockReserved(); err != nil {
+		return err
+	}
+	defer p.releaseLock()
+
+	page, err := p.readPageInternal(from)
+	if err != nil {
+		return err
+	}
+	defer p.unpinPageInternal(from, false)
+	return p.writePageInternal(to, page.Data)
+}
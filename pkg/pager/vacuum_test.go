@@ -0,0 +1,317 @@
+package pager
+
+import (
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestTruncate(t *testing.T) {
+	for _, cfg := range crashConfigs {
+		t.Run(cfg.name, func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "test.db")
+			opts := Options{JournalMode: cfg.mode, Compression: cfg.compression, Key: cfg.key}
+			p, err := NewWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("Failed to create pager: %v", err)
+			}
+			for i := uint32(1); i <= 20; i++ {
+				p.WritePage(i, testPage(p, byte(i)))
+			}
+			if err := p.Flush(); err != nil {
+				t.Fatalf("Failed to flush: %v", err)
+			}
+
+			if err := p.Truncate(11); err != nil {
+				t.Fatalf("Failed to truncate: %v", err)
+			}
+			if p.NumPages() != 11 {
+				t.Errorf("Expected 11 pages, got %d", p.NumPages())
+			}
+			// A page regrown before the truncation commits reads as new
+			pageNum, err := p.AllocatePage()
+			if err != nil {
+				t.Fatalf("Failed to allocate page: %v", err)
+			}
+			page, err := p.ReadPage(pageNum)
+			if err != nil {
+				t.Fatalf("Failed to read page %d: %v", pageNum, err)
+			}
+			if pageNum != 11 || page.Data[0] != 0 {
+				t.Errorf("Expected page 11 to come back zeroed, got page %d holding %d", pageNum, page.Data[0])
+			}
+			p.UnpinPage(pageNum, false)
+			if err := p.Close(); err != nil {
+				t.Fatalf("Failed to close: %v", err)
+			}
+
+			p, err = NewWithOptions(dbPath, opts)
+			if err != nil {
+				t.Fatalf("Failed to reopen: %v", err)
+			}
+			defer p.Close()
+			if p.NumPages() != 12 {
+				t.Errorf("Expected 12 pages after reopen, got %d", p.NumPages())
+			}
+			if m := p.Metrics(); m.FileSize > int64(12*p.PageSize()) {
+				t.Errorf("Expected the file to shrink to at most 12 pages, got %d bytes", m.FileSize)
+			}
+			expectPages(t, p, 10, func(i uint32) byte { return byte(i) })
+		})
+	}
+}
+
+func TestTruncate_Rollback(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeOff, JournalModeDelete, JournalModeWAL} {
+		p, err := NewWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{JournalMode: mode})
+		if err != nil {
+			t.Fatalf("Failed to create pager: %v", err)
+		}
+		for i := uint32(1); i <= 20; i++ {
+			p.WritePage(i, testPage(p, byte(i)))
+		}
+		if err := p.Flush(); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+
+		tx, err := p.Begin()
+		if err != nil {
+			t.Fatalf("Failed to begin: %v", err)
+		}
+		if err := p.Truncate(5); err != nil {
+			t.Fatalf("Mode %d: failed to truncate: %v", mode, err)
+		}
+		if err := tx.Rollback(); err != nil {
+			t.Fatalf("Mode %d: failed to roll back: %v", mode, err)
+		}
+		if p.NumPages() != 21 {
+			t.Errorf("Mode %d: expected 21 pages after rollback, got %d", mode, p.NumPages())
+		}
+		expectPages(t, p, 20, func(i uint32) byte { return byte(i) })
+		p.Close()
+	}
+}
+
+func TestTruncate_Freelist(t *testing.T) {
+	p, err := New(MemoryPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	for range 20 {
+		if _, err := p.AllocatePage(); err != nil {
+			t.Fatalf("Failed to allocate page: %v", err)
+		}
+	}
+	for _, pageNum := range []uint32{3, 15, 17, 5} {
+		if err := p.FreePage(pageNum); err != nil {
+			t.Fatalf("Failed to free page %d: %v", pageNum, err)
+		}
+	}
+
+	if _, err := p.ReadPage(18); err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	if err := p.Truncate(12); !errors.Is(err, ErrPagePinned) {
+		t.Errorf("Expected ErrPagePinned with page 18 pinned, got %v", err)
+	}
+	p.UnpinPage(18, false)
+
+	if err := p.Truncate(12); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	if p.FreelistCount() != 2 {
+		t.Errorf("Expected pages 3 and 5 left on the freelist, got %d pages", p.FreelistCount())
+	}
+	got := map[uint32]bool{}
+	for range 3 {
+		pageNum, err := p.AllocatePage()
+		if err != nil {
+			t.Fatalf("Failed to allocate page: %v", err)
+		}
+		got[pageNum] = true
+	}
+	if !got[3] || !got[5] || !got[12] {
+		t.Errorf("Expected pages 3, 5 and 12, got %v", got)
+	}
+	if err := p.Truncate(0); !errors.Is(err, ErrPageOutOfBounds) {
+		t.Errorf("Expected ErrPageOutOfBounds, got %v", err)
+	}
+}
+
+// newLinkedDB builds a database whose page 1 lists the pages in use and
+// frees every page listed in free
+func newLinkedDB(t *testing.T, dbPath string, n uint32, free []uint32) *Pager {
+	t.Helper()
+	p := newTestDB(t, dbPath, Options{JournalMode: JournalModeDelete, CacheSize: 8}, n, func(p *Pager, i uint32) []byte {
+		if i > 1 {
+			return testPage(p, byte(i))
+		}
+		root := make([]byte, p.PageSize())
+		slot := 0
+		for pageNum := uint32(2); pageNum <= n; pageNum++ {
+			if !slices.Contains(free, pageNum) {
+				binary.LittleEndian.PutUint32(root[4*slot:], pageNum)
+				slot++
+			}
+		}
+		return root
+	})
+	for _, pageNum := range free {
+		if err := p.FreePage(pageNum); err != nil {
+			t.Fatalf("Failed to free page %d: %v", pageNum, err)
+		}
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	return p
+}
+
+// relocateLinked updates the list on page 1 when a page moves
+func relocateLinked(p *Pager) func(from, to uint32) error {
+	return func(from, to uint32) error {
+		h, err := p.AcquireForWrite(1)
+		if err != nil {
+			return err
+		}
+		defer h.Release()
+		for off := 0; off+4 <= p.UsableSize(); off += 4 {
+			if binary.LittleEndian.Uint32(h.Bytes()[off:]) == from {
+				binary.LittleEndian.PutUint32(h.Bytes()[off:], to)
+				h.MarkDirty()
+				return nil
+			}
+		}
+		return errors.New("page not listed")
+	}
+}
+
+// expectLinked checks every page listed on page 1 still holds its value
+func expectLinked(t *testing.T, p *Pager, want int) {
+	t.Helper()
+	root, err := p.ReadPage(1)
+	if err != nil {
+		t.Fatalf("Failed to read root: %v", err)
+	}
+	defer p.UnpinPage(1, false)
+
+	values := map[byte]bool{}
+	for off := 0; ; off += 4 {
+		pageNum := binary.LittleEndian.Uint32(root.Data[off:])
+		if pageNum == 0 {
+			break
+		}
+		page, err := p.ReadPage(pageNum)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", pageNum, err)
+		}
+		values[page.Data[0]] = true
+		p.UnpinPage(pageNum, false)
+	}
+	if len(values) != want {
+		t.Errorf("Expected %d distinct pages listed, got %d", want, len(values))
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p := newLinkedDB(t, dbPath, 40, []uint32{2, 7, 8, 20, 33, 39})
+
+	moved := 0
+	relocate := relocateLinked(p)
+	err := p.Vacuum(func(from, to uint32) error {
+		moved++
+		if from < 35 || to >= 35 {
+			t.Errorf("Expected moves from the tail into the pages in use, got %d to %d", from, to)
+		}
+		return relocate(from, to)
+	})
+	if err != nil {
+		t.Fatalf("Failed to vacuum: %v", err)
+	}
+
+	// Pages 35-40 less the free 39 had to move
+	if moved != 5 {
+		t.Errorf("Expected 5 moves, got %d", moved)
+	}
+	if p.NumPages() != 35 || p.FreelistCount() != 0 {
+		t.Errorf("Expected 35 pages and no free ones, got %d and %d", p.NumPages(), p.FreelistCount())
+	}
+	expectLinked(t, p, 33)
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	p, err = New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer p.Close()
+	if p.NumPages() != 35 {
+		t.Errorf("Expected 35 pages after reopen, got %d", p.NumPages())
+	}
+	if m := p.Metrics(); m.FileSize != int64(35*p.PageSize()) {
+		t.Errorf("Expected the file to shrink to 35 pages, got %d bytes", m.FileSize)
+	}
+	expectLinked(t, p, 33)
+}
+
+func TestVacuum_RelocateFails(t *testing.T) {
+	p := newLinkedDB(t, filepath.Join(t.TempDir(), "test.db"), 20, []uint32{3, 4, 5})
+	defer p.Close()
+
+	failure := errors.New("relocation failed")
+	relocate := relocateLinked(p)
+	moves := 0
+	err := p.Vacuum(func(from, to uint32) error {
+		if moves++; moves == 2 {
+			return failure
+		}
+		return relocate(from, to)
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("Expected the relocation error, got %v", err)
+	}
+
+	// The vacuum was rolled back as a whole
+	if p.NumPages() != 21 || p.FreelistCount() != 3 {
+		t.Errorf("Expected 21 pages with 3 free, got %d and %d", p.NumPages(), p.FreelistCount())
+	}
+	expectLinked(t, p, 16)
+}
+
+func TestTruncateFree(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p := newLinkedDB(t, dbPath, 40, []uint32{5, 38, 40, 39})
+
+	n, err := p.TruncateFree()
+	if err != nil {
+		t.Fatalf("Failed to truncate free pages: %v", err)
+	}
+	if n != 3 || p.NumPages() != 38 || p.FreelistCount() != 1 {
+		t.Errorf("Expected 3 pages cut off, 38 left with 1 free, got %d, %d and %d", n, p.NumPages(), p.FreelistCount())
+	}
+	expectLinked(t, p, 35)
+
+	// Nothing is left to cut off
+	if n, err := p.TruncateFree(); err != nil || n != 0 {
+		t.Errorf("Expected nothing cut off, got %d and %v", n, err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	p, err = New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer p.Close()
+	if p.NumPages() != 38 || p.FreelistCount() != 1 {
+		t.Errorf("Expected 38 pages with 1 free after reopen, got %d and %d", p.NumPages(), p.FreelistCount())
+	}
+	expectLinked(t, p, 35)
+}
@@ -0,0 +1,526 @@
+package pager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand/v2"
+	"sort"
+	"time"
+
+	"mash-db/internal/common"
+	"mash-db/pkg/vfs"
+)
+
+// WAL file layout
+//
+// The write-ahead log lives next to the database in "<path>-wal". It starts
+// with a fixed header followed by a sequence of frames, each holding one
+// sealed page image:
+//
+//	header: magic, version, page size, checkpoint sequence, salt1, salt2, checksum
+//	frame:  page number, commit size, salt1, salt2, checksum, page data
+//
+// A frame with a non-zero commit size ends a transaction and records the
+// database size in pages at that point. Frames after the last commit frame
+// belong to an unfinished transaction and are ignored on recovery. The salts
+// change on every checkpoint so stale frames left behind by an earlier
+// generation of the log are never mistaken for current ones.
+//
+// As in SQLite, the checksums are chained: each frame's checksum continues
+// from the one before it, and the first from the header's. Recovery stops at
+// the first frame that does not continue the chain, so frames left behind
+// by a rolled back transaction, or by a truncation that did not survive a
+// crash, cannot follow on from the frames that replaced them.
+const (
+	walMagic   = 0x4d574c31 // "MWL1"
+	walVersion = 2
+
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+
+	// DefaultWALAutoCheckpoint is the number of WAL frames that triggers an
+	// automatic checkpoint after a commit
+	DefaultWALAutoCheckpoint = 1000
+)
+
+var ErrCorruptWAL = errors.New("corrupt write-ahead log")
+
+// walPath returns the path of the WAL file for a database
+func walPath(dbPath string) string {
+	return dbPath + "-wal"
+}
+
+// wal is the write-ahead log of a single database
+// All methods must be called with the owning pager's lock held.
+type wal struct {
+	fs       vfs.FS
+	file     vfs.File
+	path     string
+	pageSize int
+
+	ckptSeq     uint32
+	salt1       uint32
+	salt2       uint32
+	chain       uint32 // Checksum of the last frame written, which the next continues
+	commitChain uint32 // Checksum of the last commit frame
+
+	committed map[uint32]int64 // Page number to offset of its latest committed frame
+	pending   map[uint32]int64 // Frames written after the last commit
+	dbSize    uint32           // Database size in pages recorded by the last commit
+	writeOff  int64            // Offset where the next frame is appended
+	commitOff int64            // Offset just past the last commit frame
+	frameBuf  []byte
+}
+
+// openWAL opens or creates the WAL for a database and recovers its committed frames
+func openWAL(fs vfs.FS, path string, pageSize int) (*wal, error) {
+	file, err := fs.Open(path, vfs.OpenCreate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal: %w", err)
+	}
+
+	w := &wal{
+		fs:        fs,
+		file:      file,
+		path:      path,
+		pageSize:  pageSize,
+		committed: make(map[uint32]int64),
+		pending:   make(map[uint32]int64),
+		frameBuf:  make([]byte, walFrameHeaderSize+pageSize),
+	}
+
+	if err := w.recover(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// frameSize returns the size of a frame including its header
+func (w *wal) frameSize() int64 {
+	return int64(walFrameHeaderSize + w.pageSize)
+}
+
+// recover loads the header and scans frames up to the last valid commit
+// An empty or unusable log is reset to a fresh header.
+func (w *wal) recover() error {
+	var hdr [walHeaderSize]byte
+	if _, err := w.file.ReadAt(hdr[:], 0); err != nil {
+		if err == io.EOF {
+			return w.reset()
+		}
+		return fmt.Errorf("failed to read wal header: %w", err)
+	}
+
+	if binary.LittleEndian.Uint32(hdr[0:]) != walMagic ||
+		binary.LittleEndian.Uint32(hdr[24:]) != crc32.Checksum(hdr[:24], castagnoli) {
+		// A torn header means no frame was ever committed under it
+		return w.reset()
+	}
+	if v := binary.LittleEndian.Uint32(hdr[4:]); v != walVersion {
+		return fmt.Errorf("%w: wal version %d", ErrUnsupportedVersion, v)
+	}
+	if int(binary.LittleEndian.Uint32(hdr[8:])) != w.pageSize {
+		return fmt.Errorf("%w: page size mismatch", ErrCorruptWAL)
+	}
+	w.ckptSeq = binary.LittleEndian.Uint32(hdr[12:])
+	w.salt1 = binary.LittleEndian.Uint32(hdr[16:])
+	w.salt2 = binary.LittleEndian.Uint32(hdr[20:])
+
+	// Frames are only trusted once a later commit frame vouches for them
+	frames := make(map[uint32]int64)
+	off := int64(walHeaderSize)
+	chain := binary.LittleEndian.Uint32(hdr[24:])
+	w.commitOff, w.commitChain = off, chain
+	for {
+		pageNum, commitSize, ok := w.readFrame(off, chain)
+		if !ok {
+			break
+		}
+		frames[pageNum] = off
+		off += w.frameSize()
+		chain = binary.LittleEndian.Uint32(w.frameBuf[16:])
+		if commitSize != 0 {
+			for pn, frameOff := range frames {
+				w.committed[pn] = frameOff
+			}
+			clear(frames)
+			w.dbSize = commitSize
+			w.commitOff, w.commitChain = off, chain
+		}
+	}
+	w.writeOff, w.chain = w.commitOff, w.commitChain
+	return nil
+}
+
+// readFrame reads the frame at off into frameBuf and validates it as the one
+// following a frame with checksum chain
+func (w *wal) readFrame(off int64, chain uint32) (pageNum, commitSize uint32, ok bool) {
+	buf := w.frameBuf
+	if n, _ := w.file.ReadAt(buf, off); n != len(buf) {
+		return 0, 0, false
+	}
+	if binary.LittleEndian.Uint32(buf[8:]) != w.salt1 || binary.LittleEndian.Uint32(buf[12:]) != w.salt2 {
+		return 0, 0, false
+	}
+	if binary.LittleEndian.Uint32(buf[16:]) != frameChecksum(chain, buf) {
+		return 0, 0, false
+	}
+	return binary.LittleEndian.Uint32(buf[0:]), binary.LittleEndian.Uint32(buf[4:]), true
+}
+
+// frameChecksum continues the checksum chain from the previous frame over
+// the frame header fields before the checksum and the page data
+func frameChecksum(chain uint32, frame []byte) uint32 {
+	crc := crc32.Update(chain, castagnoli, frame[:16])
+	return crc32.Update(crc, castagnoli, frame[walFrameHeaderSize:])
+}
+
+// reset starts a new generation of the log, discarding every frame
+func (w *wal) reset() error {
+	w.ckptSeq++
+	w.salt1 = rand.Uint32()
+	w.salt2 = rand.Uint32()
+
+	var hdr [walHeaderSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:], walMagic)
+	binary.LittleEndian.PutUint32(hdr[4:], walVersion)
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(w.pageSize))
+	binary.LittleEndian.PutUint32(hdr[12:], w.ckptSeq)
+	binary.LittleEndian.PutUint32(hdr[16:], w.salt1)
+	binary.LittleEndian.PutUint32(hdr[20:], w.salt2)
+	binary.LittleEndian.PutUint32(hdr[24:], crc32.Checksum(hdr[:24], castagnoli))
+
+	// Forget the frames first: once the log is truncated they are gone even
+	// if writing the new header fails
+	clear(w.committed)
+	clear(w.pending)
+	w.dbSize = 0
+	w.writeOff = walHeaderSize
+	w.commitOff = walHeaderSize
+	w.chain = binary.LittleEndian.Uint32(hdr[24:])
+	w.commitChain = w.chain
+
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate wal: %w", err)
+	}
+	if _, err := w.file.WriteAt(hdr[:], 0); err != nil {
+		return fmt.Errorf("failed to write wal header: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync wal: %w", err)
+	}
+	return nil
+}
+
+// appendFrame writes a sealed page image to the end of the log
+// A non-zero commitSize makes this frame the commit record of a transaction;
+// the caller syncs the log and then calls commit.
+func (w *wal) appendFrame(pageNum uint32, data []byte, commitSize uint32) error {
+	buf := w.frameBuf
+	binary.LittleEndian.PutUint32(buf[0:], pageNum)
+	binary.LittleEndian.PutUint32(buf[4:], commitSize)
+	binary.LittleEndian.PutUint32(buf[8:], w.salt1)
+	binary.LittleEndian.PutUint32(buf[12:], w.salt2)
+	copy(buf[walFrameHeaderSize:], data)
+	checksum := frameChecksum(w.chain, buf)
+	binary.LittleEndian.PutUint32(buf[16:], checksum)
+	binary.LittleEndian.PutUint32(buf[20:], 0)
+
+	if _, err := w.file.WriteAt(buf, w.writeOff); err != nil {
+		return fmt.Errorf("failed to write wal frame for page %d: %w", pageNum, err)
+	}
+	w.pending[pageNum] = w.writeOff
+	w.writeOff += w.frameSize()
+	w.chain = checksum
+	return nil
+}
+
+// commit promotes the pending frames once their commit frame is synced
+// Until then a failed commit can still be undone by rollback.
+func (w *wal) commit(dbSize uint32) {
+	for pn, off := range w.pending {
+		w.committed[pn] = off
+	}
+	clear(w.pending)
+	w.dbSize = dbSize
+	w.commitOff, w.commitChain = w.writeOff, w.chain
+}
+
+// sync makes every frame written so far durable
+func (w *wal) sync() error {
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync wal: %w", err)
+	}
+	return nil
+}
+
+// readPage reads the latest image of a page from the log into buf
+// It reports false if the log holds no frame for the page.
+func (w *wal) readPage(pageNum uint32, buf []byte) (bool, error) {
+	off, ok := w.pending[pageNum]
+	if !ok {
+		off, ok = w.committed[pageNum]
+	}
+	if !ok {
+		return false, nil
+	}
+	if _, err := w.file.ReadAt(buf, off+walFrameHeaderSize); err != nil {
+		return true, fmt.Errorf("failed to read wal frame for page %d: %w", pageNum, err)
+	}
+	return true, nil
+}
+
+// frameCount returns the number of frames in the log
+func (w *wal) frameCount() int {
+	return int((w.writeOff - walHeaderSize) / w.frameSize())
+}
+
+// checkpoint hands every committed page to write in page order, calls finish
+// to make them durable, and resets the log
+// Frames of an unfinished transaction must not exist when this is called.
+func (w *wal) checkpoint(write func(pageNum uint32, data []byte) error, finish func() error) error {
+	if len(w.pending) > 0 {
+		return fmt.Errorf("%w: checkpoint with uncommitted frames", ErrCorruptWAL)
+	}
+	if len(w.committed) == 0 {
+		return nil
+	}
+
+	// Copy pages in file order
+	pageNums := make([]uint32, 0, len(w.committed))
+	for pageNum := range w.committed {
+		pageNums = append(pageNums, pageNum)
+	}
+	sort.Slice(pageNums, func(i, j int) bool { return pageNums[i] < pageNums[j] })
+
+	data := make([]byte, w.pageSize)
+	for _, pageNum := range pageNums {
+		if _, err := w.file.ReadAt(data, w.committed[pageNum]+walFrameHeaderSize); err != nil {
+			return fmt.Errorf("failed to read wal frame for page %d: %w", pageNum, err)
+		}
+		if err := write(pageNum, data); err != nil {
+			return err
+		}
+	}
+	if err := finish(); err != nil {
+		return err
+	}
+
+	// Only now is it safe to forget the frames
+	return w.reset()
+}
+
+// close closes the log file, removing it when remove is set
+func (w *wal) close(remove bool) error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if remove {
+		return w.fs.Delete(w.path)
+	}
+	return nil
+}
+
+// commitWAL appends the header as the commit frame of a transaction and syncs
+// the log (must hold lock). Nothing is written if no page or header field
+// changed since the last commit.
+func (p *Pager) commitWAL() error {
+	p.header.PageCount = p.numPages.Load()
+	if len(p.wal.pending) == 0 && p.header == p.committed {
+		return nil
+	}
+	if err := p.logHoles(); err != nil {
+		return err
+	}
+	p.header.ChangeCounter++
+
+	header := p.sealPage(common.HeaderPageNum, p.headerPage())
+	if err := p.wal.appendFrame(common.HeaderPageNum, header, p.numPages.Load()); err != nil {
+		return err
+	}
+	if err := p.wal.sync(); err != nil {
+		return err
+	}
+	p.wal.commit(p.numPages.Load())
+	p.committed = p.header
+
+	if p.walAutoCheckpoint > 0 && p.wal.frameCount() >= p.walAutoCheckpoint {
+		// The transaction is durable already. A failed checkpoint leaves every
+		// frame in the log, so it is simply retried after the next commit.
+		p.checkpointWAL(p.wal)
+	}
+	if p.checkpointDue() {
+		p.writer.nudge()
+	}
+	return nil
+}
+
+// logHoles appends a sealed page of zeroes to the log for every page past
+// the end of the database file that has no frame (must hold lock)
+// Every page of the database is then in the file or the log, so a checkpoint
+// extends the file without leaving pages of zeroes inside it, and a crash in
+// the middle of one leaves none the log does not cover. A compressed
+// database keeps no pages in the file and has no holes.
+func (p *Pager) logHoles() error {
+	if p.store != nil {
+		return nil
+	}
+	size, err := p.file.Size()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	var zero []byte
+	for pageNum := uint32((size + int64(p.pageSize) - 1) / int64(p.pageSize)); pageNum < p.numPages.Load(); pageNum++ {
+		if _, ok := p.wal.pending[pageNum]; ok {
+			continue
+		}
+		if _, ok := p.wal.committed[pageNum]; ok {
+			continue
+		}
+		if zero == nil {
+			zero = make([]byte, p.pageSize)
+		}
+		if err := p.wal.appendFrame(pageNum, p.sealPage(pageNum, zero), 0); err != nil {
+			return err
+		}
+		p.countWrite()
+	}
+	return nil
+}
+
+// checkpointWAL copies the committed frames of w into the database file and
+// resets w (must hold lock)
+// In a compressed database the pages are stored as new records and the
+// header from the log is written last, pointing at the new page map.
+func (p *Pager) checkpointWAL(w *wal) error {
+	if err := p.checkpointFrames(w); err != nil {
+		return err
+	}
+	p.staleEnd = 0
+	p.lastCheckpoint = time.Now()
+	return nil
+}
+
+// checkpointFrames implements checkpointWAL
+// Pages cut off by a Truncate are dropped from the database file here.
+func (p *Pager) checkpointFrames(w *wal) error {
+	if p.store == nil {
+		return w.checkpoint(func(pageNum uint32, data []byte) error {
+			if _, err := p.file.WriteAt(data, p.pageOffset(pageNum)); err != nil {
+				return fmt.Errorf("failed to checkpoint page %d: %w", pageNum, err)
+			}
+			p.countWrite()
+			return nil
+		}, func() error {
+			if size, err := p.file.Size(); err == nil && size > p.pageOffset(w.dbSize) {
+				if err := p.file.Truncate(p.pageOffset(w.dbSize)); err != nil {
+					return fmt.Errorf("failed to truncate database: %w", err)
+				}
+			}
+			return p.syncFile()
+		})
+	}
+
+	var header Header
+	return w.checkpoint(func(pageNum uint32, data []byte) error {
+		if pageNum != common.HeaderPageNum {
+			if err := p.store.write(pageNum, data); err != nil {
+				return err
+			}
+			p.countWrite()
+			return nil
+		}
+		h, err := decodeHeader(data)
+		if err != nil {
+			return fmt.Errorf("%w: header frame: %v", ErrCorruptWAL, err)
+		}
+		header = h
+		return nil
+	}, func() error {
+		p.store.truncate(header.PageCount)
+		ref, crc, err := p.store.writeMap()
+		if err != nil {
+			return err
+		}
+		header.PageMapSlot, header.PageMapSlots, header.PageMapCRC = ref.start, ref.count, crc
+		if err := p.syncFile(); err != nil {
+			return err
+		}
+
+		buf := make([]byte, p.pageSize)
+		header.encode(buf)
+		if _, err := p.file.WriteAt(p.sealPage(common.HeaderPageNum, buf), 0); err != nil {
+			return fmt.Errorf("failed to write header: %w", err)
+		}
+		p.countWrite()
+		if err := p.syncFile(); err != nil {
+			return err
+		}
+
+		for _, h := range []*Header{&p.header, &p.committed} {
+			h.PageMapSlot, h.PageMapSlots, h.PageMapCRC = ref.start, ref.count, crc
+		}
+		return p.store.commit()
+	})
+}
+
+// syncFile makes every write to the database file durable (must hold lock)
+func (p *Pager) syncFile() error {
+	if err := p.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync database: %w", err)
+	}
+	return nil
+}
+
+// Checkpoint commits pending changes and copies the write-ahead log back into
+// the database file, leaving the log empty. It is a no-op outside WAL mode.
+func (p *Pager) Checkpoint() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.retryLatched(nil, func() error {
+		if p.closed.Load() {
+			return ErrFileClosed
+		}
+
+		if p.wal == nil {
+			return nil
+		}
+
+		if p.tx != nil {
+			return ErrTxActive
+		}
+
+		if err := p.flushAllInternal(); err != nil {
+			return err
+		}
+		return p.checkpointWAL(p.wal)
+	})
+}
+
+// WALFrameCount returns the number of frames currently in the write-ahead log
+func (p *Pager) WALFrameCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.wal == nil {
+		return 0
+	}
+	return p.wal.frameCount()
+}
+
+// rollback discards every frame written since the last commit
+// The truncation is synced, and the frames written next continue the chain
+// from the last commit frame, so the discarded ones never come back.
+func (w *wal) rollback() error {
+	if err := w.file.Truncate(w.commitOff); err != nil {
+		return fmt.Errorf("failed to truncate wal: %w", err)
+	}
+	clear(w.pending)
+	w.writeOff, w.chain = w.commitOff, w.commitChain
+	return w.sync()
+}
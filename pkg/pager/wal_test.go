@@ -0,0 +1,305 @@
+package pager
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mash-db/internal/common"
+	"mash-db/pkg/vfs"
+)
+
+// snapshotFiles copies a database and its sidecar files to a new location,
+// capturing what would be on disk if the process crashed right now
+func snapshotFiles(t *testing.T, dbPath string, suffixes ...string) string {
+	t.Helper()
+	dst := filepath.Join(t.TempDir(), "crashed.db")
+	for _, suffix := range append([]string{""}, suffixes...) {
+		raw, err := os.ReadFile(dbPath + suffix)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", dbPath+suffix, err)
+		}
+		if err := os.WriteFile(dst+suffix, raw, 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", dst+suffix, err)
+		}
+	}
+	return dst
+}
+
+func TestWAL_WritesGoToLog(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := NewWithOptions(dbPath, Options{CacheSize: 10, JournalMode: JournalModeWAL})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+
+	for i := uint32(1); i <= 3; i++ {
+		if err := p.WritePage(i, testPage(p, byte(i))); err != nil {
+			t.Fatalf("Failed to write page %d: %v", i, err)
+		}
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	// The database file still only holds the header written at creation
+	info, _ := os.Stat(dbPath)
+	if info.Size() != common.PageSize {
+		t.Errorf("Expected database size %d before checkpoint, got %d", common.PageSize, info.Size())
+	}
+	if p.WALFrameCount() != 4 {
+		t.Errorf("Expected 4 frames (3 pages + header), got %d", p.WALFrameCount())
+	}
+
+	// A flush with nothing to commit leaves the log alone
+	p.Flush()
+	if p.WALFrameCount() != 4 {
+		t.Errorf("Empty commit should not add frames, got %d", p.WALFrameCount())
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if _, err := os.Stat(walPath(dbPath)); !os.IsNotExist(err) {
+		t.Errorf("WAL should be removed on close, stat err: %v", err)
+	}
+
+	p2, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer p2.Close()
+	for i := uint32(1); i <= 3; i++ {
+		page, err := p2.ReadPage(i)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", i, err)
+		}
+		if page.Data[0] != byte(i) {
+			t.Errorf("Page %d: expected %d, got %d", i, i, page.Data[0])
+		}
+	}
+}
+
+func TestWAL_RecoverAfterCrash(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := NewWithOptions(dbPath, Options{CacheSize: 10, JournalMode: JournalModeWAL})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	p.WritePage(1, testPage(p, 1))
+	p.WritePage(2, testPage(p, 2))
+	p.SetSchemaCookie(7)
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	crashed := snapshotFiles(t, dbPath, "-wal")
+
+	// Replay happens on open, even in the default journal mode
+	p2, err := New(crashed, 10)
+	if err != nil {
+		t.Fatalf("Failed to open crashed database: %v", err)
+	}
+	defer p2.Close()
+
+	if _, err := os.Stat(walPath(crashed)); !os.IsNotExist(err) {
+		t.Errorf("WAL should be removed after replay, stat err: %v", err)
+	}
+	if p2.NumPages() != 3 {
+		t.Errorf("Expected 3 pages, got %d", p2.NumPages())
+	}
+	if p2.SchemaCookie() != 7 {
+		t.Errorf("Expected schema cookie 7, got %d", p2.SchemaCookie())
+	}
+	for i := uint32(1); i <= 2; i++ {
+		page, err := p2.ReadPage(i)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", i, err)
+		}
+		if page.Data[0] != byte(i) {
+			t.Errorf("Page %d: expected %d, got %d", i, i, page.Data[0])
+		}
+	}
+}
+
+func TestWAL_UncommittedFramesIgnored(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := NewWithOptions(dbPath, Options{CacheSize: 2, JournalMode: JournalModeWAL})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	p.WritePage(1, testPage(p, 1))
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	// Overwrite page 1 and push it out of the small cache without committing
+	p.WritePage(1, testPage(p, 99))
+	for i := uint32(2); i <= 5; i++ {
+		p.WritePage(i, testPage(p, byte(i)))
+	}
+
+	// This process still sees its own uncommitted writes
+	page, err := p.ReadPage(1)
+	if err != nil {
+		t.Fatalf("Failed to read page 1: %v", err)
+	}
+	if page.Data[0] != 99 {
+		t.Errorf("Expected uncommitted value 99, got %d", page.Data[0])
+	}
+	p.UnpinPage(1, false)
+
+	crashed := snapshotFiles(t, dbPath, "-wal")
+	p2, err := New(crashed, 10)
+	if err != nil {
+		t.Fatalf("Failed to open crashed database: %v", err)
+	}
+	defer p2.Close()
+
+	if p2.NumPages() != 2 {
+		t.Errorf("Expected 2 pages from last commit, got %d", p2.NumPages())
+	}
+	page, err = p2.ReadPage(1)
+	if err != nil {
+		t.Fatalf("Failed to read page 1: %v", err)
+	}
+	if page.Data[0] != 1 {
+		t.Errorf("Expected committed value 1, got %d", page.Data[0])
+	}
+}
+
+func TestWAL_TornTail(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := NewWithOptions(dbPath, Options{CacheSize: 10, JournalMode: JournalModeWAL})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	p.WritePage(1, testPage(p, 1))
+	p.Flush()
+	p.WritePage(1, testPage(p, 2))
+	p.Flush()
+
+	// Cut the second commit frame in half
+	crashed := snapshotFiles(t, dbPath, "-wal")
+	info, _ := os.Stat(walPath(crashed))
+	os.Truncate(walPath(crashed), info.Size()-common.PageSize/2)
+
+	p2, err := New(crashed, 10)
+	if err != nil {
+		t.Fatalf("Failed to open crashed database: %v", err)
+	}
+	defer p2.Close()
+
+	page, err := p2.ReadPage(1)
+	if err != nil {
+		t.Fatalf("Failed to read page 1: %v", err)
+	}
+	if page.Data[0] != 1 {
+		t.Errorf("Expected first commit's value 1, got %d", page.Data[0])
+	}
+}
+
+func TestWAL_Checkpoint(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	p, err := NewWithOptions(dbPath, Options{
+		CacheSize:         10,
+		JournalMode:       JournalModeWAL,
+		WALAutoCheckpoint: 5,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	// Each commit adds a page frame and a header frame
+	p.WritePage(1, testPage(p, 1))
+	p.Flush()
+	if p.WALFrameCount() != 2 {
+		t.Errorf("Expected 2 frames, got %d", p.WALFrameCount())
+	}
+	p.WritePage(2, testPage(p, 2))
+	p.Flush()
+	p.WritePage(3, testPage(p, 3))
+	p.Flush()
+
+	// Six frames crossed the threshold of five
+	if p.WALFrameCount() != 0 {
+		t.Errorf("Expected automatic checkpoint to empty the log, got %d frames", p.WALFrameCount())
+	}
+	info, _ := os.Stat(dbPath)
+	if info.Size() != 4*common.PageSize {
+		t.Errorf("Expected database size %d after checkpoint, got %d", 4*common.PageSize, info.Size())
+	}
+
+	p.WritePage(4, testPage(p, 4))
+	if err := p.Checkpoint(); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	if p.WALFrameCount() != 0 {
+		t.Errorf("Expected empty log after checkpoint, got %d frames", p.WALFrameCount())
+	}
+	info, _ = os.Stat(dbPath)
+	if info.Size() != 5*common.PageSize {
+		t.Errorf("Expected database size %d after checkpoint, got %d", 5*common.PageSize, info.Size())
+	}
+}
+
+func TestWAL_StaleFramesAfterRollback(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	w, err := openWAL(fsys, "test.db-wal", common.PageSize)
+	if err != nil {
+		t.Fatalf("Failed to open wal: %v", err)
+	}
+	if err := w.appendFrame(1, bytes.Repeat([]byte{1}, common.PageSize), 2); err != nil {
+		t.Fatalf("Failed to append frame: %v", err)
+	}
+	w.commit(2)
+
+	// A transaction whose commit frame is written but never made it
+	w.appendFrame(2, bytes.Repeat([]byte{2}, common.PageSize), 0)
+	w.appendFrame(0, bytes.Repeat([]byte{0}, common.PageSize), 3)
+	stale := make([]byte, w.frameSize())
+	staleOff := w.writeOff - w.frameSize()
+	w.file.ReadAt(stale, staleOff)
+	if err := w.rollback(); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+
+	// The next transaction writes a frame in the same place, and a crash
+	// brings back the stale commit frame behind it
+	w.appendFrame(3, bytes.Repeat([]byte{3}, common.PageSize), 0)
+	w.file.WriteAt(stale, staleOff)
+	w.file.Close()
+
+	w, err = openWAL(fsys, "test.db-wal", common.PageSize)
+	if err != nil {
+		t.Fatalf("Failed to reopen wal: %v", err)
+	}
+	defer w.close(false)
+	if len(w.committed) != 1 || w.dbSize != 2 {
+		t.Errorf("Expected only the first commit recovered, got %d pages and size %d", len(w.committed), w.dbSize)
+	}
+	if _, ok := w.committed[3]; ok {
+		t.Errorf("Expected the frame of the unfinished transaction to be ignored")
+	}
+}
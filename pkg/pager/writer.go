@@ -0,0 +1,222 @@
+package pager
+
+import (
+	"sync"
+	"time"
+)
+
+// Background writer
+//
+// With Options.WriterInterval set, a goroutine owned by the Pager wakes up
+// periodically and writes dirty, unpinned pages out ahead of eviction, so a
+// reader that needs room in the cache almost always finds a clean page to
+// drop. It is also woken whenever eviction had to write a page itself.
+// Pages are written exactly as eviction writes them: the journal or the
+// write-ahead log still protects them, and nothing is committed.
+//
+// With Options.CheckpointInterval set in WAL mode the same goroutine also
+// checkpoints the log once the interval has passed since the last
+// checkpoint. Frames not committed yet keep the log from being checkpointed,
+// so while a checkpoint is due the writer writes no pages to the log and the
+// next commit wakes it to checkpoint.
+//
+// A failed write leaves its page dirty and a failed checkpoint leaves the
+// log as it was, so both are simply retried on the next run.
+// Options.OnWriteError hears about failures that persist.
+const (
+	writerBatchSize   = 32 // Pages written per hold of the pager's lock
+	writerReportAfter = 3  // Consecutive failed runs before OnWriteError is called
+)
+
+// bgWriter is the background goroutine of a Pager
+type bgWriter struct {
+	p                  *Pager
+	interval           time.Duration
+	checkpointInterval time.Duration
+	dirtyRatio         float64
+	onError            func(error)
+
+	wake     chan struct{} // Buffered; a pending wake-up is never lost
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	writeFailures      int // Consecutive failed runs
+	checkpointFailures int
+}
+
+// startWriter starts the background goroutine if opts asks for one
+func (p *Pager) startWriter(opts Options) {
+	if opts.WriterInterval <= 0 && opts.CheckpointInterval <= 0 {
+		return
+	}
+	p.writer = &bgWriter{
+		p:                  p,
+		interval:           opts.WriterInterval,
+		checkpointInterval: opts.CheckpointInterval,
+		dirtyRatio:         opts.WriterDirtyRatio,
+		onError:            opts.OnWriteError,
+		wake:               make(chan struct{}, 1),
+		stop:               make(chan struct{}),
+		done:               make(chan struct{}),
+	}
+	p.lastCheckpoint = time.Now()
+	go p.writer.run()
+}
+
+func (w *bgWriter) run() {
+	defer close(w.done)
+
+	var writeTick, checkpointTick <-chan time.Time
+	if w.interval > 0 {
+		t := time.NewTicker(w.interval)
+		defer t.Stop()
+		writeTick = t.C
+	}
+	if w.checkpointInterval > 0 {
+		t := time.NewTicker(w.checkpointInterval)
+		defer t.Stop()
+		checkpointTick = t.C
+	}
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-writeTick:
+			w.writeBack()
+		case <-w.wake:
+			w.checkpoint()
+			w.writeBack()
+		case <-checkpointTick:
+			w.checkpoint()
+		}
+	}
+}
+
+// writeBack runs Pager.writeBack if the writer writes pages
+func (w *bgWriter) writeBack() {
+	if w.interval > 0 {
+		w.report(&w.writeFailures, w.p.writeBack(w.dirtyRatio))
+	}
+}
+
+// checkpoint runs Pager.checkpointIdle if the writer checkpoints
+func (w *bgWriter) checkpoint() {
+	if w.checkpointInterval > 0 {
+		w.report(&w.checkpointFailures, w.p.checkpointIdle())
+	}
+}
+
+// report tracks consecutive failures and passes on those that persist
+func (w *bgWriter) report(failures *int, err error) {
+	if err == nil {
+		*failures = 0
+		return
+	}
+	*failures++
+	if *failures == writerReportAfter && w.onError != nil {
+		w.onError(err)
+	}
+}
+
+// nudge wakes the writer without waiting for its next run
+func (w *bgWriter) nudge() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close stops the writer and waits for it to finish its current run
+// It must be called without the pager's lock held.
+func (w *bgWriter) close() {
+	w.stopOnce.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+// writeBack writes dirty, unpinned pages to disk once more than ratio of the
+// cache holds them, until it no longer does
+// The pager's lock is released between batches so readers are not held up.
+// Pages go out in page number order, so adjacent ones are written together.
+func (p *Pager) writeBack(ratio float64) error {
+	// A pinned page may be changing under its user, so not even its dirty
+	// flag is looked at
+	var dirty []*CacheEntry
+	p.mu.Lock()
+	if p.checkpointDue() {
+		// Pages written now would keep the log from being checkpointed
+		p.mu.Unlock()
+		return nil
+	}
+	p.cache.ForEach(func(pageNum uint32, page *Page) bool {
+		if page.PinCnt == 0 && page.Dirty {
+			dirty = append(dirty, &CacheEntry{PageNum: pageNum, Page: page})
+		}
+		return true
+	})
+	excess := len(dirty) - int(ratio*float64(p.cache.Capacity()))
+	p.mu.Unlock()
+	sortEntries(dirty)
+
+	for len(dirty) > 0 && excess > 0 {
+		n := min(len(dirty), writerBatchSize)
+		written, err := p.writeBatch(dirty[:n], excess)
+		if err != nil {
+			return err
+		}
+		dirty = dirty[n:]
+		excess -= written
+	}
+	return nil
+}
+
+// writeBatch writes up to limit of the given pages that are still cached,
+// dirty and unpinned, and returns how many it wrote
+func (p *Pager) writeBatch(entries []*CacheEntry, limit int) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed.Load() {
+		return 0, nil
+	}
+
+	var run []*CacheEntry
+	for _, entry := range entries {
+		if len(run) == limit {
+			break
+		}
+		page := p.cache.Peek(entry.PageNum)
+		if page != entry.Page || !page.Dirty || p.cache.Pinned(entry.PageNum) {
+			continue
+		}
+		run = append(run, entry)
+	}
+	if err := p.flushPages(run); err != nil {
+		return 0, err
+	}
+	return len(run), nil
+}
+
+// checkpointIdle checkpoints the write-ahead log if a checkpoint is due,
+// unless a transaction has frames in it
+func (p *Pager) checkpointIdle() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed.Load() || !p.checkpointDue() || len(p.wal.pending) > 0 {
+		return nil
+	}
+	if p.wal.frameCount() == 0 {
+		p.lastCheckpoint = time.Now()
+		return nil
+	}
+	return p.checkpointWAL(p.wal)
+}
+
+// checkpointDue reports whether the background writer's checkpoint interval
+// has passed since the log was last checkpointed (must hold lock)
+func (p *Pager) checkpointDue() bool {
+	return p.wal != nil && p.writer != nil && p.writer.checkpointInterval > 0 &&
+		time.Since(p.lastCheckpoint) >= p.writer.checkpointInterval
+}
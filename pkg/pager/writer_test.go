@@ -0,0 +1,208 @@
+package pager
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"mash-db/pkg/vfs"
+)
+
+// dirtyCount returns how many cached pages are dirty
+func dirtyCount(p *Pager) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.cache.GetAllDirty())
+}
+
+// waitFor polls cond until it holds or a generous deadline passes
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBackgroundWriter_CleansDirtyPages(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	p, err := NewWithOptions(dbPath, Options{CacheSize: 10, WriterInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	for i := uint32(1); i <= 5; i++ {
+		p.WritePage(i, testPage(p, byte(i)))
+	}
+	waitFor(t, "dirty pages to be written", func() bool { return dirtyCount(p) == 0 })
+
+	// A pinned page is left alone
+	page, err := p.GetPage(6)
+	if err != nil {
+		t.Fatalf("Failed to get page: %v", err)
+	}
+	page.Data[0] = 6
+	page.Dirty = true
+	time.Sleep(20 * time.Millisecond)
+	if !page.Dirty {
+		t.Error("Pinned page was written in the background")
+	}
+	p.UnpinPage(6, true)
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	p2, err := New(dbPath, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer p2.Close()
+	expectPages(t, p2, 5, func(i uint32) byte { return byte(i) })
+}
+
+func TestBackgroundWriter_DirtyRatio(t *testing.T) {
+	p, err := NewWithOptions(filepath.Join(t.TempDir(), "test.db"),
+		Options{CacheSize: 10, WriterInterval: time.Millisecond, WriterDirtyRatio: 0.5})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	for i := uint32(1); i <= 4; i++ {
+		p.WritePage(i, testPage(p, byte(i)))
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := dirtyCount(p); n != 4 {
+		t.Errorf("Expected pages below the ratio to stay dirty, got %d dirty", n)
+	}
+
+	for i := uint32(5); i <= 9; i++ {
+		p.WritePage(i, testPage(p, byte(i)))
+	}
+	waitFor(t, "the dirty ratio to be restored", func() bool { return dirtyCount(p) <= 5 })
+}
+
+func TestBackgroundWriter_ReportsPersistentFailure(t *testing.T) {
+	ffs := vfs.NewFaultFS(1)
+	errs := make(chan error, 10)
+	p, err := NewWithOptions("test.db", Options{
+		CacheSize:      10,
+		FS:             ffs,
+		WriterInterval: time.Millisecond,
+		OnWriteError:   func(err error) { errs <- err },
+	})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	for n := range 2 * writerReportAfter {
+		ffs.InjectError(vfs.OpWrite, n+1, syscall.EIO)
+	}
+	p.WritePage(1, testPage(p, 1))
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, syscall.EIO) {
+			t.Errorf("Expected EIO to be reported, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Persistent write failure was not reported")
+	}
+
+	// The page is retried until the disk recovers
+	waitFor(t, "the page to be written", func() bool { return dirtyCount(p) == 0 })
+}
+
+func TestBackgroundWriter_PeriodicCheckpoint(t *testing.T) {
+	p, err := NewWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{
+		JournalMode:        JournalModeWAL,
+		WALAutoCheckpoint:  -1,
+		CheckpointInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	for i := uint32(1); i <= 3; i++ {
+		p.WritePage(i, testPage(p, byte(i)))
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	waitFor(t, "the log to be checkpointed", func() bool { return p.WALFrameCount() == 0 })
+	expectPages(t, p, 3, func(i uint32) byte { return byte(i) })
+}
+
+func TestBackgroundWriter_CheckpointWithWriter(t *testing.T) {
+	const interval = 200 * time.Millisecond
+	p, err := NewWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{
+		JournalMode:        JournalModeWAL,
+		WALAutoCheckpoint:  -1,
+		WriterInterval:     time.Millisecond,
+		CheckpointInterval: interval,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	for i := uint32(1); i <= 3; i++ {
+		p.WritePage(i, testPage(p, byte(i)))
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	// The frame the writer leaves uncommitted holds the checkpoint off
+	p.WritePage(4, testPage(p, 4))
+	waitFor(t, "page 4 to be written out", func() bool { return dirtyCount(p) == 0 })
+	frames := p.WALFrameCount()
+	time.Sleep(interval + 20*time.Millisecond)
+	if n := p.WALFrameCount(); n != frames {
+		t.Errorf("Expected %d frames left with one uncommitted, got %d", frames, n)
+	}
+
+	// Once the checkpoint is due the writer writes nothing more to the log,
+	// and the next commit checkpoints it
+	p.WritePage(5, testPage(p, 5))
+	time.Sleep(20 * time.Millisecond)
+	if n := dirtyCount(p); n != 1 {
+		t.Errorf("Expected the writer to hold page 5 back, got %d dirty pages", n)
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	waitFor(t, "the log to be checkpointed", func() bool { return p.WALFrameCount() == 0 })
+	expectPages(t, p, 5, func(i uint32) byte { return byte(i) })
+}
+
+func TestEvictionWriteFailure_KeepsPage(t *testing.T) {
+	ffs := vfs.NewFaultFS(1)
+	p, err := NewWithOptions("test.db", Options{CacheSize: 2, FS: ffs})
+	if err != nil {
+		t.Fatalf("Failed to create pager: %v", err)
+	}
+	defer p.Close()
+
+	p.WritePage(1, testPage(p, 1))
+	p.WritePage(2, testPage(p, 2))
+
+	ffs.InjectError(vfs.OpWrite, 1, syscall.EIO)
+	if _, err := p.ReadPage(3); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("Expected the eviction write to fail with EIO, got %v", err)
+	}
+	if n := dirtyCount(p); n != 2 {
+		t.Errorf("Expected both dirty pages to stay cached, got %d", n)
+	}
+
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	expectPages(t, p, 2, func(i uint32) byte { return byte(i) })
+}
@@ -0,0 +1,320 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"sync"
+)
+
+// SectorSize is the unit in which FaultFS tears unsynced writes on a crash
+const SectorSize = 512
+
+// ErrCrashed is returned by every operation after a simulated power loss
+// until FaultFS.Restart is called, and by Files opened before it forever.
+var ErrCrashed = errors.New("simulated power loss")
+
+// Op is a kind of file operation FaultFS can fail
+type Op int
+
+const (
+	OpRead  Op = iota // File.ReadAt
+	OpWrite           // File.WriteAt
+	OpSync            // File.Sync
+
+	// opOther covers operations that never have errors injected
+	opOther Op = -1
+)
+
+// FaultFS is an in-memory FS for crash and I/O error testing
+// It tracks, for every file, what has been made durable by Sync separately
+// from what has merely been written. A simulated crash throws away the
+// unsynced part, optionally keeping a random subset of its sectors the way a
+// real disk may persist some writes but not others.
+//
+// Deletes take effect durably at once, and a newly created file exists from
+// the start, empty until its first Sync.
+type FaultFS struct {
+	mu      sync.Mutex
+	files   map[string]*faultData
+	rng     *rand.Rand
+	gen     int // Bumped by Restart; Files of older generations are dead
+	crashed bool
+
+	mutations int // Writes, syncs, truncates and deletes so far
+	crashAt   int // Mutation that triggers a crash; zero for none
+	faults    []*fault
+}
+
+// faultData is one file of a FaultFS
+type faultData struct {
+	data   []byte // Contents as seen by readers
+	synced []byte // Contents that survive a crash
+}
+
+// fault fails the remaining'th next call of op with err
+type fault struct {
+	op        Op
+	remaining int
+	err       error
+}
+
+// NewFaultFS returns an empty FaultFS whose crash behaviour is derived from seed
+func NewFaultFS(seed uint64) *FaultFS {
+	return &FaultFS{
+		files: make(map[string]*faultData),
+		rng:   rand.New(rand.NewPCG(seed, seed)),
+	}
+}
+
+// InjectError makes the nth call of op from now on fail with err
+// The call fails without any effect, as a full disk (ENOSPC) or a failing
+// device (EIO) would report.
+func (f *FaultFS) InjectError(op Op, n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &fault{op: op, remaining: n, err: err})
+}
+
+// CrashAfter simulates a power loss in place of the nth mutating operation
+// from now on. That operation and everything after it fail with ErrCrashed.
+func (f *FaultFS) CrashAfter(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.crashAt = f.mutations + n
+}
+
+// Crash simulates a power loss right now
+func (f *FaultFS) Crash() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.crashed = true
+}
+
+// Mutations returns the number of writes, syncs, truncates and deletes so far
+// It is useful for picking crash points after a dry run of a workload.
+func (f *FaultFS) Mutations() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.mutations
+}
+
+// Restart brings the FS back after a crash with only durable data left
+// With tear set, each unsynced sector independently survives or is lost,
+// and a file whose size changed since its last Sync ends up with either
+// size. Files opened before the restart stay unusable.
+func (f *FaultFS) Restart(tear bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, d := range f.files {
+		if tear {
+			d.tear(f.rng)
+		}
+		d.data = append(d.data[:0], d.synced...)
+	}
+	f.gen++
+	f.crashed = false
+	f.crashAt = 0
+	f.faults = nil
+}
+
+// tear merges a random subset of unsynced sectors into the durable image
+func (d *faultData) tear(rng *rand.Rand) {
+	size := len(d.synced)
+	if len(d.data) != size && rng.IntN(2) == 0 {
+		size = len(d.data)
+	}
+	torn := make([]byte, size)
+	copy(torn, d.synced)
+	for off := 0; off < size; off += SectorSize {
+		end := min(off+SectorSize, size)
+		if off < len(d.data) && rng.IntN(2) == 0 {
+			clear(torn[off:end])
+			copy(torn[off:end], d.data[off:min(end, len(d.data))])
+		}
+	}
+	d.synced = torn
+}
+
+// check accounts for one operation and returns the error it must fail with
+// (must hold mu)
+func (f *FaultFS) check(op Op, mutating bool) error {
+	if f.crashed {
+		return ErrCrashed
+	}
+	if mutating {
+		f.mutations++
+		if f.mutations == f.crashAt {
+			f.crashed = true
+			return ErrCrashed
+		}
+	}
+	// Every armed fault counts the call, even once one of them has fired
+	var err error
+	armed := f.faults[:0]
+	for _, flt := range f.faults {
+		if flt.op == op {
+			flt.remaining--
+		}
+		if flt.op != op || flt.remaining != 0 {
+			armed = append(armed, flt)
+		} else if err == nil {
+			err = flt.err
+		}
+	}
+	clear(f.faults[len(armed):])
+	f.faults = armed
+	return err
+}
+
+func (f *FaultFS) Open(name string, flag OpenFlag) (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return nil, ErrCrashed
+	}
+	d, ok := f.files[name]
+	if !ok {
+		if flag&OpenCreate == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		d = &faultData{}
+		f.files[name] = d
+	}
+	return &faultFile{fs: f, d: d, gen: f.gen}, nil
+}
+
+func (f *FaultFS) Delete(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(opOther, true); err != nil {
+		return err
+	}
+	if _, ok := f.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(f.files, name)
+	return nil
+}
+
+func (f *FaultFS) Exists(name string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return false, ErrCrashed
+	}
+	_, ok := f.files[name]
+	return ok, nil
+}
+
+// faultFile is an open file of a FaultFS
+type faultFile struct {
+	fs     *FaultFS
+	d      *faultData
+	gen    int
+	closed bool
+}
+
+// check accounts for one operation on the file and returns the error it must
+// fail with (must hold fs.mu)
+func (f *faultFile) check(op Op, mutating bool) error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	if f.gen != f.fs.gen {
+		return ErrCrashed
+	}
+	return f.fs.check(op, mutating)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(OpRead, false); err != nil {
+		return 0, err
+	}
+
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(OpWrite, true); err != nil {
+		return 0, err
+	}
+
+	if end := int(off) + len(p); end > len(f.d.data) {
+		f.d.data = append(f.d.data, make([]byte, end-len(f.d.data))...)
+	}
+	return copy(f.d.data[off:], p), nil
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(OpSync, true); err != nil {
+		return err
+	}
+
+	f.d.synced = append(f.d.synced[:0], f.d.data...)
+	return nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(opOther, true); err != nil {
+		return err
+	}
+
+	if int(size) <= len(f.d.data) {
+		f.d.data = f.d.data[:size]
+	} else {
+		f.d.data = append(f.d.data, make([]byte, int(size)-len(f.d.data))...)
+	}
+	return nil
+}
+
+func (f *faultFile) Size() (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(opOther, false); err != nil {
+		return 0, err
+	}
+	return int64(len(f.d.data)), nil
+}
+
+func (f *faultFile) Lock(typ LockType, start, length int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.check(opOther, false)
+}
+
+func (f *faultFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
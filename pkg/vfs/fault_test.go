@@ -0,0 +1,143 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestFaultFS_CrashDropsUnsyncedWrites(t *testing.T) {
+	ffs := NewFaultFS(1)
+	f, _ := ffs.Open("test.db", OpenCreate)
+
+	f.WriteAt([]byte("durable"), 0)
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	f.WriteAt([]byte("volatile"), 0)
+	f.WriteAt([]byte("tail"), 100)
+
+	ffs.Crash()
+	if _, err := f.WriteAt([]byte("x"), 0); !errors.Is(err, ErrCrashed) {
+		t.Fatalf("Expected ErrCrashed after crash, got %v", err)
+	}
+
+	ffs.Restart(false)
+	if _, err := f.ReadAt(make([]byte, 1), 0); !errors.Is(err, ErrCrashed) {
+		t.Fatalf("Expected files opened before the crash to stay dead, got %v", err)
+	}
+
+	f2, err := ffs.Open("test.db", 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	if size, _ := f2.Size(); size != 7 {
+		t.Errorf("Expected size 7, got %d", size)
+	}
+	buf := make([]byte, 7)
+	f2.ReadAt(buf, 0)
+	if string(buf) != "durable" {
+		t.Errorf("Expected durable, got %q", buf)
+	}
+}
+
+func TestFaultFS_TearKeepsWholeSectors(t *testing.T) {
+	ffs := NewFaultFS(7)
+	f, _ := ffs.Open("test.db", OpenCreate)
+
+	const sectors = 64
+	f.WriteAt(bytes.Repeat([]byte{1}, sectors*SectorSize), 0)
+	f.Sync()
+	f.WriteAt(bytes.Repeat([]byte{2}, sectors*SectorSize), 0)
+
+	ffs.Crash()
+	ffs.Restart(true)
+
+	f2, _ := ffs.Open("test.db", 0)
+	buf := make([]byte, sectors*SectorSize)
+	f2.ReadAt(buf, 0)
+
+	var kept, lost int
+	for i := 0; i < sectors; i++ {
+		sector := buf[i*SectorSize : (i+1)*SectorSize]
+		switch {
+		case bytes.Equal(sector, bytes.Repeat([]byte{2}, SectorSize)):
+			kept++
+		case bytes.Equal(sector, bytes.Repeat([]byte{1}, SectorSize)):
+			lost++
+		default:
+			t.Fatalf("Sector %d is torn inside", i)
+		}
+	}
+	if kept == 0 || lost == 0 {
+		t.Errorf("Expected a mix of kept and lost sectors, got %d kept, %d lost", kept, lost)
+	}
+}
+
+func TestFaultFS_CrashAfter(t *testing.T) {
+	ffs := NewFaultFS(1)
+	f, _ := ffs.Open("test.db", OpenCreate)
+
+	ffs.CrashAfter(3)
+	f.WriteAt([]byte("a"), 0)
+	f.Sync()
+	if _, err := f.WriteAt([]byte("b"), 1); !errors.Is(err, ErrCrashed) {
+		t.Fatalf("Expected the third mutation to crash, got %v", err)
+	}
+	if ffs.Mutations() != 3 {
+		t.Errorf("Expected 3 mutations, got %d", ffs.Mutations())
+	}
+
+	ffs.Restart(false)
+	f2, _ := ffs.Open("test.db", 0)
+	if size, _ := f2.Size(); size != 1 {
+		t.Errorf("Expected only the synced byte, got size %d", size)
+	}
+}
+
+func TestFaultFS_InjectError(t *testing.T) {
+	ffs := NewFaultFS(1)
+	f, _ := ffs.Open("test.db", OpenCreate)
+
+	ffs.InjectError(OpWrite, 2, syscall.ENOSPC)
+	ffs.InjectError(OpSync, 1, syscall.EIO)
+	ffs.InjectError(OpRead, 1, syscall.EIO)
+
+	if _, err := f.WriteAt([]byte("a"), 0); err != nil {
+		t.Fatalf("Expected first write to succeed, got %v", err)
+	}
+	if _, err := f.WriteAt([]byte("b"), 1); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Expected ENOSPC on second write, got %v", err)
+	}
+	if _, err := f.WriteAt([]byte("c"), 1); err != nil {
+		t.Fatalf("Expected faults to fire once, got %v", err)
+	}
+	if err := f.Sync(); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("Expected EIO on sync, got %v", err)
+	}
+	if _, err := f.ReadAt(make([]byte, 1), 0); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("Expected EIO on read, got %v", err)
+	}
+
+	// Faults on the same operation all count every call, whichever fires
+	ffs.InjectError(OpWrite, 1, syscall.ENOSPC)
+	ffs.InjectError(OpWrite, 2, syscall.EIO)
+	if _, err := f.WriteAt([]byte("d"), 1); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Expected ENOSPC on the next write, got %v", err)
+	}
+	if _, err := f.WriteAt([]byte("e"), 1); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("Expected EIO on the write after, got %v", err)
+	}
+	if _, err := f.WriteAt([]byte("f"), 1); err != nil {
+		t.Fatalf("Expected no faults left, got %v", err)
+	}
+
+	// The failed sync made nothing durable
+	ffs.Crash()
+	ffs.Restart(false)
+	f2, _ := ffs.Open("test.db", 0)
+	if size, _ := f2.Size(); size != 0 {
+		t.Errorf("Expected empty file after crash, got size %d", size)
+	}
+}
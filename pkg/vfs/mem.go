@@ -0,0 +1,154 @@
+package vfs
+
+import (
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// MemFS is an FS that keeps every file in memory
+// Files outlive the Files opened on them and are only discarded by Delete or
+// when the MemFS itself is dropped. Sync is a no-op and Lock always
+// succeeds, so a MemFS should be used by a single pager.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+}
+
+// memData is the contents of one in-memory file
+type memData struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+// NewMemFS returns an empty in-memory FS
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string]*memData)}
+}
+
+func (m *MemFS) Open(name string, flag OpenFlag) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.files[name]
+	if !ok {
+		if flag&OpenCreate == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		d = &memData{}
+		m.files[name] = d
+	}
+	return &memFile{d: d}, nil
+}
+
+func (m *MemFS) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *MemFS) Exists(name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.files[name]
+	return ok, nil
+}
+
+// memFile is an open file of a MemFS
+type memFile struct {
+	d      *memData
+	closed bool
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	f.d.mu.RLock()
+	defer f.d.mu.RUnlock()
+
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(f.d.data)) {
+		f.d.resize(end)
+	}
+	return copy(f.d.data[off:], p), nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	f.d.resize(size)
+	return nil
+}
+
+func (f *memFile) Size() (int64, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	f.d.mu.RLock()
+	defer f.d.mu.RUnlock()
+	return int64(len(f.d.data)), nil
+}
+
+func (f *memFile) Lock(typ LockType, start, length int64) error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// resize grows or shrinks the file to size bytes, zero-filling any growth
+func (d *memData) resize(size int64) {
+	if size <= int64(cap(d.data)) {
+		old := len(d.data)
+		d.data = d.data[:size]
+		if int(size) > old {
+			clear(d.data[old:])
+		}
+		return
+	}
+	grown := make([]byte, size, max(size, 2*int64(cap(d.data))))
+	copy(grown, d.data)
+	d.data = grown
+}
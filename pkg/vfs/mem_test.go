@@ -0,0 +1,69 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+)
+
+func TestMemFS_OpenMissing(t *testing.T) {
+	m := NewMemFS()
+
+	if _, err := m.Open("missing.db", 0); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected fs.ErrNotExist, got %v", err)
+	}
+	if err := m.Delete("missing.db"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected fs.ErrNotExist on delete, got %v", err)
+	}
+}
+
+func TestMemFS_ReadWriteTruncate(t *testing.T) {
+	m := NewMemFS()
+	f, err := m.Open("test.db", OpenCreate)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	if _, err := f.WriteAt([]byte("hello"), 10); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if size, _ := f.Size(); size != 15 {
+		t.Errorf("Expected size 15, got %d", size)
+	}
+
+	buf := make([]byte, 15)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil || n != 15 || string(buf[10:]) != "hello" || buf[0] != 0 {
+		t.Errorf("Unexpected read %q, %v", buf[:n], err)
+	}
+	if _, err := f.ReadAt(buf, 12); err != io.EOF {
+		t.Errorf("Expected io.EOF on short read, got %v", err)
+	}
+
+	// Shrinking and growing again must not resurrect old bytes
+	f.Truncate(11)
+	f.Truncate(15)
+	f.ReadAt(buf, 0)
+	if buf[10] != 'h' || buf[11] != 0 {
+		t.Errorf("Expected zeroes after regrowing, got %q", buf[10:])
+	}
+
+	// Contents outlive the open file
+	f.Close()
+	f2, err := m.Open("test.db", 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	if size, _ := f2.Size(); size != 15 {
+		t.Errorf("Expected size 15 after reopen, got %d", size)
+	}
+	f2.Close()
+
+	if err := m.Delete("test.db"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if exists, _ := m.Exists("test.db"); exists {
+		t.Error("Expected file to be gone")
+	}
+}
@@ -0,0 +1,52 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+)
+
+// OS is the FS backed by the local file system
+var OS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Open(name string, flag OpenFlag) (File, error) {
+	mode := os.O_RDWR
+	if flag&OpenCreate != 0 {
+		mode |= os.O_CREATE
+	}
+	f, err := os.OpenFile(name, mode, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &osFile{File: f}, nil
+}
+
+func (osFS) Delete(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Exists(name string) (bool, error) {
+	_, err := os.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// osFile adds Size and Lock to *os.File
+type osFile struct {
+	*os.File
+}
+
+func (f *osFile) Size() (int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (f *osFile) Lock(typ LockType, start, length int64) error {
+	return lockRange(f.File, typ, start, length)
+}
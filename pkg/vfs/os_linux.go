@@ -0,0 +1,45 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// Open file description locks belong to the open file rather than the
+// process, so two pagers in one process exclude each other just like two
+// processes do.
+const (
+	fOFDSetLk = 37
+)
+
+// lockRange applies a non-blocking lock to a byte range of f
+func lockRange(f *os.File, typ LockType, start, length int64) error {
+	lk := syscall.Flock_t{
+		Whence: 0,
+		Start:  start,
+		Len:    length,
+	}
+	switch typ {
+	case ReadLock:
+		lk.Type = syscall.F_RDLCK
+	case WriteLock:
+		lk.Type = syscall.F_WRLCK
+	default:
+		lk.Type = syscall.F_UNLCK
+	}
+
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var lockErr error
+	if err := conn.Control(func(fd uintptr) {
+		lockErr = syscall.FcntlFlock(fd, fOFDSetLk, &lk)
+	}); err != nil {
+		return err
+	}
+	if lockErr == syscall.EAGAIN || lockErr == syscall.EACCES {
+		return ErrBusy
+	}
+	return lockErr
+}
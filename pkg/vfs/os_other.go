@@ -0,0 +1,10 @@
+//go:build !unix
+
+package vfs
+
+import "os"
+
+// lockRange fails where advisory record locks are unavailable
+func lockRange(f *os.File, typ LockType, start, length int64) error {
+	return ErrLockingUnsupported
+}
@@ -0,0 +1,111 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestOS_OpenMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.db")
+
+	if _, err := OS.Open(path, 0); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected fs.ErrNotExist, got %v", err)
+	}
+	if exists, err := OS.Exists(path); err != nil || exists {
+		t.Fatalf("Expected missing file, got exists=%v err=%v", exists, err)
+	}
+	if err := OS.Delete(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected fs.ErrNotExist on delete, got %v", err)
+	}
+}
+
+func TestOS_ReadWriteTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	f, err := OS.Open(path, OpenCreate)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt([]byte("hello"), 10); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if size, _ := f.Size(); size != 15 {
+		t.Errorf("Expected size 15, got %d", size)
+	}
+
+	buf := make([]byte, 8)
+	n, err := f.ReadAt(buf, 10)
+	if err != io.EOF || n != 5 || string(buf[:n]) != "hello" {
+		t.Errorf("Expected short read of hello with io.EOF, got %q, %v", buf[:n], err)
+	}
+
+	if err := f.Truncate(12); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	if size, _ := f.Size(); size != 12 {
+		t.Errorf("Expected size 12, got %d", size)
+	}
+
+	if exists, _ := OS.Exists(path); !exists {
+		t.Error("Expected file to exist")
+	}
+	f.Close()
+	if err := OS.Delete(path); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+}
+
+func TestOS_LockConflicts(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("record locks only conflict between files of one process on Linux")
+	}
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	f1, err := OS.Open(path, OpenCreate)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer f1.Close()
+	f2, err := OS.Open(path, 0)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer f2.Close()
+
+	if err := f1.Lock(ReadLock, 100, 10); err != nil {
+		t.Fatalf("Failed to read lock: %v", err)
+	}
+	if err := f2.Lock(ReadLock, 100, 10); err != nil {
+		t.Fatalf("Expected read locks to overlap, got %v", err)
+	}
+	if err := f2.Lock(WriteLock, 105, 1); !errors.Is(err, ErrBusy) {
+		t.Fatalf("Expected ErrBusy, got %v", err)
+	}
+
+	// Outside the locked range there is no conflict
+	if err := f2.Lock(WriteLock, 200, 1); err != nil {
+		t.Fatalf("Failed to write lock: %v", err)
+	}
+
+	if err := f1.Lock(Unlock, 100, 10); err != nil {
+		t.Fatalf("Failed to unlock: %v", err)
+	}
+	if err := f2.Lock(WriteLock, 100, 10); err != nil {
+		t.Fatalf("Expected write lock after unlock, got %v", err)
+	}
+
+	// Closing a file releases its locks
+	f2.Close()
+	if err := f1.Lock(WriteLock, 100, 10); err != nil {
+		t.Fatalf("Expected write lock after close, got %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build unix && !linux
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockRange applies a non-blocking lock to a byte range of f
+// POSIX record locks belong to the process, so two pagers on the same file
+// within one process do not exclude each other on these platforms.
+func lockRange(f *os.File, typ LockType, start, length int64) error {
+	lk := syscall.Flock_t{
+		Whence: 0,
+		Start:  start,
+		Len:    length,
+	}
+	switch typ {
+	case ReadLock:
+		lk.Type = syscall.F_RDLCK
+	case WriteLock:
+		lk.Type = syscall.F_WRLCK
+	default:
+		lk.Type = syscall.F_UNLCK
+	}
+
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var lockErr error
+	if err := conn.Control(func(fd uintptr) {
+		lockErr = syscall.FcntlFlock(fd, syscall.F_SETLK, &lk)
+	}); err != nil {
+		return err
+	}
+	if lockErr == syscall.EAGAIN || lockErr == syscall.EACCES {
+		return ErrBusy
+	}
+	return lockErr
+}
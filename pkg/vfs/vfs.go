@@ -0,0 +1,82 @@
+// Package vfs abstracts the storage MashDB runs on
+// The pager reaches the database file, its write-ahead log and its rollback
+// journal only through an FS, so databases can live on anything that
+// implements these interfaces. OS is the implementation backed by the local
+// file system; MemFS keeps every file in memory.
+package vfs
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	// ErrBusy is returned by File.Lock when a conflicting lock is held elsewhere
+	ErrBusy = errors.New("lock is held by another process")
+
+	// ErrLockingUnsupported is returned by File.Lock where the platform has
+	// no advisory record locks
+	ErrLockingUnsupported = errors.New("file locking is not supported on this platform")
+)
+
+// OpenFlag controls how FS.Open opens a file
+type OpenFlag int
+
+const (
+	// OpenCreate creates the file if it does not exist
+	OpenCreate OpenFlag = 1 << iota
+)
+
+// LockType is the kind of byte-range lock requested from File.Lock
+type LockType int
+
+const (
+	// ReadLock is a shared lock; any number of holders may overlap
+	ReadLock LockType = iota
+
+	// WriteLock is an exclusive lock; it conflicts with every other lock
+	WriteLock
+
+	// Unlock releases whatever locks the file holds on the range
+	Unlock
+)
+
+// FS opens and removes files by name
+// Errors for missing files must satisfy errors.Is(err, fs.ErrNotExist).
+type FS interface {
+	// Open opens a file for reading and writing
+	Open(name string, flag OpenFlag) (File, error)
+
+	// Delete removes a file
+	Delete(name string) error
+
+	// Exists reports whether a file exists
+	Exists(name string) (bool, error)
+}
+
+// File is an open file of an FS
+// Reads past the end of the file return io.EOF like os.File does; writes past
+// the end grow the file.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// Sync makes every write so far durable
+	Sync() error
+
+	// Truncate changes the size of the file
+	Truncate(size int64) error
+
+	// Size returns the current size of the file in bytes
+	Size() (int64, error)
+
+	// Lock applies an advisory lock to a byte range without waiting
+	// A lock that conflicts with one held through another File fails with
+	// ErrBusy. Locks held through the same File replace each other, as with
+	// POSIX record locks. Without locking support it fails with
+	// ErrLockingUnsupported.
+	Lock(typ LockType, start, length int64) error
+
+	// Close releases the file and every lock held through it
+	Close() error
+}